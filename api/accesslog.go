@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AccessRecord is the access log record of the request, Files and Points
+// are the DEFs and the points fetched by the queries, Duration is in
+// seconds.
+type AccessRecord struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	User     string    `json:"user,omitempty"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration"`
+	Files    int       `json:"files"`
+	Points   int       `json:"points"`
+}
+
+type accessKey int
+
+const recordKey accessKey = 0
+
+func accessRecord(ctx context.Context) *AccessRecord {
+	rec, _ := ctx.Value(recordKey).(*AccessRecord)
+	return rec
+}
+
+// SetAccessUser sets the user of the request's access log record.
+func SetAccessUser(r *http.Request, user string) {
+	if rec := accessRecord(r.Context()); rec != nil {
+		rec.User = user
+	}
+}
+
+// addAccessStats adds the fetched DEFs and points to the access log record
+// of the query context.
+func addAccessStats(ctx context.Context, files, points int) {
+	if rec := accessRecord(ctx); rec != nil {
+		rec.Files += files
+		rec.Points += points
+	}
+}
+
+// clf formats the record in the Common Log Format followed by the duration,
+// the files and the points.
+func (rec *AccessRecord) clf() string {
+	user := rec.User
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %.3f %d %d\n",
+		rec.Remote, user, rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(rec.Method+" "+rec.Path), rec.Status, rec.Bytes, rec.Duration, rec.Files, rec.Points)
+}
+
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// AccessLogHandler writes the access log record of every request to Out in
+// JSON or in the Common Log Format. The user is set by SetAccessUser of the
+// inner handler.
+type AccessLogHandler struct {
+	Out  io.Writer
+	JSON bool
+
+	handler http.Handler
+}
+
+func NewAccessLogHandler(out io.Writer, handler http.Handler) *AccessLogHandler {
+	return &AccessLogHandler{Out: out, handler: handler}
+}
+
+func (h *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &AccessRecord{
+		Time:   time.Now(),
+		Remote: RemoteIP(r),
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+	}
+	aw := &accessWriter{ResponseWriter: w}
+
+	h.handler.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), recordKey, rec)))
+
+	rec.Duration = time.Since(rec.Time).Seconds()
+	rec.Status, rec.Bytes = aw.status, aw.bytes
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+
+	var line []byte
+	if h.JSON {
+		line, _ = json.Marshal(rec)
+		line = append(line, '\n')
+	} else {
+		line = []byte(rec.clf())
+	}
+	h.Out.Write(line)
+}
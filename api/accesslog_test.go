@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLogHandler(test *testing.T) {
+	api := NewAPI("")
+	api.Storage = newTestMemoryStorage()
+
+	query := `/query?start=2000.01.02-00:59:59&end=2000.01.02-01:05:00&step=1m` +
+		`&query=DEF:A=server1.net/cpu-0/cpu-system:value:AVERAGE` +
+		`&query=DEF:B=server1.net/cpu-1/cpu-system:value:AVERAGE` +
+		`&query=CDEF:C=A,B,%2B`
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			SetAccessUser(r, "alice")
+		}
+
+		switch r.URL.Path {
+		case "/query":
+			api.QueryGetHandler(w, r)
+		case "/info":
+			api.InfoHandler(w, r)
+		default:
+			w.Write([]byte("index"))
+		}
+	})
+
+	cases := []struct {
+		url  string
+		user bool
+		want AccessRecord
+	}{
+		{query, true, AccessRecord{Method: "GET", Path: query, User: "alice", Status: http.StatusOK, Files: 2, Points: 21}},
+		{"/info?metric=missing", false, AccessRecord{Method: "GET", Path: "/info?metric=missing", Status: http.StatusBadRequest}},
+		{"/", false, AccessRecord{Method: "GET", Path: "/", Status: http.StatusOK, Bytes: 5}},
+	}
+
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		handler := NewAccessLogHandler(out, inner)
+		handler.JSON = true
+
+		req, _ := http.NewRequest("GET", "http://127.0.0.1"+c.url, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if c.user {
+			req.Header.Set("Authorization", "Bearer x")
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		rec := AccessRecord{}
+		if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+			test.Fatalf("Incorrect record '%v': %v", out.String(), err)
+		}
+
+		if c.want.Bytes == 0 {
+			c.want.Bytes = int64(w.Body.Len())
+		}
+		if rec.Remote != "10.0.0.1" || rec.Method != c.want.Method || rec.Path != c.want.Path || rec.User != c.want.User ||
+			rec.Status != c.want.Status || rec.Bytes != c.want.Bytes || rec.Files != c.want.Files || rec.Points != c.want.Points {
+			test.Errorf("%v\nResult: %+v\nWant:   %+v\n", c.url, rec, c.want)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	NewAccessLogHandler(out, inner).ServeHTTP(httptest.NewRecorder(), req)
+
+	clf := regexp.MustCompile(`^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /" 200 5 \d+\.\d{3} 0 0\n$`)
+	if !clf.MatchString(out.String()) {
+		test.Errorf("Incorrect Common Log Format record '%v'", out.String())
+	}
+}
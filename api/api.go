@@ -1,24 +1,41 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rrdserver/rrdserver/log"
+	"github.com/rrdserver/rrdserver/writer"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type API struct {
-	DataDir string
+	Storage Storage
+	Writer  writer.Sink
+
+	// Allow returns the access check of the request user's metrics, nil
+	// allows all of them.
+	Allow func(r *http.Request) func(metric string) bool
+
+	// Xports limits the concurrent query executions, nil doesn't limit
+	// them.
+	Xports *Semaphore
+
+	// QueryTimeout limits the duration of the queries, MaxPoints the number
+	// of the points they fetch and compute, zero doesn't limit them.
+	QueryTimeout time.Duration
+	MaxPoints    int
 }
 
 func NewAPI(dataDir string) API {
 	return API{
-		DataDir: dataDir,
+		Storage: NewFileStorage(dataDir),
 	}
 }
 
@@ -26,16 +43,55 @@ func (api *API) Serve(router *mux.Router) {
 	router.Methods("GET").Path("/suggest/metrics").HandlerFunc(api.SuggestMetricsGetHandler)
 	router.Methods("POST").Path("/suggest/metrics").HandlerFunc(api.SuggestMetricsPostHandler)
 
+	router.Methods("GET").Path("/info").HandlerFunc(api.InfoHandler)
+	router.Methods("GET").Path("/tree").HandlerFunc(api.TreeHandler)
+
 	router.Methods("GET").Path("/query").HandlerFunc(api.QueryGetHandler)
 	router.Methods("POST").Path("/query").HandlerFunc(api.QueryPostHandler)
+
+	router.Methods("POST").Path("/write").HandlerFunc(api.WriteHandler)
+	router.Methods("POST").Path("/v1/metrics").HandlerFunc(api.OTLPMetricsHandler)
 }
 
-func (api *API) CommonHeader(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// forRequest returns the API limited by the access check of the request user.
+func (api *API) forRequest(r *http.Request) *API {
+	if api.Allow == nil {
+		return api
+	}
 
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
+	allow := api.Allow(r)
+	if allow == nil {
+		return api
 	}
+
+	res := *api
+	res.Storage = NewACLStorage(api.Storage, allow)
+	return &res
+}
+
+// accessCheck returns the access check of the request user's metrics.
+func (api *API) accessCheck(r *http.Request) func(metric string) bool {
+	if api.Allow != nil {
+		if allow := api.Allow(r); allow != nil {
+			return allow
+		}
+	}
+	return func(string) bool { return true }
+}
+
+// queryContext returns the context of the request's query, it's done on the
+// client disconnect or after QueryTimeout.
+func (api *API) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if api.QueryTimeout > 0 {
+		return context.WithTimeout(r.Context(), api.QueryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// CommonHeader sets the headers of the API responses, the CORS headers are
+// set by CORSHandler.
+func (api *API) CommonHeader(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 }
 
 type ErrorResponse struct {
@@ -57,16 +113,51 @@ func srvError(w http.ResponseWriter, httpStatus int, format string, args ...inte
 	w.Write([]byte("\n"))
 }
 
+// statusError writes the error with the status, the forbidden metrics get
+// 403 Forbidden, the exceeded limits 429 Too Many Requests, the aborted
+// queries 499 or 503.
+func statusError(w http.ResponseWriter, httpStatus int, err error) {
+	switch e := err.(type) {
+	case *ForbiddenError:
+		httpStatus = http.StatusForbidden
+	case *TooManyRequestsError:
+		httpStatus = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", e.retryAfter())
+	case *PointsLimitError:
+		httpStatus = http.StatusBadRequest
+	case *CanceledError:
+		httpStatus = e.status()
+	case *BodyTooLargeError:
+		httpStatus = http.StatusRequestEntityTooLarge
+	}
+	srvError(w, httpStatus, "%v", err)
+}
+
 func BadRequest(w http.ResponseWriter, format string, args ...interface{}) {
 	srvError(w, http.StatusBadRequest, format, args...)
 }
 
+func Forbidden(w http.ResponseWriter, format string, args ...interface{}) {
+	srvError(w, http.StatusForbidden, format, args...)
+}
+
 func InternalServerError(w http.ResponseWriter, format string, args ...interface{}) {
 	srvError(w, http.StatusInternalServerError, format, args...)
 }
 
-func (api API) FileForMetric(metric string) string {
-	return api.DataDir + SafeMetric(metric) + ".rrd"
+// PartialErrorHeader reports the failed upstreams of the partial result in
+// the X-Upstream-Error headers, the rest of the errors are returned as is.
+func PartialErrorHeader(w http.ResponseWriter, err error) error {
+	partial, ok := err.(*PartialError)
+	if !ok {
+		return err
+	}
+
+	for _, e := range partial.Errors {
+		log.Warning("%v", e)
+		w.Header().Add("X-Upstream-Error", e.Error())
+	}
+	return nil
 }
 
 func SafeMetric(metric string) string {
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CollectdTags are the parts of the collectd metric path:
+// <host>/<plugin>[-<plugin_instance>]/<type>[-<type_instance>]
+type CollectdTags struct {
+	Host           string `json:"host"`
+	Plugin         string `json:"plugin"`
+	PluginInstance string `json:"plugin_instance"`
+	Type           string `json:"type"`
+	TypeInstance   string `json:"type_instance"`
+}
+
+var collectdTagNames = []string{"host", "plugin", "plugin_instance", "type", "type_instance"}
+
+// ParseCollectdMetric splits the metric path into the collectd tags, the
+// leading segments of the longer paths (like the namespace) are ignored.
+// The plugin and type names don't contain '-', so the first '-' separates
+// the instance.
+func ParseCollectdMetric(metric string) (CollectdTags, bool) {
+	items := strings.Split(strings.Trim(metric, "/"), "/")
+	if len(items) < 3 {
+		return CollectdTags{}, false
+	}
+	items = items[len(items)-3:]
+
+	res := CollectdTags{Host: items[0]}
+	res.Plugin, res.PluginInstance = splitInstance(items[1])
+	res.Type, res.TypeInstance = splitInstance(items[2])
+
+	if res.Host == "" || res.Plugin == "" || res.Type == "" {
+		return CollectdTags{}, false
+	}
+	return res, true
+}
+
+func splitInstance(s string) (name, instance string) {
+	items := strings.SplitN(s, "-", 2)
+	if len(items) == 2 {
+		return items[0], items[1]
+	}
+	return items[0], ""
+}
+
+func (t CollectdTags) Get(name string) string {
+	switch name {
+	case "host":
+		return t.Host
+	case "plugin":
+		return t.Plugin
+	case "plugin_instance":
+		return t.PluginInstance
+	case "type":
+		return t.Type
+	case "type_instance":
+		return t.TypeInstance
+	}
+	return ""
+}
+
+// TagFilter is the list of the tag=pattern conditions, the patterns are
+// shell patterns like web*. The metric should match all of them.
+type TagFilter map[string]string
+
+// ParseTagFilter parses the filter like "host=web*,plugin=interface".
+func ParseTagFilter(s string) (TagFilter, error) {
+	res := TagFilter{}
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Incorrect tag filter '%v', should be tag=pattern", item)
+		}
+
+		name, pattern := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !isCollectdTag(name) {
+			return nil, fmt.Errorf("Unknown tag '%v', should be one of %v", name, strings.Join(collectdTagNames, ", "))
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Incorrect pattern '%v' of the tag '%v'", pattern, name)
+		}
+
+		if _, ok := res[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag '%v' in the filter", name)
+		}
+		res[name] = pattern
+	}
+
+	return res, nil
+}
+
+// ParseTagSelector parses the tag filter of the DEF metric like
+// "{host=web1,plugin=interface}", ok is false for the metric paths.
+func ParseTagSelector(metric string) (filter TagFilter, ok bool, err error) {
+	if !strings.HasPrefix(metric, "{") || !strings.HasSuffix(metric, "}") {
+		return nil, false, nil
+	}
+
+	filter, err = ParseTagFilter(metric[1 : len(metric)-1])
+	if err == nil && len(filter) == 0 {
+		err = fmt.Errorf("Empty tag selector '%v'", metric)
+	}
+	return filter, true, err
+}
+
+func isCollectdTag(name string) bool {
+	for _, n := range collectdTagNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Match checks the tags of the metric, the non collectd metrics match
+// only the empty filter.
+func (f TagFilter) Match(metric string) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	tags, ok := ParseCollectdMetric(metric)
+	if !ok {
+		return false
+	}
+
+	for name, pattern := range f {
+		if ok, _ := path.Match(pattern, tags.Get(name)); !ok {
+			return false
+		}
+	}
+	return true
+}
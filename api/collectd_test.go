@@ -0,0 +1,67 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestParseCollectdMetric(test *testing.T) {
+	cases := []struct {
+		metric string
+		want   CollectdTags
+		ok     bool
+	}{
+		{"server1.net/interface-eth0/if_packets", CollectdTags{"server1.net", "interface", "eth0", "if_packets", ""}, true},
+		{"server1.net/cpu-0/cpu-system", CollectdTags{"server1.net", "cpu", "0", "cpu", "system"}, true},
+		{"server1.net/load/load", CollectdTags{"server1.net", "load", "", "load", ""}, true},
+		{"server1.net/df-var-lib/df_complex-used", CollectdTags{"server1.net", "df", "var-lib", "df_complex", "used"}, true},
+		{"dc1/server1.net/load/load", CollectdTags{"server1.net", "load", "", "load", ""}, true},
+		{"/server1.net/load/load/", CollectdTags{"server1.net", "load", "", "load", ""}, true},
+		{"server1.net/load", CollectdTags{}, false},
+		{"server1.net/-0/load", CollectdTags{}, false},
+		{"", CollectdTags{}, false},
+	}
+
+	for _, c := range cases {
+		res, ok := ParseCollectdMetric(c.metric)
+		if ok != c.ok || res != c.want {
+			test.Errorf("Metric: %s\nResult: %+v %v\nWant:   %+v %v\n", c.metric, res, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestTagFilter(test *testing.T) {
+	cases := []struct {
+		filter string
+		metric string
+		want   bool
+	}{
+		{"", "server1.net/load/load", true},
+		{"", "notcollectd", true},
+		{"host=web*", "web1.net/load/load", true},
+		{"host=web*", "db1.net/load/load", false},
+		{"host=web*,plugin=interface", "web1.net/interface-eth0/if_packets", true},
+		{"host=web*, plugin=interface", "web1.net/cpu-0/cpu-system", false},
+		{"plugin_instance=eth?", "web1.net/interface-eth0/if_packets", true},
+		{"type_instance=", "web1.net/interface-eth0/if_packets", true},
+		{"type_instance=", "web1.net/cpu-0/cpu-system", false},
+		{"type=if_*", "notcollectd", false},
+	}
+
+	for _, c := range cases {
+		f, err := ParseTagFilter(c.filter)
+		if err != nil {
+			test.Errorf("Filter: %s\nUnexpected error: %v", c.filter, err)
+			continue
+		}
+
+		if res := f.Match(c.metric); res != c.want {
+			test.Errorf("Filter: %s\nMetric: %s\nResult: %v\nWant:   %v\n", c.filter, c.metric, res, c.want)
+		}
+	}
+
+	for _, filter := range []string{"host", "color=red", "host=[", "host=a,host=b"} {
+		if _, err := ParseTagFilter(filter); err == nil {
+			test.Errorf("Filter: %s\nError expected", filter)
+		}
+	}
+}
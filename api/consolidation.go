@@ -24,7 +24,7 @@ func (c *Consolidation) String() string {
 	case CFMIN:
 		return "MIN"
 	case CFLAST:
-		return "LASTMAX"
+		return "LAST"
 	}
 	return "AVERAGE"
 }
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CORS is the cross-origin policy of the API. The origins are the exact
+// values or the path.Match patterns ("https://*.example.com"), "*" allows
+// any origin without the credentials. No origins disable CORS.
+type CORS struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Expose      []string
+	MaxAge      int
+	Credentials bool
+}
+
+func DefaultCORS() CORS {
+	return CORS{
+		Methods: []string{"GET", "POST", "OPTIONS"},
+		Headers: []string{"Authorization", "Content-Type", "Content-Encoding", "Accept-Encoding"},
+		Expose:  []string{"X-Total-Count", "X-Upstream-Error"},
+		MaxAge:  600,
+	}
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for the
+// origin, the empty string if it isn't allowed.
+func (c CORS) allowOrigin(origin string) string {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return "*"
+		}
+
+		if ok, err := path.Match(o, origin); o == origin || (err == nil && ok) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CORSHandler applies the policy to the requests and answers the preflight
+// requests, so they don't reach the authentication.
+type CORSHandler struct {
+	CORS
+
+	handler http.Handler
+}
+
+func NewCORSHandler(cors CORS, handler http.Handler) *CORSHandler {
+	return &CORSHandler{CORS: cors, handler: handler}
+}
+
+func (c *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	allow := c.allowOrigin(origin)
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if allow != "" {
+		w.Header().Set("Access-Control-Allow-Origin", allow)
+		if c.Credentials && allow != "*" {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(c.Expose) > 0 && !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.Expose, ", "))
+		}
+	}
+
+	if !preflight {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if allow != "" {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
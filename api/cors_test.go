@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSHandler(test *testing.T) {
+	cors := DefaultCORS()
+	cors.Origins = []string{"https://grafana.example.com", "https://*.dev.example.com"}
+	cors.Credentials = true
+
+	anyOrigin := DefaultCORS()
+	anyOrigin.Origins = []string{"*"}
+	anyOrigin.Credentials = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+
+	cases := []struct {
+		cors        CORS
+		method      string
+		origin      string
+		preflight   bool
+		code        int
+		body        string
+		allow       string
+		credentials string
+		methods     string
+	}{
+		{cors, "GET", "", false, http.StatusOK, "next", "", "", ""},
+		{cors, "GET", "https://grafana.example.com", false, http.StatusOK, "next", "https://grafana.example.com", "true", ""},
+		{cors, "GET", "https://a.dev.example.com", false, http.StatusOK, "next", "https://a.dev.example.com", "true", ""},
+		{cors, "GET", "https://evil.com", false, http.StatusOK, "next", "", "", ""},
+		{cors, "GET", "https://grafana.example.com.evil.com", false, http.StatusOK, "next", "", "", ""},
+		{cors, "OPTIONS", "https://grafana.example.com", true, http.StatusNoContent, "", "https://grafana.example.com", "true", "GET, POST, OPTIONS"},
+		{cors, "OPTIONS", "https://evil.com", true, http.StatusNoContent, "", "", "", ""},
+		{cors, "OPTIONS", "https://grafana.example.com", false, http.StatusOK, "next", "https://grafana.example.com", "true", ""},
+		{anyOrigin, "GET", "https://evil.com", false, http.StatusOK, "next", "*", "", ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://127.0.0.1/query", nil)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.preflight {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		w := httptest.NewRecorder()
+		NewCORSHandler(c.cors, next).ServeHTTP(w, req)
+
+		h := w.Header()
+		if w.Code != c.code || w.Body.String() != c.body ||
+			h.Get("Access-Control-Allow-Origin") != c.allow ||
+			h.Get("Access-Control-Allow-Credentials") != c.credentials ||
+			h.Get("Access-Control-Allow-Methods") != c.methods {
+			test.Errorf("%v %v preflight=%v\nResult: %v '%v' %v\nWant:   %v '%v' allow=%v credentials=%v methods=%v\n",
+				c.method, c.origin, c.preflight, w.Code, w.Body.String(), h, c.code, c.body, c.allow, c.credentials, c.methods)
+		}
+	}
+}
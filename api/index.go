@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rrdserver/rrdserver/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Index keeps the metric names and data sources of the storage in memory,
+// so the suggest and tree requests don't walk the data directories. It's
+// built in the background, the requests go to the storage until it's ready.
+// The new and removed files of the watched directories start the rescan,
+// the data sources of the known metrics are reread only by the periodic one.
+type Index struct {
+	Storage Storage
+
+	// Interval of the full rescans, Delay collects the file events into
+	// one rescan.
+	Interval time.Duration
+	Delay    time.Duration
+
+	dirs []string
+	stop chan struct{}
+
+	mutex          sync.RWMutex
+	ready          bool
+	metrics        []string
+	ds             map[string][]string
+	lastRescan     time.Time
+	rescanDuration time.Duration
+	lastError      string
+	watched        int
+}
+
+type IndexStatus struct {
+	Ready          bool     `json:"ready"`
+	Metrics        int      `json:"metrics"`
+	DataSources    int      `json:"dataSources"`
+	LastRescan     *Time    `json:"lastRescan,omitempty"`
+	RescanDuration Duration `json:"rescanDuration"`
+	WatchedDirs    int      `json:"watchedDirs"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// NewIndex creates the index of the storage, the dirs are watched for the
+// new and removed files.
+func NewIndex(storage Storage, interval time.Duration, dirs ...string) *Index {
+	return &Index{
+		Storage:  storage,
+		Interval: interval,
+		Delay:    time.Second,
+		dirs:     dirs,
+		stop:     make(chan struct{}),
+		ds:       make(map[string][]string),
+	}
+}
+
+// Start builds the index and keeps it fresh in the background.
+func (idx *Index) Start() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warning("Can't watch the data directories: %v", err)
+		watcher = nil
+	}
+
+	if watcher != nil {
+		for _, dir := range idx.dirs {
+			idx.watchDir(watcher, dir)
+		}
+	}
+
+	go func() {
+		idx.Rescan(true)
+		idx.run(watcher)
+	}()
+}
+
+func (idx *Index) Stop() {
+	close(idx.stop)
+}
+
+// watchDir adds the directory and its subdirectories to the watcher,
+// inotify isn't recursive.
+func (idx *Index) watchDir(watcher *fsnotify.Watcher, dir string) {
+	count := 0
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return nil
+		}
+
+		if err := watcher.Add(path); err != nil {
+			log.Warning("Can't watch '%v': %v", path, err)
+			return nil
+		}
+		count++
+		return nil
+	})
+
+	idx.mutex.Lock()
+	idx.watched += count
+	idx.mutex.Unlock()
+}
+
+func (idx *Index) run(watcher *fsnotify.Watcher) {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	var ticker <-chan time.Time
+	if idx.Interval > 0 {
+		t := time.NewTicker(idx.Interval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+
+			// The updates of the files don't change the index.
+			if ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			if ev.Op&fsnotify.Create != 0 && isDir(ev.Name) {
+				idx.watchDir(watcher, ev.Name)
+			}
+
+			if pending == nil {
+				pending = time.After(idx.Delay)
+			}
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Warning("Index watcher error: %v", err)
+
+		case <-pending:
+			pending = nil
+			idx.Rescan(false)
+
+		case <-ticker:
+			idx.Rescan(true)
+
+		case <-idx.stop:
+			return
+		}
+	}
+}
+
+// Rescan rebuilds the index, the data sources of the known metrics are
+// reread only by the full rescan.
+func (idx *Index) Rescan(full bool) error {
+	start := time.Now()
+
+	metrics, err := idx.Storage.ListMetrics("")
+	if _, ok := err.(*PartialError); err != nil && !ok {
+		log.Warning("Can't rescan the index: %v", err)
+		idx.mutex.Lock()
+		idx.lastError = err.Error()
+		idx.mutex.Unlock()
+		return err
+	}
+
+	idx.mutex.RLock()
+	known := idx.ds
+	idx.mutex.RUnlock()
+
+	ds := make(map[string][]string)
+	for _, m := range metrics {
+		if d, ok := known[m]; ok && !full {
+			ds[m] = d
+			continue
+		}
+
+		// The failed metric is kept in the index, its data sources are
+		// requested from the storage.
+		if d, e := idx.Storage.DataSources(m); e == nil {
+			ds[m] = d
+		}
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.ready = true
+	idx.metrics = metrics
+	idx.ds = ds
+	idx.lastRescan = start
+	idx.rescanDuration = time.Since(start)
+	idx.lastError = ""
+	if err != nil {
+		idx.lastError = err.Error()
+	}
+
+	return err
+}
+
+func (idx *Index) ListMetrics(prefix string) ([]string, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if !idx.ready {
+		return idx.Storage.ListMetrics(prefix)
+	}
+
+	prefix = SafeMetric(strings.TrimRight(prefix, "/"))
+
+	// The metrics are sorted, so the matched ones follow each other.
+	i := sort.SearchStrings(idx.metrics, prefix)
+	exact := i < len(idx.metrics) && idx.metrics[i] == prefix
+
+	res := []string{}
+	for ; i < len(idx.metrics) && strings.HasPrefix(idx.metrics[i], prefix); i++ {
+		if hasMetricPrefix(idx.metrics[i], prefix, exact) {
+			res = append(res, idx.metrics[i])
+		}
+	}
+	return res, nil
+}
+
+func (idx *Index) DataSources(metric string) ([]string, error) {
+	idx.mutex.RLock()
+	ds, ok := idx.ds[SafeMetric(metric)]
+	idx.mutex.RUnlock()
+
+	if ok {
+		return ds, nil
+	}
+	return idx.Storage.DataSources(metric)
+}
+
+func (idx *Index) Info(metric string) (MetricInfo, error) {
+	return idx.Storage.Info(metric)
+}
+
+func (idx *Index) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	return idx.Storage.Fetch(ctx, metric, cf, start, end, step)
+}
+
+func (idx *Index) Status() IndexStatus {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	res := IndexStatus{
+		Ready:          idx.ready,
+		Metrics:        len(idx.metrics),
+		RescanDuration: Duration(idx.rescanDuration),
+		WatchedDirs:    idx.watched,
+		Error:          idx.lastError,
+	}
+
+	if idx.ready {
+		t := Time(idx.lastRescan)
+		res.LastRescan = &t
+	}
+
+	for _, ds := range idx.ds {
+		res.DataSources += len(ds)
+	}
+	return res
+}
+
+func (idx *Index) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(idx.Status()); err != nil {
+		InternalServerError(w, "%v", err)
+		return
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitMetrics waits for the index to catch up with the file events.
+func waitMetrics(index *Index, prefix string, want []string) ([]string, error) {
+	var res []string
+	var err error
+
+	for i := 0; i < 100; i++ {
+		res, err = index.ListMetrics(prefix)
+		if err == nil && reflect.DeepEqual(res, want) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return res, err
+}
+
+func TestIndex(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	for _, f := range []string{"server1/load/x.wsp", "server1/load/y.wsp", "server2/load.wsp", "server2/load/x.wsp"} {
+		if err := writeTestWhisper(dir+f, 60, testFirstRow, []float64{1, 2, 3}); err != nil {
+			test.Fatalf("Can't write test file: %v", err)
+		}
+	}
+
+	index := NewIndex(NewWhisperStorage(dir), time.Hour, dir)
+	index.Delay = 10 * time.Millisecond
+	index.Start()
+	defer index.Stop()
+
+	for i := 0; i < 100 && !index.Status().Ready; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !index.Status().Ready {
+		test.Fatalf("The index isn't built")
+	}
+
+	want := []string{"server1/load/x", "server1/load/y", "server2/load", "server2/load/x"}
+	if res, err := waitMetrics(index, "", want); err != nil || !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics: %v %v\nWant:               %v", res, err, want)
+	}
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"server1/", []string{"server1/load/x", "server1/load/y"}},
+		{"server1/load/x", []string{"server1/load/x"}},
+		{"server1/load/x/", []string{"server1/load/x"}},
+		{"server", []string{"server1/load/x", "server1/load/y", "server2/load", "server2/load/x"}},
+		{"server2/load", []string{"server2/load", "server2/load/x"}},
+		{"server2/lo", []string{"server2/load", "server2/load/x"}},
+		{"notexists", []string{}},
+	}
+
+	for _, c := range cases {
+		res, err := index.ListMetrics(c.prefix)
+		if err != nil || !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Prefix: %s\nResult: %v %v\nWant:   %v\n", c.prefix, res, err, c.want)
+		}
+	}
+
+	if ds, err := index.DataSources("server1/load/x"); err != nil || !reflect.DeepEqual(ds, []string{"value"}) {
+		test.Errorf("Incorrect DS: %v %v", ds, err)
+	}
+
+	// The new directory is watched as well.
+	if err := writeTestWhisper(dir+"server3/load/x.wsp", 60, testFirstRow, []float64{1}); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if err := os.Remove(dir + "server1/load/y.wsp"); err != nil {
+		test.Fatalf("Can't remove test file: %v", err)
+	}
+
+	want = []string{"server1/load/x", "server2/load", "server2/load/x", "server3/load/x"}
+	if res, err := waitMetrics(index, "", want); err != nil || !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics after the file events: %v %v\nWant:               %v", res, err, want)
+	}
+
+	// The new file of the new directory created before its watch is found
+	// by the next rescan.
+	if err := writeTestWhisper(dir+"server3/cpu/x.wsp", 60, testFirstRow, []float64{1}); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+
+	want = []string{"server3/cpu/x", "server3/load/x"}
+	if res, err := waitMetrics(index, "server3/", want); err != nil || !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics of the new directory: %v %v\nWant:               %v", res, err, want)
+	}
+
+	j := MakeGetRequest(test, index.StatusHandler, "")
+	status := struct {
+		Ready       bool   `json:"ready"`
+		Metrics     int    `json:"metrics"`
+		DataSources int    `json:"dataSources"`
+		LastRescan  *Time  `json:"lastRescan"`
+		WatchedDirs int    `json:"watchedDirs"`
+		Error       string `json:"error"`
+	}{}
+	if err := json.Unmarshal([]byte(j), &status); err != nil {
+		test.Fatalf("Incorrect status '%v': %v", j, err)
+	}
+
+	if !status.Ready || status.LastRescan == nil || status.Metrics != 5 || status.DataSources != 5 || status.WatchedDirs < 5 || status.Error != "" {
+		test.Errorf("Incorrect status: %v", j)
+	}
+}
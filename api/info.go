@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type InfoResponse struct {
+	Metric     string            `json:"metric"`
+	Step       Duration          `json:"step"`
+	LastUpdate Time              `json:"lastUpdate"`
+	DS         []string          `json:"ds"`
+	Title      string            `json:"title,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+func (api *API) InfoHandler(w http.ResponseWriter, r *http.Request) {
+	api = api.forRequest(r)
+	api.CommonHeader(w, r)
+
+	metric := r.FormValue("metric")
+	if metric == "" {
+		BadRequest(w, "Missing parameter 'metric' in the request.")
+		return
+	}
+
+	inf, err := api.Storage.Info(metric)
+	if err != nil {
+		statusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res := InfoResponse{
+		Metric:     SafeMetric(metric),
+		Step:       Duration(inf.Step),
+		LastUpdate: Time(inf.LastUpdate),
+		DS:         inf.DS,
+		Title:      inf.Title,
+		Labels:     inf.Labels,
+	}
+	if res.DS == nil {
+		res.DS = []string{}
+	}
+	if inf.LastUpdate.IsZero() {
+		res.LastUpdate = Time(time.Unix(0, 0))
+	}
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		InternalServerError(w, "%v", err)
+		return
+	}
+}
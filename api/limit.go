@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TooManyRequestsError is returned when the client is over its limit, it's
+// reported as 429 Too Many Requests with Retry-After.
+type TooManyRequestsError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return e.Message
+}
+
+// retryAfter returns the Retry-After value in whole seconds, at least 1.
+func (e *TooManyRequestsError) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(e.RetryAfter.Seconds()))))
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is the token bucket of every key: it has up to Burst tokens,
+// Rate tokens per second are added, every request takes one.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	cleaned time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take takes the token of the key, it returns 0 if it's taken or the time
+// until the next token.
+func (l *RateLimiter) Take(key string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.cleanup(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.Burst), b.tokens+elapsed*l.Rate)
+		b.updated = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	if l.Rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// cleanup drops the buckets which are refilled, so the limiter doesn't grow
+// with the number of the clients. The mutex should be locked.
+func (l *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.cleaned) < time.Minute || l.Rate <= 0 {
+		return
+	}
+	l.cleaned = now
+
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitHandler limits the requests of every client, Key returns the
+// client of the request, by default it's the remote IP. The requests Skip
+// returns true for aren't limited.
+type RateLimitHandler struct {
+	Limiter *RateLimiter
+	Key     func(r *http.Request) string
+	Skip    func(r *http.Request) bool
+
+	handler http.Handler
+}
+
+func NewRateLimitHandler(limiter *RateLimiter, handler http.Handler) *RateLimitHandler {
+	return &RateLimitHandler{
+		Limiter: limiter,
+		Key:     RemoteIP,
+		handler: handler,
+	}
+}
+
+func (h *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" || (h.Skip != nil && h.Skip(r)) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := h.Key(r)
+	if wait := h.Limiter.Take(key, time.Now()); wait > 0 {
+		statusError(w, http.StatusTooManyRequests, &TooManyRequestsError{
+			Message:    fmt.Sprintf("Rate limit of '%v' is exceeded", key),
+			RetryAfter: wait,
+		})
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// RemoteIP returns the IP address of the client.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Semaphore limits the number of the concurrent executions, the nil one
+// doesn't limit them. Acquire waits for the free slot up to Wait.
+type Semaphore struct {
+	Wait time.Duration
+
+	slots chan struct{}
+}
+
+func NewSemaphore(n int, wait time.Duration) *Semaphore {
+	return &Semaphore{Wait: wait, slots: make(chan struct{}, n)}
+}
+
+// Acquire takes the slot, it returns the error of the context if it's done
+// while waiting.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if s.Wait > 0 {
+		timer := time.NewTimer(s.Wait)
+		defer timer.Stop()
+
+		select {
+		case s.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return &TooManyRequestsError{
+		Message:    fmt.Sprintf("Too many concurrent queries, the limit is %v", cap(s.slots)),
+		RetryAfter: time.Second,
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+// StatusClientClosedRequest is the status of the queries aborted on the
+// client disconnect, the client doesn't get it, but it's logged.
+const StatusClientClosedRequest = 499
+
+// CanceledError is returned when the query is aborted on the client
+// disconnect or on the timeout, it's reported as 499 or 503 Service
+// Unavailable.
+type CanceledError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *CanceledError) Error() string {
+	if e.Err == context.DeadlineExceeded {
+		return fmt.Sprintf("Query is aborted, it takes longer than %v", e.Timeout)
+	}
+	return "Query is aborted, the client closed the connection"
+}
+
+func (e *CanceledError) status() int {
+	if e.Err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable
+	}
+	return StatusClientClosedRequest
+}
+
+// PointsLimitError is returned when the query fetches or computes more
+// points than the limit, it's reported as 400 Bad Request.
+type PointsLimitError struct {
+	Limit int
+}
+
+func (e *PointsLimitError) Error() string {
+	return fmt.Sprintf("Query exceeds the limit of %v points, increase the step or shorten the time range", e.Limit)
+}
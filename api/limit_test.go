@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(test *testing.T) {
+	l := NewRateLimiter(2, 3)
+	now := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		key   string
+		after time.Duration
+		wait  time.Duration
+	}{
+		{"alice", 0, 0},
+		{"alice", 0, 0},
+		{"alice", 0, 0},
+		{"alice", 0, 500 * time.Millisecond},
+		{"bob", 0, 0},
+		{"alice", 250 * time.Millisecond, 250 * time.Millisecond},
+		{"alice", 250 * time.Millisecond, 0},
+		{"alice", 0, 500 * time.Millisecond},
+		{"alice", 10 * time.Second, 0},
+		{"alice", 0, 0},
+		{"alice", 0, 0},
+		{"alice", 0, 500 * time.Millisecond},
+	}
+
+	for i, c := range cases {
+		now = now.Add(c.after)
+		if wait := l.Take(c.key, now); wait != c.wait {
+			test.Errorf("%v: %v\nResult: %v\nWant:   %v\n", i, c.key, wait, c.wait)
+		}
+	}
+
+	// The refilled buckets are dropped.
+	l.Take("bob", now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		test.Errorf("The idle buckets aren't dropped: %v", len(l.buckets))
+	}
+}
+
+func TestRateLimitHandler(test *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+	handler := NewRateLimitHandler(NewRateLimiter(0.1, 1), next)
+
+	cases := []struct {
+		method string
+		remote string
+		code   int
+		retry  string
+	}{
+		{"GET", "10.0.0.1:1234", http.StatusOK, ""},
+		{"GET", "10.0.0.1:1235", http.StatusTooManyRequests, "10"},
+		{"OPTIONS", "10.0.0.1:1236", http.StatusOK, ""},
+		{"GET", "10.0.0.2:1234", http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://127.0.0.1/query", nil)
+		req.RemoteAddr = c.remote
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != c.code || w.Header().Get("Retry-After") != c.retry {
+			test.Errorf("%v %v\nResult: %v %v\nWant:   %v %v\n", c.method, c.remote, w.Code, w.Header().Get("Retry-After"), c.code, c.retry)
+		}
+
+		if c.code == http.StatusTooManyRequests {
+			res := ErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Code != c.code {
+				test.Errorf("Incorrect error response '%v': %v", w.Body.String(), err)
+			}
+		}
+	}
+}
+
+func TestSemaphore(test *testing.T) {
+	var unlimited *Semaphore
+	if err := unlimited.Acquire(context.Background()); err != nil {
+		test.Errorf("The nil semaphore is limited: %v", err)
+	}
+	unlimited.Release()
+
+	s := NewSemaphore(2, 50*time.Millisecond)
+	if s.Acquire(context.Background()) != nil || s.Acquire(context.Background()) != nil {
+		test.Fatalf("The free slots aren't acquired")
+	}
+
+	err := s.Acquire(context.Background())
+	if _, ok := err.(*TooManyRequestsError); !ok {
+		test.Errorf("TooManyRequestsError expected, got %v", err)
+	}
+
+	// The waiting execution gets the released slot.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Release()
+	}()
+	if err := s.Acquire(context.Background()); err != nil {
+		test.Errorf("The released slot isn't acquired: %v", err)
+	}
+
+	api := API{Storage: NewMultiStorage(), Xports: NewSemaphore(1, 0)}
+	api.Xports.Acquire(context.Background())
+
+	req := QueryRequest{Queries: []QueryRequestQuery{{Query: "DEF:a=metric:value:AVERAGE"}}}
+	if _, err := api.xport(context.Background(), req); err == nil {
+		test.Errorf("The query over the limit is executed")
+	}
+
+	w := httptest.NewRecorder()
+	statusError(w, http.StatusInternalServerError, &TooManyRequestsError{Message: "limit", RetryAfter: 1500 * time.Millisecond})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		test.Errorf("Incorrect response %v %v", w.Code, w.Header())
+	}
+}
+
+// slowStorage delays the fetches like the big files do.
+type slowStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (s slowStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	time.Sleep(s.delay)
+	return s.Storage.Fetch(ctx, metric, cf, start, end, step)
+}
+
+func TestQueryLimits(test *testing.T) {
+	query := `?start=2000.01.02-00:59:59&end=2000.01.02-01:05:00&step=1m` +
+		`&query=DEF:A=server1.net/cpu-0/cpu-system:value:AVERAGE` +
+		`&query=DEF:B=server1.net/cpu-1/cpu-system:value:AVERAGE`
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		timeout   time.Duration
+		maxPoints int
+		ctx       context.Context
+		code      int
+	}{
+		{0, 0, context.Background(), http.StatusOK},
+		{time.Second, 14, context.Background(), http.StatusOK},
+		{0, 13, context.Background(), http.StatusBadRequest},
+		{0, 0, canceled, StatusClientClosedRequest},
+		{30 * time.Millisecond, 0, context.Background(), http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		api := NewAPI("")
+		api.Storage = slowStorage{newTestMemoryStorage(), 20 * time.Millisecond}
+		api.QueryTimeout = c.timeout
+		api.MaxPoints = c.maxPoints
+
+		req, _ := http.NewRequest("GET", "http://127.0.0.1/query"+query, nil)
+		w := httptest.NewRecorder()
+		api.QueryGetHandler(w, req.WithContext(c.ctx))
+
+		if w.Code != c.code {
+			test.Errorf("timeout=%v maxpoints=%v\nResult: %v %v\nWant:   %v\n", c.timeout, c.maxPoints, w.Code, w.Body.String(), c.code)
+		}
+	}
+
+	// The points of the requested step are checked before the fetches.
+	storage := &countingStorage{Storage: newTestMemoryStorage()}
+	api := NewAPI("")
+	api.Storage = storage
+	api.MaxPoints = 9
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/query"+query, nil)
+	w := httptest.NewRecorder()
+	api.QueryGetHandler(w, req)
+
+	if w.Code != http.StatusBadRequest || storage.fetches != 0 {
+		test.Errorf("Points limit isn't checked before the fetches: %v %v, %v fetches", w.Code, w.Body.String(), storage.fetches)
+	}
+}
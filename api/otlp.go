@@ -0,0 +1,326 @@
+package api
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/writer"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	metrics "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MetricWrite struct {
+	Metric string
+	Time   time.Time
+	Values []writer.DataSource
+}
+
+func attributesMap(attrs []*common.KeyValue) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range attrs {
+		v := kv.GetValue()
+		switch v.GetValue().(type) {
+		case *common.AnyValue_StringValue:
+			res[kv.GetKey()] = v.GetStringValue()
+		case *common.AnyValue_IntValue:
+			res[kv.GetKey()] = strconv.FormatInt(v.GetIntValue(), 10)
+		case *common.AnyValue_DoubleValue:
+			res[kv.GetKey()] = strconv.FormatFloat(v.GetDoubleValue(), 'f', -1, 64)
+		case *common.AnyValue_BoolValue:
+			res[kv.GetKey()] = strconv.FormatBool(v.GetBoolValue())
+		}
+	}
+	return res
+}
+
+// otlpResourcePath maps the resource to <host.name>/<service.name>,
+// both parts are optional.
+func otlpResourcePath(attrs map[string]string) string {
+	res := []string{}
+	for _, k := range []string{"host.name", "service.name"} {
+		if v := attrs[k]; v != "" {
+			res = append(res, strings.Replace(v, "/", "_", -1))
+		}
+	}
+	return strings.Join(res, "/")
+}
+
+// otlpMetricPath appends <metric name>[-<key>_<value>] to the resource path,
+// the attributes are sorted by the key like the InfluxDB tags of /write.
+func otlpMetricPath(resource, name string, attrs []*common.KeyValue) string {
+	m := attributesMap(attrs)
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := strings.Replace(name, "/", "_", -1)
+	for _, k := range keys {
+		res += "-" + strings.Replace(k+"_"+m[k], "/", "_", -1)
+	}
+
+	if resource != "" {
+		res = resource + "/" + res
+	}
+	return res
+}
+
+func otlpTime(ns uint64, now time.Time) time.Time {
+	if ns == 0 {
+		return now
+	}
+	return time.Unix(0, int64(ns))
+}
+
+func numberValue(dp *metrics.NumberDataPoint) float64 {
+	if _, ok := dp.GetValue().(*metrics.NumberDataPoint_AsInt); ok {
+		return float64(dp.GetAsInt())
+	}
+	return dp.GetAsDouble()
+}
+
+// OTLPWrites converts the export request to the RRD updates. Gauges and
+// non monotonic sums are stored as GAUGE, cumulative monotonic sums as DERIVE
+// for the integer points and DDERIVE for the double ones, delta monotonic
+// sums as ABSOLUTE, the rate over the export interval. Histograms and
+// summaries are stored as count, sum, min and max (or quantiles). The points
+// of the same metric and second are merged into one update.
+func OTLPWrites(req *colmetrics.ExportMetricsServiceRequest, now time.Time) []MetricWrite {
+	res := []MetricWrite{}
+
+	for _, rm := range req.GetResourceMetrics() {
+		resource := otlpResourcePath(attributesMap(rm.GetResource().GetAttributes()))
+
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				res = append(res, otlpMetricWrites(resource, m, now)...)
+			}
+		}
+	}
+
+	return mergeWrites(res)
+}
+
+// mergeWrites merges the values of the writes which share metric and second,
+// RRD doesn't allow two updates for the same second. The later value of the
+// data source wins.
+func mergeWrites(writes []MetricWrite) []MetricWrite {
+	type key struct {
+		metric string
+		time   int64
+	}
+
+	res := []MetricWrite{}
+	index := make(map[key]int)
+
+	for _, mw := range writes {
+		k := key{mw.Metric, mw.Time.Unix()}
+		i, ok := index[k]
+		if !ok {
+			i = len(res)
+			index[k] = i
+			res = append(res, MetricWrite{Metric: mw.Metric, Time: time.Unix(k.time, 0)})
+		}
+
+	values:
+		for _, v := range mw.Values {
+			for j := range res[i].Values {
+				if res[i].Values[j].Name == v.Name {
+					res[i].Values[j] = v
+					continue values
+				}
+			}
+			res[i].Values = append(res[i].Values, v)
+		}
+	}
+
+	return res
+}
+
+func otlpMetricWrites(resource string, m *metrics.Metric, now time.Time) []MetricWrite {
+	res := []MetricWrite{}
+
+	add := func(attrs []*common.KeyValue, ns uint64, values ...writer.DataSource) {
+		res = append(res, MetricWrite{
+			Metric: otlpMetricPath(resource, m.GetName(), attrs),
+			Time:   otlpTime(ns, now),
+			Values: values,
+		})
+	}
+
+	// DERIVE accepts only the integer values, ABSOLUTE accepts both.
+	counterType := func(temporality metrics.AggregationTemporality, double bool) string {
+		switch {
+		case temporality == metrics.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+			return "ABSOLUTE"
+		case temporality != metrics.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			return "GAUGE"
+		case double:
+			return "DDERIVE"
+		}
+		return "DERIVE"
+	}
+
+	switch {
+	case m.GetGauge() != nil:
+		for _, dp := range m.GetGauge().GetDataPoints() {
+			add(dp.GetAttributes(), dp.GetTimeUnixNano(),
+				writer.DataSource{Name: "value", Type: "GAUGE", Value: numberValue(dp)})
+		}
+
+	case m.GetSum() != nil:
+		sum := m.GetSum()
+		for _, dp := range sum.GetDataPoints() {
+			dsType := "GAUGE"
+			if sum.GetIsMonotonic() {
+				_, isInt := dp.GetValue().(*metrics.NumberDataPoint_AsInt)
+				dsType = counterType(sum.GetAggregationTemporality(), !isInt)
+			}
+			add(dp.GetAttributes(), dp.GetTimeUnixNano(),
+				writer.DataSource{Name: "value", Type: dsType, Value: numberValue(dp)})
+		}
+
+	case m.GetHistogram() != nil:
+		temporality := m.GetHistogram().GetAggregationTemporality()
+		for _, dp := range m.GetHistogram().GetDataPoints() {
+			values := []writer.DataSource{
+				{Name: "count", Type: counterType(temporality, false), Value: float64(dp.GetCount())},
+			}
+			if dp.Sum != nil {
+				values = append(values, writer.DataSource{Name: "sum", Type: counterType(temporality, true), Value: dp.GetSum()})
+			}
+			if dp.Min != nil {
+				values = append(values, writer.DataSource{Name: "min", Type: "GAUGE", Value: dp.GetMin()})
+			}
+			if dp.Max != nil {
+				values = append(values, writer.DataSource{Name: "max", Type: "GAUGE", Value: dp.GetMax()})
+			}
+			add(dp.GetAttributes(), dp.GetTimeUnixNano(), values...)
+		}
+
+	case m.GetExponentialHistogram() != nil:
+		temporality := m.GetExponentialHistogram().GetAggregationTemporality()
+		for _, dp := range m.GetExponentialHistogram().GetDataPoints() {
+			values := []writer.DataSource{
+				{Name: "count", Type: counterType(temporality, false), Value: float64(dp.GetCount())},
+			}
+			if dp.Sum != nil {
+				values = append(values, writer.DataSource{Name: "sum", Type: counterType(temporality, true), Value: dp.GetSum()})
+			}
+			if dp.Min != nil {
+				values = append(values, writer.DataSource{Name: "min", Type: "GAUGE", Value: dp.GetMin()})
+			}
+			if dp.Max != nil {
+				values = append(values, writer.DataSource{Name: "max", Type: "GAUGE", Value: dp.GetMax()})
+			}
+			add(dp.GetAttributes(), dp.GetTimeUnixNano(), values...)
+		}
+
+	case m.GetSummary() != nil:
+		for _, dp := range m.GetSummary().GetDataPoints() {
+			values := []writer.DataSource{
+				{Name: "count", Type: "DERIVE", Value: float64(dp.GetCount())},
+				{Name: "sum", Type: "DDERIVE", Value: dp.GetSum()},
+			}
+			for _, q := range dp.GetQuantileValues() {
+				name := "q" + strings.Replace(strconv.FormatFloat(q.GetQuantile()*100, 'f', -1, 64), ".", "_", -1)
+				values = append(values, writer.DataSource{Name: name, Type: "GAUGE", Value: q.GetValue()})
+			}
+			add(dp.GetAttributes(), dp.GetTimeUnixNano(), values...)
+		}
+	}
+
+	return res
+}
+
+func (api *API) OTLPMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	api.CommonHeader(w, r)
+
+	if api.Writer == nil {
+		InternalServerError(w, "Write API is disabled.")
+		return
+	}
+
+	if r.Body == nil {
+		BadRequest(w, "Empty request.")
+		return
+	}
+
+	data, err := readBody(w, r)
+	if err != nil {
+		statusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	isJSON := false
+	switch strings.TrimSpace(strings.SplitN(r.Header.Get("Content-Type"), ";", 2)[0]) {
+	case "application/x-protobuf", "application/protobuf":
+	case "application/json":
+		isJSON = true
+	default:
+		srvError(w, http.StatusUnsupportedMediaType, "Unsupported content type '%v'", r.Header.Get("Content-Type"))
+		return
+	}
+
+	req := &colmetrics.ExportMetricsServiceRequest{}
+	if isJSON {
+		err = protojson.Unmarshal(data, req)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		BadRequest(w, "Incorrect OTLP request: %v", err)
+		return
+	}
+
+	resp := &colmetrics.ExportMetricsServiceResponse{}
+	writes := OTLPWrites(req, time.Now())
+	rejected := 0
+	var firstErr error
+
+	allow := api.accessCheck(r)
+	for _, mw := range writes {
+		if m := writer.SafeMetric(mw.Metric); !allow(m) {
+			rejected++
+			if firstErr == nil {
+				firstErr = &ForbiddenError{Metric: m}
+			}
+			continue
+		}
+
+		if err := api.Writer.Write(mw.Metric, mw.Time, mw.Values); err != nil {
+			rejected++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetrics.ExportMetricsPartialSuccess{
+			RejectedDataPoints: int64(rejected),
+			ErrorMessage:       fmt.Sprintf("%d of %d data points failed, first error: %v", rejected, len(writes), firstErr),
+		}
+	}
+
+	var body []byte
+	if isJSON {
+		body, err = protojson.Marshal(resp)
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		body, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		InternalServerError(w, "%v", err)
+		return
+	}
+
+	w.Write(body)
+}
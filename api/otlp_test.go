@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"github.com/rrdserver/rrdserver/writer"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const otlpJSON = `{
+	"resourceMetrics": [{
+		"resource": {"attributes": [
+			{"key": "host.name",    "value": {"stringValue": "server1.net"}},
+			{"key": "service.name", "value": {"stringValue": "shop"}}
+		]},
+		"scopeMetrics": [{"metrics": [
+			{
+				"name": "queue.size",
+				"gauge": {"dataPoints": [{"asInt": "12", "timeUnixNano": "1430031094000000000"}]}
+			},
+			{
+				"name": "http.requests",
+				"sum": {
+					"aggregationTemporality": 2,
+					"isMonotonic": true,
+					"dataPoints": [{
+						"asDouble": 1027,
+						"timeUnixNano": "1430031094000000000",
+						"attributes": [
+							{"key": "method", "value": {"stringValue": "post"}},
+							{"key": "code",   "value": {"intValue": "200"}}
+						]
+					}, {
+						"asInt": "5",
+						"timeUnixNano": "1430031094000000000",
+						"attributes": [
+							{"key": "method", "value": {"stringValue": "get"}},
+							{"key": "code",   "value": {"intValue": "200"}}
+						]
+					}, {
+						"asDouble": 1030,
+						"timeUnixNano": "1430031094500000000",
+						"attributes": [
+							{"key": "method", "value": {"stringValue": "post"}},
+							{"key": "code",   "value": {"intValue": "200"}}
+						]
+					}]
+				}
+			},
+			{
+				"name": "bytes.sent",
+				"sum": {
+					"aggregationTemporality": 1,
+					"isMonotonic": true,
+					"dataPoints": [{"asInt": "2048", "timeUnixNano": "1430031094000000000"}]
+				}
+			},
+			{
+				"name": "http.duration",
+				"histogram": {
+					"aggregationTemporality": 1,
+					"dataPoints": [{"count": "4", "sum": 10, "min": 1, "max": 4, "timeUnixNano": "1430031094000000000"}]
+				}
+			},
+			{
+				"name": "rpc.duration",
+				"summary": {"dataPoints": [{
+					"count": "10", "sum": 55, "timeUnixNano": "1430031094000000000",
+					"quantileValues": [{"quantile": 0.5, "value": 5}, {"quantile": 0.99, "value": 9.9}]
+				}]}
+			}
+		]}]
+	}]
+}`
+
+func TestOTLPWrites(test *testing.T) {
+	// The points of the same metric and second are merged.
+	t := time.Unix(1430031094, 0)
+	want := []MetricWrite{
+		{"server1.net/shop/queue.size", t, []writer.DataSource{
+			{Name: "value", Type: "GAUGE", Value: 12}}},
+		{"server1.net/shop/http.requests-code_200-method_post", t, []writer.DataSource{
+			{Name: "value", Type: "DDERIVE", Value: 1030}}},
+		{"server1.net/shop/http.requests-code_200-method_get", t, []writer.DataSource{
+			{Name: "value", Type: "DERIVE", Value: 5}}},
+		{"server1.net/shop/bytes.sent", t, []writer.DataSource{
+			{Name: "value", Type: "ABSOLUTE", Value: 2048}}},
+		{"server1.net/shop/http.duration", t, []writer.DataSource{
+			{Name: "count", Type: "ABSOLUTE", Value: 4},
+			{Name: "sum", Type: "ABSOLUTE", Value: 10},
+			{Name: "min", Type: "GAUGE", Value: 1},
+			{Name: "max", Type: "GAUGE", Value: 4}}},
+		{"server1.net/shop/rpc.duration", t, []writer.DataSource{
+			{Name: "count", Type: "DERIVE", Value: 10},
+			{Name: "sum", Type: "DDERIVE", Value: 55},
+			{Name: "q50", Type: "GAUGE", Value: 5},
+			{Name: "q99", Type: "GAUGE", Value: 9.9}}},
+	}
+
+	req := &colmetrics.ExportMetricsServiceRequest{}
+	if err := protojson.Unmarshal([]byte(otlpJSON), req); err != nil {
+		test.Fatalf("Incorrect request: %v", err)
+	}
+
+	res := OTLPWrites(req, time.Now())
+	if !reflect.DeepEqual(res, want) {
+		test.Errorf("Result: %+v\nWant:   %+v\n", res, want)
+	}
+}
+
+type testSink []MetricWrite
+
+func (s *testSink) Write(metric string, t time.Time, values []writer.DataSource) error {
+	*s = append(*s, MetricWrite{metric, t, values})
+	return nil
+}
+
+func TestOTLPMetricsHandler(test *testing.T) {
+	req := &colmetrics.ExportMetricsServiceRequest{}
+	if err := protojson.Unmarshal([]byte(otlpJSON), req); err != nil {
+		test.Fatalf("Incorrect request: %v", err)
+	}
+
+	pb, err := proto.Marshal(req)
+	if err != nil {
+		test.Fatalf("Can't marshal request: %v", err)
+	}
+
+	cases := []struct {
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{"application/json", []byte(otlpJSON), http.StatusOK},
+		{"application/x-protobuf", pb, http.StatusOK},
+		{"text/plain", pb, http.StatusUnsupportedMediaType},
+		{"application/x-protobuf", []byte("garbage"), http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		sink := &testSink{}
+		api := NewAPI("")
+		api.Writer = sink
+
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/v1/metrics", bytes.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		api.OTLPMetricsHandler(w, r)
+
+		if w.Code != c.code {
+			test.Errorf("Content type: %s\nHTTP code: %v, want %v\n%s", c.contentType, w.Code, c.code, w.Body.String())
+			continue
+		}
+
+		if c.code == http.StatusOK && len(*sink) != 6 {
+			test.Errorf("Content type: %s\nWrites: %d, want 6\n", c.contentType, len(*sink))
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/ziutek/rrd"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -29,6 +29,7 @@ type QueryResponse struct {
 	End    Time                  `json:"end"`
 	Step   Duration              `json:"step"`
 	Result []QueryRespDataPoints `json:"result"`
+	Errors []string              `json:"errors,omitempty"`
 }
 
 type QueryRespDataPoints struct {
@@ -111,6 +112,7 @@ func QueryDefFromString(s string) (QueryDef, error) {
 }
 
 func (api API) QueryGetHandler(w http.ResponseWriter, r *http.Request) {
+	api = *api.forRequest(r)
 	var err error
 	api.CommonHeader(w, r)
 
@@ -167,9 +169,12 @@ func (api API) QueryGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := api.query(req)
+	ctx, cancel := api.queryContext(r)
+	defer cancel()
+
+	res, err := api.query(ctx, req)
 	if err != nil {
-		InternalServerError(w, "%v", err)
+		statusError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -182,6 +187,7 @@ func (api API) QueryGetHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api API) QueryPostHandler(w http.ResponseWriter, r *http.Request) {
+	api = *api.forRequest(r)
 	api.CommonHeader(w, r)
 
 	if r.Body == nil {
@@ -206,9 +212,12 @@ func (api API) QueryPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := api.query(req)
+	ctx, cancel := api.queryContext(r)
+	defer cancel()
+
+	res, err := api.query(ctx, req)
 	if err != nil {
-		InternalServerError(w, "%v", err)
+		statusError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -219,52 +228,29 @@ func (api API) QueryPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (api API) query(req QueryRequest) (QueryResponse, error) {
-
-	rrd := rrd.NewExporter()
-	for _, q := range req.Queries {
-		def, err := QueryDefFromString(q.Query)
-		if err != nil {
-			return QueryResponse{}, err
-		}
-
-		switch def.Type {
-		case "DEF":
-			rrd.Def(def.Name, api.FileForMetric(def.Metric), def.DS, def.CF.String(), def.Options)
-			if !q.Hidden {
-				rrd.XportDef(def.Name, def.Name)
-			}
-
-		case "CDEF":
-			rrd.CDef(def.Name, def.Metric)
-			if !q.Hidden {
-				rrd.XportDef(def.Name, def.Name)
-			}
-		}
-	}
-
-	rrdRes, err := rrd.Xport(time.Time(req.Start), time.Time(req.End), time.Duration(req.Step))
+func (api API) query(ctx context.Context, req QueryRequest) (QueryResponse, error) {
+	xres, err := api.xport(ctx, req)
 	if err != nil {
 		return QueryResponse{}, err
 	}
-	defer rrdRes.FreeValues()
 
 	res := QueryResponse{
 		Start:  req.Start,
 		End:    req.End,
 		Step:   req.Step,
 		Result: []QueryRespDataPoints{},
+		Errors: xres.Errors,
 	}
 
 	end := time.Time(req.End)
-	for idx, name := range rrdRes.Legends {
+	for idx, name := range xres.Legends {
 		data := QueryRespDataPoints{
 			Name:   name,
-			Values: make(DataPoints, rrdRes.RowCnt),
+			Values: make(DataPoints, xres.RowCnt),
 		}
 
-		for k, t := 0, rrdRes.Start.Add(rrdRes.Step); t.Before(end) || t.Equal(end); k, t = k+1, t.Add(rrdRes.Step) {
-			data.Values[Time(t)] = rrdRes.ValueAt(idx, k)
+		for k, t := 0, xres.Start.Add(xres.Step); k < xres.RowCnt && (t.Before(end) || t.Equal(end)); k, t = k+1, t.Add(xres.Step) {
+			data.Values[Time(t)] = xres.ValueAt(idx, k)
 		}
 		res.Result = append(res.Result, data)
 	}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// Reader reads the data from the RRD files. By default the files are read
+// by the pure Go rrdfile package, build with the librrd tag to read them
+// through the rrdtool C library. Fetch doesn't read the file when the
+// context is done.
+type Reader interface {
+	Info(file string) (MetricInfo, error)
+	Fetch(ctx context.Context, file string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error)
+}
+
+// FetchResult is the result of rrd_fetch, the row with index n covers the
+// interval (Start + n*Step, Start + (n+1)*Step].
+type FetchResult struct {
+	Start   time.Time
+	Step    time.Duration
+	DsNames []string
+	RowCnt  int
+	Values  []float64
+}
+
+func (r *FetchResult) ValueAt(dsIndex, rowIndex int) float64 {
+	return r.Values[len(r.DsNames)*rowIndex+dsIndex]
+}
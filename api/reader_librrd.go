@@ -0,0 +1,86 @@
+//go:build librrd
+// +build librrd
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/ziutek/rrd"
+	"sort"
+	"time"
+)
+
+type librrdReader struct{}
+
+func newReader() Reader {
+	return librrdReader{}
+}
+
+func infoInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case uint:
+		return int64(v)
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func (librrdReader) Info(file string) (MetricInfo, error) {
+	res := MetricInfo{DS: []string{}}
+
+	inf, err := rrd.Info(file)
+	if err != nil {
+		return MetricInfo{}, fmt.Errorf("Can't get info for %s file: %v", file, err)
+	}
+
+	switch v := inf["ds.type"].(type) {
+	case map[string]interface{}:
+		for ds := range v {
+			res.DS = append(res.DS, ds)
+		}
+	default:
+		return MetricInfo{}, fmt.Errorf("Can't get ds.type from info for %s file", file)
+	}
+	sort.Strings(res.DS)
+
+	res.Step = time.Duration(infoInt(inf["step"])) * time.Second
+	res.LastUpdate = time.Unix(infoInt(inf["last_update"]), 0)
+	return res, nil
+}
+
+func (librrdReader) Fetch(ctx context.Context, file string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := rrd.Fetch(file, cf.String(), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	defer res.FreeValues()
+
+	// The last row returned by the library doesn't belong to the interval.
+	rowCnt := res.RowCnt - 1
+	if rowCnt < 0 {
+		rowCnt = 0
+	}
+
+	values := make([]float64, 0, rowCnt*len(res.DsNames))
+	for r := 0; r < rowCnt; r++ {
+		for d := range res.DsNames {
+			values = append(values, res.ValueAt(d, r))
+		}
+	}
+
+	return &FetchResult{
+		Start:   res.Start,
+		Step:    res.Step,
+		DsNames: res.DsNames,
+		RowCnt:  rowCnt,
+		Values:  values,
+	}, nil
+}
@@ -0,0 +1,63 @@
+//go:build !librrd
+// +build !librrd
+
+package api
+
+import (
+	"context"
+	"github.com/rrdserver/rrdserver/rrdfile"
+	"sort"
+	"time"
+)
+
+type nativeReader struct{}
+
+func newReader() Reader {
+	return nativeReader{}
+}
+
+func (nativeReader) Info(file string) (MetricInfo, error) {
+	f, err := rrdfile.Open(file)
+	if err != nil {
+		return MetricInfo{}, err
+	}
+
+	res := MetricInfo{
+		Step:       time.Duration(f.Step) * time.Second,
+		LastUpdate: f.LastUpdate,
+		DS:         f.DSNames(),
+	}
+	sort.Strings(res.DS)
+	return res, nil
+}
+
+func (nativeReader) Fetch(ctx context.Context, file string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := rrdfile.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.Fetch(cf.String(), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, 0, res.RowCnt*len(res.DsNames))
+	for r := 0; r < res.RowCnt; r++ {
+		for d := range res.DsNames {
+			values = append(values, res.ValueAt(d, r))
+		}
+	}
+
+	return &FetchResult{
+		Start:   res.Start,
+		Step:    res.Step,
+		DsNames: res.DsNames,
+		RowCnt:  res.RowCnt,
+		Values:  values,
+	}, nil
+}
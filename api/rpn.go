@@ -0,0 +1,664 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RPN is the parsed CDEF expression, the operators follow rrdgraph_rpn(1).
+type RPN struct {
+	expr  string
+	items []rpnItem
+}
+
+type rpnItem struct {
+	op    string
+	value float64
+	vname string
+}
+
+// rpnContext is the state of the calculation for the single row.
+type rpnContext struct {
+	time  int64
+	step  int64
+	count int
+	prev  float64
+	vars  func(vname string, t int64) float64
+}
+
+var rpnOperators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "%": true, "ADDNAN": true,
+	"LT": true, "LE": true, "GT": true, "GE": true, "EQ": true, "NE": true,
+	"UN": true, "ISINF": true, "IF": true, "MIN": true, "MAX": true, "LIMIT": true,
+	"UNKN": true, "INF": true, "NEGINF": true,
+	"DUP": true, "POP": true, "EXC": true,
+	"ABS": true, "FLOOR": true, "CEIL": true, "SQRT": true, "LOG": true, "EXP": true,
+	"SIN": true, "COS": true, "ATAN": true, "ATAN2": true, "DEG2RAD": true, "RAD2DEG": true,
+	"AVG": true, "TIME": true, "NOW": true, "STEPWIDTH": true, "PREV": true, "COUNT": true,
+	"POW": true, "LTIME": true, "NEWDAY": true, "NEWWEEK": true, "NEWMONTH": true, "NEWYEAR": true,
+	"DEPTH": true, "COPY": true, "INDEX": true, "ROLL": true, "SORT": true, "REV": true,
+	"MEDIAN": true, "STDEV": true, "PERCENT": true, "MAD": true, "SMIN": true, "SMAX": true,
+	"TREND": true, "TRENDNAN": true, "PREDICT": true, "PREDICTSIGMA": true, "PREDICTPERC": true,
+}
+
+// ParseRPN parses the expression, isVar reports whether the token is the
+// name of the defined DEF or CDEF.
+func ParseRPN(expr string, isVar func(string) bool) (RPN, error) {
+	res := RPN{expr: expr}
+
+	for _, token := range strings.Split(expr, ",") {
+		token = strings.TrimSpace(token)
+		n := len(res.items)
+
+		switch {
+		case token == "":
+			return RPN{}, fmt.Errorf("Empty item in the expression '%v'", expr)
+
+		case rpnOperators[token]:
+			// vname,seconds,TREND and ...,vname,PREDICT use the past values of
+			// the variable.
+			switch token {
+			case "TREND", "TRENDNAN":
+				if n < 2 || res.items[n-2].vname == "" {
+					return RPN{}, fmt.Errorf("%v should follow the variable and the window in the expression '%v'", token, expr)
+				}
+			case "PREDICT", "PREDICTSIGMA", "PREDICTPERC":
+				if n < 1 || res.items[n-1].vname == "" {
+					return RPN{}, fmt.Errorf("%v should follow the variable in the expression '%v'", token, expr)
+				}
+			}
+			res.items = append(res.items, rpnItem{op: token})
+
+		case isVar(token):
+			res.items = append(res.items, rpnItem{vname: token})
+
+		default:
+			v, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				return RPN{}, fmt.Errorf("Unknown item '%v' in the expression '%v'", token, expr)
+			}
+			res.items = append(res.items, rpnItem{value: v})
+		}
+	}
+
+	return res, nil
+}
+
+// Vars returns the names of the variables used in the expression.
+func (rpn RPN) Vars() []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, it := range rpn.items {
+		if it.vname != "" && !seen[it.vname] {
+			seen[it.vname] = true
+			res = append(res, it.vname)
+		}
+	}
+	return res
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func compare(a, b float64, f func(a, b float64) bool) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.NaN()
+	}
+	return boolValue(f(a, b))
+}
+
+// rpnLess orders the values for SORT and PERCENT: -INF is the smallest,
+// the unknown value is smaller than the rest.
+func rpnLess(a, b float64) bool {
+	switch {
+	case math.IsNaN(a):
+		return !math.IsNaN(b) && !math.IsInf(b, -1)
+	case math.IsNaN(b):
+		return math.IsInf(a, -1)
+	}
+	return a < b
+}
+
+// known returns the values without the unknown ones.
+func known(values []float64) []float64 {
+	res := []float64{}
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func median(values []float64) float64 {
+	values = known(values)
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 0 {
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	return values[n/2]
+}
+
+func stdev(values []float64) float64 {
+	values = known(values)
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sum, sum2 := 0.0, 0.0
+	for _, v := range values {
+		sum += v
+		sum2 += v * v
+	}
+	mean := sum / float64(len(values))
+	return math.Sqrt(math.Max(sum2/float64(len(values))-mean*mean, 0))
+}
+
+// percent returns the value which percent of the values are less than or
+// equal to.
+func percent(values []float64, p float64) float64 {
+	if len(values) == 0 || math.IsNaN(p) {
+		return math.NaN()
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return rpnLess(sorted[i], sorted[j]) })
+
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// newPeriod reports whether the row starts the new day, week, month or year
+// of the local time.
+func newPeriod(op string, t, step int64) bool {
+	prev, cur := time.Unix(t-step, 0), time.Unix(t, 0)
+	switch op {
+	case "NEWDAY":
+		return prev.YearDay() != cur.YearDay() || prev.Year() != cur.Year()
+	case "NEWWEEK":
+		py, pw := prev.ISOWeek()
+		cy, cw := cur.ISOWeek()
+		return py != cy || pw != cw
+	case "NEWMONTH":
+		return prev.Month() != cur.Month() || prev.Year() != cur.Year()
+	}
+	return prev.Year() != cur.Year()
+}
+
+// stackOp evaluates the operators which take the count of their arguments or
+// the variable from the stack, ok is false for the rest of the operators.
+func (rpn RPN) stackOp(pos int, stack []float64, ctx *rpnContext) (res []float64, ok bool, err error) {
+	op := rpn.items[pos].op
+
+	pop := func() (float64, error) {
+		if len(stack) == 0 {
+			return 0, fmt.Errorf("RPN stack underflow in the expression '%v'", rpn.expr)
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+
+	// popCount pops the count and the values it counts.
+	popCount := func() ([]float64, error) {
+		v, err := pop()
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(v) || v < 0 || int(v) > len(stack) {
+			return nil, fmt.Errorf("Incorrect count of %v arguments in the expression '%v'", op, rpn.expr)
+		}
+		n := len(stack) - int(v)
+		values := append([]float64{}, stack[n:]...)
+		stack = stack[:n]
+		return values, nil
+	}
+
+	switch op {
+	case "DEPTH":
+		stack = append(stack, float64(len(stack)))
+
+	case "LTIME":
+		_, offset := time.Unix(ctx.time, 0).Zone()
+		stack = append(stack, float64(ctx.time+int64(offset)))
+
+	case "NEWDAY", "NEWWEEK", "NEWMONTH", "NEWYEAR":
+		stack = append(stack, boolValue(newPeriod(op, ctx.time, ctx.step)))
+
+	case "COPY":
+		values, err := popCount()
+		if err != nil {
+			return nil, true, err
+		}
+		stack = append(append(stack, values...), values...)
+
+	case "INDEX":
+		v, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		if math.IsNaN(v) || v < 1 || int(v) > len(stack) {
+			return nil, true, fmt.Errorf("Incorrect INDEX argument in the expression '%v'", rpn.expr)
+		}
+		stack = append(stack, stack[len(stack)-int(v)])
+
+	case "ROLL":
+		// n,m,ROLL rotates the top n values m times, the top value goes down.
+		m, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		values, err := popCount()
+		if err != nil {
+			return nil, true, err
+		}
+		if math.IsNaN(m) {
+			return nil, true, fmt.Errorf("Incorrect ROLL argument in the expression '%v'", rpn.expr)
+		}
+		if n := len(values); n > 0 {
+			k := ((int(m) % n) + n) % n
+			stack = append(append(stack, values[n-k:]...), values[:n-k]...)
+		}
+
+	case "SORT", "REV":
+		values, err := popCount()
+		if err != nil {
+			return nil, true, err
+		}
+		if op == "SORT" {
+			sort.SliceStable(values, func(i, j int) bool { return rpnLess(values[i], values[j]) })
+		} else {
+			for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+		stack = append(stack, values...)
+
+	case "MEDIAN", "STDEV", "MAD", "SMIN", "SMAX":
+		values, err := popCount()
+		if err != nil {
+			return nil, true, err
+		}
+
+		v := math.NaN()
+		switch op {
+		case "MEDIAN":
+			v = median(values)
+		case "STDEV":
+			v = stdev(values)
+		case "MAD":
+			m := median(values)
+			deviations := []float64{}
+			for _, x := range known(values) {
+				deviations = append(deviations, math.Abs(x-m))
+			}
+			v = median(deviations)
+		default:
+			for _, x := range known(values) {
+				if math.IsNaN(v) || (op == "SMIN" && x < v) || (op == "SMAX" && x > v) {
+					v = x
+				}
+			}
+		}
+		stack = append(stack, v)
+
+	case "PERCENT":
+		p, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		values, err := popCount()
+		if err != nil {
+			return nil, true, err
+		}
+		stack = append(stack, percent(values, p))
+
+	case "TREND", "TRENDNAN":
+		// The average of the variable over the window ending at the row, the
+		// unknown values are skipped by TRENDNAN. It's unknown until the
+		// window is filled.
+		window, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		if _, err := pop(); err != nil {
+			return nil, true, err
+		}
+		vname := rpn.items[pos-2].vname
+
+		v := math.NaN()
+		if cnt := int64(math.Ceil(window / float64(ctx.step))); cnt > 0 && int64(ctx.count) >= cnt {
+			sum, n := 0.0, 0
+			for i := int64(0); i < cnt; i++ {
+				x := ctx.vars(vname, ctx.time-i*ctx.step)
+				if op == "TREND" || !math.IsNaN(x) {
+					sum += x
+					n++
+				}
+			}
+			if n > 0 {
+				v = sum / float64(n)
+			}
+		}
+		stack = append(stack, v)
+
+	case "PREDICT", "PREDICTSIGMA", "PREDICTPERC":
+		// shift1,...,shiftN,n,window,[percentile,]vname,PREDICT gathers the
+		// values of the variable in the windows around the shifted times,
+		// -n,shift,... means the shifts shift, 2*shift, ..., n*shift.
+		if _, err := pop(); err != nil {
+			return nil, true, err
+		}
+		vname := rpn.items[pos-1].vname
+
+		p := 0.0
+		if op == "PREDICTPERC" {
+			if p, err = pop(); err != nil {
+				return nil, true, err
+			}
+		}
+
+		window, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		n, err := pop()
+		if err != nil {
+			return nil, true, err
+		}
+		if math.IsNaN(n) || math.IsNaN(window) || window < 0 {
+			return nil, true, fmt.Errorf("Incorrect %v arguments in the expression '%v'", op, rpn.expr)
+		}
+
+		shifts := []float64{}
+		if n < 0 {
+			shift, err := pop()
+			if err != nil {
+				return nil, true, err
+			}
+			for i := 1; i <= int(-n); i++ {
+				shifts = append(shifts, shift*float64(i))
+			}
+		} else {
+			stack = append(stack, n)
+			if shifts, err = popCount(); err != nil {
+				return nil, true, err
+			}
+		}
+
+		cnt := int64(window) / ctx.step
+		if cnt < 1 {
+			cnt = 1
+		}
+
+		values := []float64{}
+		for _, shift := range shifts {
+			for i := -cnt / 2; i < cnt-cnt/2; i++ {
+				if x := ctx.vars(vname, ctx.time-int64(shift)+i*ctx.step); !math.IsNaN(x) {
+					values = append(values, x)
+				}
+			}
+		}
+
+		v := math.NaN()
+		switch {
+		case len(values) == 0:
+		case op == "PREDICT":
+			sum := 0.0
+			for _, x := range values {
+				sum += x
+			}
+			v = sum / float64(len(values))
+		case op == "PREDICTSIGMA":
+			v = stdev(values)
+		default:
+			v = percent(values, p)
+		}
+		stack = append(stack, v)
+
+	default:
+		return stack, false, nil
+	}
+
+	return stack, true, nil
+}
+
+func (rpn RPN) eval(ctx *rpnContext) (float64, error) {
+	stack := make([]float64, 0, len(rpn.items))
+
+	// need checks that the stack holds at least n values.
+	need := func(n int) error {
+		if len(stack) < n {
+			return fmt.Errorf("RPN stack underflow in the expression '%v'", rpn.expr)
+		}
+		return nil
+	}
+
+	for pos, it := range rpn.items {
+		if it.op == "" {
+			if it.vname != "" {
+				stack = append(stack, ctx.vars(it.vname, ctx.time))
+			} else {
+				stack = append(stack, it.value)
+			}
+			continue
+		}
+
+		// Operators without arguments ....
+		switch it.op {
+		case "UNKN":
+			stack = append(stack, math.NaN())
+			continue
+		case "INF":
+			stack = append(stack, math.Inf(1))
+			continue
+		case "NEGINF":
+			stack = append(stack, math.Inf(-1))
+			continue
+		case "TIME":
+			stack = append(stack, float64(ctx.time))
+			continue
+		case "NOW":
+			stack = append(stack, float64(time.Now().Unix()))
+			continue
+		case "STEPWIDTH":
+			stack = append(stack, float64(ctx.step))
+			continue
+		case "PREV":
+			stack = append(stack, ctx.prev)
+			continue
+		case "COUNT":
+			stack = append(stack, float64(ctx.count))
+			continue
+		}
+
+		res, ok, err := rpn.stackOp(pos, stack, ctx)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			stack = res
+			continue
+		}
+
+		// Unary operators ................
+		if err := need(1); err != nil {
+			return 0, err
+		}
+		n := len(stack) - 1
+		a := stack[n]
+
+		unary := true
+		switch it.op {
+		case "UN":
+			stack[n] = boolValue(math.IsNaN(a))
+		case "ISINF":
+			stack[n] = boolValue(math.IsInf(a, 0))
+		case "ABS":
+			stack[n] = math.Abs(a)
+		case "FLOOR":
+			stack[n] = math.Floor(a)
+		case "CEIL":
+			stack[n] = math.Ceil(a)
+		case "SQRT":
+			stack[n] = math.Sqrt(a)
+		case "LOG":
+			stack[n] = math.Log(a)
+		case "EXP":
+			stack[n] = math.Exp(a)
+		case "SIN":
+			stack[n] = math.Sin(a)
+		case "COS":
+			stack[n] = math.Cos(a)
+		case "ATAN":
+			stack[n] = math.Atan(a)
+		case "DEG2RAD":
+			stack[n] = a * math.Pi / 180
+		case "RAD2DEG":
+			stack[n] = a * 180 / math.Pi
+		case "DUP":
+			stack = append(stack, a)
+		case "POP":
+			stack = stack[:n]
+		default:
+			unary = false
+		}
+		if unary {
+			continue
+		}
+
+		// AVG takes the count of the values from the stack.
+		if it.op == "AVG" {
+			cnt := int(a)
+			if math.IsNaN(a) || cnt < 0 {
+				return 0, fmt.Errorf("Incorrect count of AVG arguments in the expression '%v'", rpn.expr)
+			}
+			stack = stack[:n]
+			if err := need(cnt); err != nil {
+				return 0, err
+			}
+
+			sum, valid := 0.0, 0
+			for _, v := range stack[len(stack)-cnt:] {
+				if !math.IsNaN(v) {
+					sum += v
+					valid++
+				}
+			}
+			stack = stack[:len(stack)-cnt]
+
+			if valid > 0 {
+				stack = append(stack, sum/float64(valid))
+			} else {
+				stack = append(stack, math.NaN())
+			}
+			continue
+		}
+
+		// Binary operators ...............
+		if err := need(2); err != nil {
+			return 0, err
+		}
+		a, b := stack[n-1], stack[n]
+
+		binary := true
+		switch it.op {
+		case "+":
+			stack[n-1] = a + b
+		case "-":
+			stack[n-1] = a - b
+		case "*":
+			stack[n-1] = a * b
+		case "/":
+			stack[n-1] = a / b
+		case "%":
+			stack[n-1] = math.Mod(a, b)
+		case "ADDNAN":
+			switch {
+			case math.IsNaN(a):
+				stack[n-1] = b
+			case math.IsNaN(b):
+				stack[n-1] = a
+			default:
+				stack[n-1] = a + b
+			}
+		case "LT":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a < b })
+		case "LE":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a <= b })
+		case "GT":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a > b })
+		case "GE":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a >= b })
+		case "EQ":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a == b })
+		case "NE":
+			stack[n-1] = compare(a, b, func(a, b float64) bool { return a != b })
+		case "MIN":
+			stack[n-1] = math.Min(a, b)
+		case "MAX":
+			stack[n-1] = math.Max(a, b)
+		case "ATAN2":
+			stack[n-1] = math.Atan2(a, b)
+		case "POW":
+			stack[n-1] = math.Pow(a, b)
+		case "EXC":
+			stack[n-1], stack[n] = b, a
+			continue
+		default:
+			binary = false
+		}
+		if binary {
+			stack = stack[:n]
+			continue
+		}
+
+		// Ternary operators ..............
+		if err := need(3); err != nil {
+			return 0, err
+		}
+		c := stack[n-2]
+
+		switch it.op {
+		case "IF":
+			// c,a,b,IF: a if c isn't 0, the unknown condition isn't 0 either
+			// like in rrdtool.
+			if c != 0 {
+				stack[n-2] = a
+			} else {
+				stack[n-2] = b
+			}
+		case "LIMIT":
+			// c,a,b,LIMIT: c if a <= c <= b, unknown otherwise.
+			if math.IsNaN(a) || math.IsNaN(b) || c < a || c > b {
+				stack[n-2] = math.NaN()
+			}
+		}
+		stack = stack[:n-1]
+	}
+
+	if len(stack) != 1 {
+		return 0, fmt.Errorf("RPN final stack size is %d instead of 1 in the expression '%v'", len(stack), rpn.expr)
+	}
+
+	return stack[0], nil
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/auth"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// The search modes of SuggestMetricsRequest.
+const (
+	SearchPrefix    = "prefix"
+	SearchSubstring = "substring"
+	SearchFuzzy     = "fuzzy"
+	SearchRegex     = "regex"
+	SearchGlob      = "glob"
+)
+
+// matcher returns the score of the name, the higher is the better match.
+// The negative score means the name doesn't match.
+type matcher func(name string) int
+
+// newMatcher creates the matcher of the search mode, the substring and
+// fuzzy searches ignore the case.
+func newMatcher(mode, query string) (matcher, error) {
+	switch mode {
+	case "", SearchPrefix:
+		return func(name string) int {
+			if strings.HasPrefix(name, query) {
+				return 0
+			}
+			return -1
+		}, nil
+
+	case SearchSubstring:
+		q := strings.ToLower(query)
+		return func(name string) int {
+			if strings.Contains(strings.ToLower(name), q) {
+				return 0
+			}
+			return -1
+		}, nil
+
+	case SearchFuzzy:
+		q := strings.ToLower(query)
+		return func(name string) int {
+			return fuzzyScore(q, strings.ToLower(name))
+		}, nil
+
+	case SearchRegex:
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect regex '%v': %v", query, err)
+		}
+		return func(name string) int {
+			if re.MatchString(name) {
+				return 0
+			}
+			return -1
+		}, nil
+
+	case SearchGlob:
+		for _, s := range strings.Split(query, "/") {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("Incorrect glob '%v': %v", query, err)
+			}
+		}
+		return func(name string) int {
+			if query == "" || auth.MatchPath(query, name) {
+				return 0
+			}
+			return -1
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown search mode '%v', should be one of %v, %v, %v, %v or %v",
+		mode, SearchPrefix, SearchSubstring, SearchFuzzy, SearchRegex, SearchGlob)
+}
+
+// globPrefix returns the directories of the glob before its first pattern
+// character, only the metrics under them can match it.
+func globPrefix(glob string) string {
+	if i := strings.IndexAny(glob, "*?[\\"); i >= 0 {
+		glob = glob[:i]
+	}
+	return glob[:strings.LastIndex(glob, "/")+1]
+}
+
+// fuzzyScore matches the query characters in the name in order. The
+// consecutive characters and the ones at the start of the path segment or
+// the word get the bonus, the gaps and the long names get the penalty.
+// The query "ifoct" matches "server1.net/interface-eth0/if_octets" better
+// than "server1.net/interface-eth0/if_packets_count_total".
+func fuzzyScore(query, name string) int {
+	if query == "" {
+		return 0
+	}
+
+	score := 0
+	prev := -2
+	qi := 0
+	q, _ := utf8.DecodeRuneInString(query)
+
+	for i, r := range name {
+		if r != q {
+			continue
+		}
+
+		score += 1
+		switch {
+		case i == prev+1:
+			score += 5
+		case i == 0 || strings.ContainsRune("/-_.", rune(name[i-1])):
+			score += 3
+		case prev >= 0:
+			score -= 1
+		}
+
+		prev = i + utf8.RuneLen(r) - 1
+		qi += utf8.RuneLen(q)
+		if qi == len(query) {
+			// The shorter name is the more specific match.
+			return 1000 + score*10 - len(name)/8
+		}
+		q, _ = utf8.DecodeRuneInString(query[qi:])
+	}
+
+	return -1
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatcher(test *testing.T) {
+	cases := []struct {
+		mode  string
+		query string
+		name  string
+		want  bool
+	}{
+		{"", "server1.net/cpu", "server1.net/cpu-0/cpu-system", true},
+		{"prefix", "cpu", "server1.net/cpu-0/cpu-system", false},
+		{"substring", "cpu-0", "server1.net/cpu-0/cpu-system", true},
+		{"substring", "CPU-0", "server1.net/cpu-0/cpu-system", true},
+		{"substring", "cpu-2", "server1.net/cpu-0/cpu-system", false},
+		{"fuzzy", "ifoct", "server1.net/interface-eth0/if_octets", true},
+		{"fuzzy", "s1cpusys", "server1.net/cpu-0/cpu-system", true},
+		{"fuzzy", "octif", "server1.net/interface-eth0/if_octets", false},
+		{"regex", `cpu-\d+/cpu-sys`, "server1.net/cpu-0/cpu-system", true},
+		{"regex", `^cpu`, "server1.net/cpu-0/cpu-system", false},
+		{"glob", "server*/cpu-?/cpu-system", "server1.net/cpu-0/cpu-system", true},
+		{"glob", "server*/cpu-?", "server1.net/cpu-0/cpu-system", false},
+		{"glob", "**/cpu-system", "server1.net/cpu-0/cpu-system", true},
+		{"glob", "", "server1.net/cpu-0/cpu-system", true},
+	}
+
+	for _, c := range cases {
+		match, err := newMatcher(c.mode, c.query)
+		if err != nil {
+			test.Errorf("Mode: %s\nQuery: %s\nUnexpected error: %v", c.mode, c.query, err)
+			continue
+		}
+
+		if res := match(c.name) >= 0; res != c.want {
+			test.Errorf("Mode: %s\nQuery: %s\nName:  %s\nResult: %v\nWant:   %v\n", c.mode, c.query, c.name, res, c.want)
+		}
+	}
+
+	for _, c := range []struct{ mode, query string }{{"wildcard", ""}, {"regex", "cpu("}, {"glob", "server[/cpu"}} {
+		if _, err := newMatcher(c.mode, c.query); err == nil {
+			test.Errorf("Mode: %s\nQuery: %s\nError expected", c.mode, c.query)
+		}
+	}
+}
+
+// countingStorage counts the DataSources calls and the fetches.
+type countingStorage struct {
+	Storage
+	calls   int
+	fetches int
+}
+
+func (s *countingStorage) DataSources(metric string) ([]string, error) {
+	s.calls++
+	return s.Storage.DataSources(metric)
+}
+
+func (s *countingStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	s.fetches++
+	return s.Storage.Fetch(ctx, metric, cf, start, end, step)
+}
+
+func TestSuggestMetricsPage(test *testing.T) {
+	storage := &countingStorage{Storage: newTestMemoryStorage()}
+	api := NewAPI("")
+	api.Storage = storage
+
+	res, total, err := api.suggestMetrics(SuggestMetricsRequest{Query: "server", WithDS: true, Limit: 2, Offset: 1})
+	if err != nil || len(res) != 2 || total != 4 {
+		test.Errorf("Incorrect result: %v %v %v", res, total, err)
+	}
+	if storage.calls != 2 {
+		test.Errorf("Data sources are read for %v metrics, want only the page of 2", storage.calls)
+	}
+
+	// The DS query needs the data sources of all metrics.
+	storage.calls = 0
+	res, total, err = api.suggestMetrics(SuggestMetricsRequest{Query: "server:rx", WithDS: true, Limit: 1})
+	if err != nil || len(res) != 1 || total != 1 || storage.calls != 4 {
+		test.Errorf("Incorrect result: %v %v %v, %v calls", res, total, err, storage.calls)
+	}
+}
+
+func TestGlobPrefix(test *testing.T) {
+	cases := []struct {
+		glob string
+		want string
+	}{
+		{"server1.net/cpu-*/cpu-system", "server1.net/"},
+		{"server1.net/load", "server1.net/"},
+		{"server?.net/load", ""},
+		{"**/load", ""},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if res := globPrefix(c.glob); res != c.want {
+			test.Errorf("Glob: %s\nResult: %v\nWant:   %v\n", c.glob, res, c.want)
+		}
+	}
+}
+
+func TestFuzzyScore(test *testing.T) {
+	// The better matches go first.
+	cases := []struct {
+		query string
+		names []string
+	}{
+		{"ifoct", []string{
+			"server1.net/interface-eth0/if_octets",
+			"server1.net/interface-eth0/if_octets_total_count",
+			"server1.net/interface-eth0/if_errors_out_count_total",
+		}},
+		{"load", []string{
+			"server1.net/load/load",
+			"server1.net/loop/lo_avg_read",
+		}},
+	}
+
+	for _, c := range cases {
+		prev := 1 << 30
+		for _, name := range c.names {
+			score := fuzzyScore(c.query, name)
+			if score < 0 || score >= prev {
+				test.Errorf("Query: %s\nName: %s\nScore %d isn't less than the previous one %d", c.query, name, score, prev)
+			}
+			prev = score
+		}
+	}
+}
+
+func TestSuggestMetricsSearch(test *testing.T) {
+	storage := newTestMemoryStorage()
+	storage.Add("server2.net/interface-eth0/if_octets", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"tx", "rx"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{1, 2}},
+	})
+
+	api := NewAPI("")
+	api.Storage = storage
+
+	cases := []struct {
+		Get   string
+		Want  string
+		Total string
+	}{
+		{
+			`?query=if_octets&mode=substring&withds=false`,
+			`[{"metric": "server2.net/interface-eth0/if_octets", "ds": []}]`,
+			"1",
+		},
+		{
+			`?query=if_:r&mode=substring`,
+			`[
+			{"metric": "server1.net/interface-eth0/if_packets", "ds": ["rx"]},
+			{"metric": "server2.net/interface-eth0/if_octets",  "ds": ["rx"]}
+		]`,
+			"2",
+		},
+		{
+			`?query=ifoct&mode=fuzzy&withds=false`,
+			`[
+			{"metric": "server2.net/interface-eth0/if_octets", "ds": []}
+		]`,
+			"1",
+		},
+		{
+			`?query=cpusys&mode=fuzzy&withds=false`,
+			`[
+			{"metric": "server1.net/cpu-0/cpu-system",  "ds": []},
+			{"metric": "server1.net/cpu-1/cpu-system",  "ds": []},
+			{"metric": "server1.net/cpu-1/cpu-system2", "ds": []}
+		]`,
+			"3",
+		},
+		{
+			`?query=cpu-\d/cpu-system$&mode=regex`,
+			`[
+			{"metric": "server1.net/cpu-0/cpu-system", "ds": ["value"]},
+			{"metric": "server1.net/cpu-1/cpu-system", "ds": ["value"]}
+		]`,
+			"2",
+		},
+		{
+			`?query=server&limit=2&offset=1&withds=false`,
+			`[
+			{"metric": "server1.net/cpu-1/cpu-system",  "ds": []},
+			{"metric": "server1.net/cpu-1/cpu-system2", "ds": []}
+		]`,
+			"5",
+		},
+		{`?query=server&offset=10`, `[]`, "5"},
+		{
+			`?query=/server1.net/cpu-1/cpu-system/&withds=false`,
+			`[{"metric": "server1.net/cpu-1/cpu-system", "ds": []}]`,
+			"1",
+		},
+		{
+			`?query=server1.net/cpu-1/cpu-system:v`,
+			`[{"metric": "server1.net/cpu-1/cpu-system", "ds": ["value"]}]`,
+			"1",
+		},
+		{
+			`?query=server*/interface-*/if_*:r*&mode=glob`,
+			`[
+			{"metric": "server1.net/interface-eth0/if_packets", "ds": ["rx"]},
+			{"metric": "server2.net/interface-eth0/if_octets",  "ds": ["rx"]}
+		]`,
+			"2",
+		},
+	}
+
+	for _, c := range cases {
+		want := SuggestMetricsResponse{}
+		resp := SuggestMetricsResponse{}
+
+		if err := json.Unmarshal([]byte(c.Want), &want); err != nil {
+			test.Fatalf("Incorrect want '%v': %v", c.Want, err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://127.0.0.1"+c.Get, nil)
+		w := httptest.NewRecorder()
+		api.SuggestMetricsGetHandler(w, req)
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			test.Errorf("Query: '%s'\nIncorrect response %v '%v': %v\n", c.Get, w.Code, w.Body.String(), err)
+			continue
+		}
+
+		if !reflect.DeepEqual(resp, want) || w.Header().Get("X-Total-Count") != c.Total {
+			test.Errorf("Query: '%s'\n\nResult: %v %v\n\nWant:   %v %v\n", c.Get, resp, w.Header().Get("X-Total-Count"), want, c.Total)
+		}
+	}
+
+	for _, get := range []string{`?mode=wildcard`, `?mode=glob&query=[`, `?mode=regex&query=(`, `?limit=-1`, `?offset=x`} {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1"+get, nil)
+		w := httptest.NewRecorder()
+		api.SuggestMetricsGetHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			test.Errorf("Query: '%s'\nBad request expected: %v %v", get, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage is the store of the metrics used by API.
+type Storage interface {
+	// ListMetrics returns the sorted names of the metrics which start with
+	// the prefix, the exact match hides the rest of the metrics except the
+	// ones under it (<prefix>/...).
+	ListMetrics(prefix string) ([]string, error)
+
+	// DataSources returns the sorted names of the metric data sources.
+	DataSources(metric string) ([]string, error)
+
+	Info(metric string) (MetricInfo, error)
+
+	// Fetch returns the metric data the same way as rrd_fetch does, the
+	// DEF and CDEF evaluation on top of it is common for all storages.
+	// The fetch is aborted when the context of the query is done.
+	Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error)
+}
+
+// MetricInfo describes the metric, Title and Labels (DS -> label) are set
+// only by the storages which know them, like munin.
+type MetricInfo struct {
+	Step       time.Duration
+	LastUpdate time.Time
+	DS         []string
+	Title      string
+	Labels     map[string]string
+}
+
+// FileStorage keeps the metrics in the RRD files of the data directory.
+type FileStorage struct {
+	DataDir string
+	Reader  Reader
+}
+
+func NewFileStorage(dataDir string) *FileStorage {
+	return &FileStorage{
+		DataDir: dataDir,
+		Reader:  newReader(),
+	}
+}
+
+func (s *FileStorage) FileForMetric(metric string) string {
+	return s.DataDir + SafeMetric(metric) + ".rrd"
+}
+
+func (s *FileStorage) ListMetrics(prefix string) ([]string, error) {
+	res := []string{}
+	for _, f := range s.findRRDFiles(prefix) {
+		res = append(res, f[len(s.DataDir):len(f)-4])
+	}
+	return res, nil
+}
+
+func (s *FileStorage) DataSources(metric string) ([]string, error) {
+	inf, err := s.Info(metric)
+	if err != nil {
+		return nil, err
+	}
+	return inf.DS, nil
+}
+
+func (s *FileStorage) Info(metric string) (MetricInfo, error) {
+	return s.Reader.Info(s.FileForMetric(metric))
+}
+
+func (s *FileStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	return s.Reader.Fetch(ctx, s.FileForMetric(metric), cf, start, end, step)
+}
+
+func (s *FileStorage) findRRDFiles(query string) []string {
+	return findFiles(s.DataDir, query, ".rrd")
+}
+
+// findFiles returns the sorted files with the extension in the data
+// directory which start with the query.
+func findFiles(dataDir, query, ext string) []string {
+	path := dataDir + SafeMetric(strings.TrimRight(query, "/"))
+	dir := filepath.Dir(path)
+
+	if isFile(path + ext) {
+		res := []string{path + ext}
+		if isDir(path) {
+			res = append(res, walkFiles(path, path+"/", ext)...)
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	var startPath string
+	if isDir(path) {
+		startPath = path
+	} else {
+		startPath = dir
+	}
+
+	res := walkFiles(startPath, path, ext)
+	sort.Strings(res)
+	return res
+}
+
+// walkFiles returns the files with the extension under the directory which
+// start with the prefix.
+func walkFiles(dir, prefix, ext string) []string {
+	res := []string{}
+	filepath.Walk(dir, func(file string, f os.FileInfo, e error) error {
+
+		if e != nil {
+			return e
+		}
+
+		if !f.IsDir() && strings.HasSuffix(file, ext) && strings.HasPrefix(file, prefix) {
+			res = append(res, file)
+		}
+		return nil
+	})
+	return res
+}
+
+// hasMetricPrefix tells if ListMetrics returns the metric for the prefix,
+// exact is set if the prefix is the metric itself.
+func hasMetricPrefix(metric, prefix string, exact bool) bool {
+	if exact {
+		return metric == prefix || strings.HasPrefix(metric, prefix+"/")
+	}
+	return strings.HasPrefix(metric, prefix)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ForbiddenError is the error of the metric the user can't access.
+type ForbiddenError struct {
+	Metric string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("Access to metric '%v' is denied", e.Metric)
+}
+
+// ACLStorage hides the metrics the Allow function denies from the listing,
+// the rest of the requests of them fail with *ForbiddenError. It's created
+// for every request by the user's access check.
+type ACLStorage struct {
+	Storage Storage
+	Allow   func(metric string) bool
+}
+
+func NewACLStorage(storage Storage, allow func(metric string) bool) *ACLStorage {
+	return &ACLStorage{Storage: storage, Allow: allow}
+}
+
+func (s *ACLStorage) check(metric string) error {
+	if m := SafeMetric(metric); !s.Allow(m) {
+		return &ForbiddenError{Metric: m}
+	}
+	return nil
+}
+
+func (s *ACLStorage) ListMetrics(prefix string) ([]string, error) {
+	metrics, err := s.Storage.ListMetrics(prefix)
+	if _, ok := err.(*PartialError); err != nil && !ok {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, m := range metrics {
+		if s.Allow(m) {
+			res = append(res, m)
+		}
+	}
+	return res, err
+}
+
+func (s *ACLStorage) DataSources(metric string) ([]string, error) {
+	if err := s.check(metric); err != nil {
+		return nil, err
+	}
+	return s.Storage.DataSources(metric)
+}
+
+func (s *ACLStorage) Info(metric string) (MetricInfo, error) {
+	if err := s.check(metric); err != nil {
+		return MetricInfo{}, err
+	}
+	return s.Storage.Info(metric)
+}
+
+func (s *ACLStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	if err := s.check(metric); err != nil {
+		return nil, err
+	}
+	return s.Storage.Fetch(ctx, metric, cf, start, end, step)
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestACLHandlers(test *testing.T) {
+	sink := &testSink{}
+
+	api := NewAPI("")
+	api.Storage = newTestMemoryStorage()
+	api.Writer = sink
+	api.Allow = func(r *http.Request) func(string) bool {
+		if r.Header.Get("X-Test-User") == "admin" {
+			return nil
+		}
+		return func(metric string) bool { return strings.HasPrefix(metric, "server1.net/cpu-1") }
+	}
+
+	query := `?start=2000.01.02-00:59:59&end=2000.01.02-01:05:00&step=1m&query=DEF:A=`
+
+	cases := []struct {
+		handler http.HandlerFunc
+		method  string
+		get     string
+		body    string
+		user    string
+		code    int
+		want    []string
+		notWant []string
+	}{
+		{
+			api.SuggestMetricsGetHandler, "GET", `?query=server1.net/`, "", "", http.StatusOK,
+			[]string{"server1.net/cpu-1/cpu-system", "server1.net/cpu-1/cpu-system2"},
+			[]string{"cpu-0", "if_packets"},
+		},
+		{
+			api.SuggestMetricsGetHandler, "GET", `?query=cpu-0&mode=substring`, "", "", http.StatusOK,
+			[]string{"[]"}, nil,
+		},
+		{
+			api.SuggestMetricsGetHandler, "GET", `?query=server1.net/`, "", "admin", http.StatusOK,
+			[]string{"cpu-0", "if_packets"}, nil,
+		},
+		{
+			api.TreeHandler, "GET", `?path=server1.net`, "", "", http.StatusOK,
+			[]string{`"server1.net/cpu-1"`}, []string{"cpu-0", "interface"},
+		},
+		{
+			api.InfoHandler, "GET", `?metric=server1.net/cpu-0/cpu-system`, "", "", http.StatusForbidden,
+			[]string{"denied"}, nil,
+		},
+		{
+			api.InfoHandler, "GET", `?metric=server1.net/cpu-1/../cpu-0/cpu-system`, "", "", http.StatusForbidden,
+			[]string{"denied"}, nil,
+		},
+		{
+			api.InfoHandler, "GET", `?metric=server1.net/cpu-1/cpu-system`, "", "", http.StatusOK,
+			[]string{`"value"`}, nil,
+		},
+		{
+			api.QueryGetHandler, "GET", query + `server1.net/cpu-0/cpu-system:value:AVERAGE`, "", "", http.StatusForbidden,
+			[]string{"server1.net/cpu-0/cpu-system"}, nil,
+		},
+		{
+			api.QueryGetHandler, "GET", query + `server1.net/cpu-1/cpu-system:value:AVERAGE`, "", "", http.StatusOK,
+			nil, nil,
+		},
+		{
+			api.WriteHandler, "POST", `?precision=s`, "load,host=server1.net value=1 946774740", "", http.StatusForbidden,
+			[]string{"server1.net/load"}, nil,
+		},
+		{
+			api.WriteHandler, "POST", `?precision=s`, "cpu-1,host=server1.net value=1 946774740", "", http.StatusNoContent,
+			nil, nil,
+		},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://127.0.0.1"+c.get, strings.NewReader(c.body))
+		if c.user != "" {
+			req.Header.Set("X-Test-User", c.user)
+		}
+
+		w := httptest.NewRecorder()
+		c.handler(w, req)
+
+		body := w.Body.String()
+		if w.Code != c.code {
+			test.Errorf("%v %v\nResult: %v %v\nWant:   %v\n", c.method, c.get, w.Code, body, c.code)
+			continue
+		}
+
+		for _, s := range c.want {
+			if !strings.Contains(body, s) {
+				test.Errorf("%v %v\nResult: %v\n'%v' expected\n", c.method, c.get, body, s)
+			}
+		}
+
+		for _, s := range c.notWant {
+			if strings.Contains(body, s) {
+				test.Errorf("%v %v\nResult: %v\n'%v' isn't expected\n", c.method, c.get, body, s)
+			}
+		}
+	}
+
+	if len(*sink) != 1 || (*sink)[0].Metric != "server1.net/cpu-1" {
+		test.Errorf("Incorrect writes: %v", *sink)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryMetric is the metric of MemoryStorage with one archive, the row
+// Rows[i] ends at First + i*Step. First should be aligned to Step.
+type MemoryMetric struct {
+	Step  time.Duration
+	DS    []string
+	First time.Time
+	Rows  [][]float64
+}
+
+// MemoryStorage keeps the metrics in memory, it's used by the tests.
+type MemoryStorage struct {
+	mutex   sync.RWMutex
+	metrics map[string]MemoryMetric
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		metrics: make(map[string]MemoryMetric),
+	}
+}
+
+func (s *MemoryStorage) Add(metric string, m MemoryMetric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics[SafeMetric(metric)] = m
+}
+
+func (s *MemoryStorage) get(metric string) (MemoryMetric, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	m, ok := s.metrics[SafeMetric(metric)]
+	if !ok {
+		return MemoryMetric{}, fmt.Errorf("Metric '%v' not found", metric)
+	}
+	return m, nil
+}
+
+func (s *MemoryStorage) ListMetrics(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	prefix = SafeMetric(strings.TrimRight(prefix, "/"))
+	_, exact := s.metrics[prefix]
+
+	res := []string{}
+	for m := range s.metrics {
+		if hasMetricPrefix(m, prefix, exact) {
+			res = append(res, m)
+		}
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *MemoryStorage) DataSources(metric string) ([]string, error) {
+	inf, err := s.Info(metric)
+	if err != nil {
+		return nil, err
+	}
+	return inf.DS, nil
+}
+
+func (s *MemoryStorage) Info(metric string) (MetricInfo, error) {
+	m, err := s.get(metric)
+	if err != nil {
+		return MetricInfo{}, err
+	}
+
+	res := MetricInfo{
+		Step:       m.Step,
+		LastUpdate: m.First.Add(time.Duration(len(m.Rows)-1) * m.Step),
+		DS:         append([]string{}, m.DS...),
+	}
+	sort.Strings(res.DS)
+	return res, nil
+}
+
+func (s *MemoryStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	m, err := s.get(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	st := int64(m.Step / time.Second)
+	if st <= 0 {
+		return nil, fmt.Errorf("Incorrect step of the metric '%v'", metric)
+	}
+
+	b, e := start.Unix(), end.Unix()
+	b -= b % st
+	e += st - e%st
+
+	res := &FetchResult{
+		Start:   time.Unix(b, 0),
+		Step:    m.Step,
+		DsNames: m.DS,
+		RowCnt:  int((e - b) / st),
+	}
+
+	first := m.First.Unix()
+	for t := b + st; t <= e; t += st {
+		i := (t - first) / st
+		for d := range m.DS {
+			if t >= first && i < int64(len(m.Rows)) && d < len(m.Rows[i]) {
+				res.Values = append(res.Values, m.Rows[i][d])
+			} else {
+				res.Values = append(res.Values, math.NaN())
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiStorage combines several storages, the metrics of the storage are
+// available as <namespace>/<metric>. The storage with the empty namespace
+// keeps its metrics as is, except the ones shadowed by the namespaces.
+type MultiStorage struct {
+	namespaces []string
+	storages   map[string]Storage
+}
+
+func NewMultiStorage() *MultiStorage {
+	return &MultiStorage{
+		storages: make(map[string]Storage),
+	}
+}
+
+func (s *MultiStorage) Add(namespace string, storage Storage) {
+	namespace = strings.Trim(namespace, "/")
+	if _, ok := s.storages[namespace]; !ok {
+		s.namespaces = append(s.namespaces, namespace)
+		sort.Strings(s.namespaces)
+	}
+	s.storages[namespace] = storage
+}
+
+// route returns the storage of the metric and the metric name inside it.
+func (s *MultiStorage) route(metric string) (Storage, string, error) {
+	metric = SafeMetric(metric)
+	items := strings.SplitN(metric, "/", 2)
+
+	if len(items) == 2 && items[0] != "" {
+		if storage, ok := s.storages[items[0]]; ok {
+			return storage, items[1], nil
+		}
+	}
+
+	if storage, ok := s.storages[""]; ok {
+		return storage, metric, nil
+	}
+
+	return nil, "", fmt.Errorf("Unknown namespace for the metric '%v'", metric)
+}
+
+// ListMetrics requests the storages concurrently. The failed upstreams don't
+// fail the whole list, they are returned as *PartialError with the rest of
+// the metrics.
+func (s *MultiStorage) ListMetrics(prefix string) ([]string, error) {
+	prefix = SafeMetric(prefix)
+
+	lists := make([][]string, len(s.namespaces))
+	errs := make([]error, len(s.namespaces))
+	wg := sync.WaitGroup{}
+
+	for i, ns := range s.namespaces {
+		var p string
+		switch {
+		case ns == "":
+			p = prefix
+		case strings.HasPrefix(prefix, ns+"/"):
+			p = prefix[len(ns)+1:]
+		case strings.HasPrefix(ns, prefix):
+			p = ""
+		default:
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, ns, p string) {
+			defer wg.Done()
+			lists[i], errs[i] = s.storages[ns].ListMetrics(p)
+		}(i, ns, p)
+	}
+	wg.Wait()
+
+	res := []string{}
+	partial := &PartialError{}
+
+	for i, ns := range s.namespaces {
+		if errs[i] != nil {
+			if _, ok := errs[i].(*UpstreamError); !ok {
+				return nil, errs[i]
+			}
+			partial.Errors = append(partial.Errors, errs[i])
+			continue
+		}
+
+		for _, m := range lists[i] {
+			if ns != "" {
+				res = append(res, ns+"/"+m)
+				continue
+			}
+
+			items := strings.SplitN(m, "/", 2)
+			if _, shadowed := s.storages[items[0]]; shadowed && len(items) == 2 {
+				continue
+			}
+			res = append(res, m)
+		}
+	}
+
+	sort.Strings(res)
+	if len(partial.Errors) > 0 {
+		return res, partial
+	}
+	return res, nil
+}
+
+func (s *MultiStorage) DataSources(metric string) ([]string, error) {
+	storage, m, err := s.route(metric)
+	if err != nil {
+		return nil, err
+	}
+	return storage.DataSources(m)
+}
+
+func (s *MultiStorage) Info(metric string) (MetricInfo, error) {
+	storage, m, err := s.route(metric)
+	if err != nil {
+		return MetricInfo{}, err
+	}
+	return storage.Info(m)
+}
+
+func (s *MultiStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	storage, m, err := s.route(metric)
+	if err != nil {
+		return nil, err
+	}
+	return storage.Fetch(ctx, m, cf, start, end, step)
+}
@@ -0,0 +1,471 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MuninStorage presents the munin data directory as the metrics
+// <group>/<host>/<plugin> with the plugin fields as data sources. Munin keeps
+// every field in its own file <group>/<host>-<plugin>-<field>-<type>.rrd with
+// the single DS "42", the graph titles, labels and CDEFs are read from the
+// datafile of the directory.
+type MuninStorage struct {
+	DataDir string
+	Reader  Reader
+
+	mutex   sync.Mutex
+	modTime time.Time
+	graphs  map[string]*MuninGraph
+	hosts   map[string]bool
+	dirs    map[string]muninDir
+}
+
+// muninDir is the scanned group directory, it's valid while the directory
+// and the datafile aren't changed.
+type muninDir struct {
+	modTime  time.Time
+	datafile time.Time
+	metrics  map[string]map[string]string
+}
+
+// MuninGraph is the graph of the munin plugin from the datafile.
+type MuninGraph struct {
+	Title  string
+	VLabel string
+	Labels map[string]string
+	CDefs  map[string]string
+}
+
+// muninFile is the file of the munin field.
+type muninFile struct {
+	Metric string
+	Field  string
+	Type   string
+}
+
+func NewMuninStorage(dataDir string) *MuninStorage {
+	return &MuninStorage{
+		DataDir: dataDir,
+		Reader:  newReader(),
+	}
+}
+
+// parseMuninFile parses the relative file name
+// <group>/<host>-<plugin>-<field>-<type>.rrd. The host name can contain
+// '-', so the hosts known from the datafile are checked first, the dots of
+// the multigraph plugin names are stored as '-' as well. The file of the
+// unknown host has the plugin without '-'.
+func parseMuninFile(name string, hosts map[string]bool) (muninFile, bool) {
+	if !strings.HasSuffix(name, ".rrd") {
+		return muninFile{}, false
+	}
+
+	group, base := filepath.Split(strings.TrimSuffix(name, ".rrd"))
+	group = strings.Trim(group, "/")
+
+	items := strings.Split(base, "-")
+	n := len(items)
+	if group == "" || n < 4 {
+		return muninFile{}, false
+	}
+
+	hostParts := n - 3
+	for i := 1; i <= n-3; i++ {
+		if hosts[group+"/"+strings.Join(items[:i], "-")] {
+			hostParts = i
+			break
+		}
+	}
+
+	host := strings.Join(items[:hostParts], "-")
+	plugin := strings.Join(items[hostParts:n-2], ".")
+	field, typ := items[n-2], items[n-1]
+
+	switch typ {
+	case "g", "d", "c", "a":
+	default:
+		return muninFile{}, false
+	}
+
+	if host == "" || plugin == "" || field == "" {
+		return muninFile{}, false
+	}
+
+	return muninFile{
+		Metric: group + "/" + host + "/" + plugin,
+		Field:  field,
+		Type:   typ,
+	}, true
+}
+
+// scan returns the files of the fields of every metric.
+func (s *MuninStorage) scan(prefix string) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+
+	// The prefix can end in the middle of the host name, which is the
+	// part of the file name, so the directory of the group is walked.
+	group := strings.SplitN(SafeMetric(prefix), "/", 2)[0]
+	if !strings.Contains(SafeMetric(prefix), "/") {
+		group = ""
+	}
+
+	_, hosts := s.load()
+	for _, f := range findFiles(s.DataDir, group, ".rrd") {
+		mf, ok := parseMuninFile(f[len(s.DataDir):], hosts)
+		if !ok {
+			continue
+		}
+
+		if _, ok := res[mf.Metric]; !ok {
+			res[mf.Metric] = make(map[string]string)
+		}
+		res[mf.Metric][mf.Field] = f
+	}
+
+	return res
+}
+
+// scanDir returns the files of the fields of the metrics in the group
+// directory, the scan is cached by the modification time of the directory.
+// The directory changed in the last second can change again without the
+// new time, so it isn't cached.
+func (s *MuninStorage) scanDir(group string) map[string]map[string]string {
+	dir := s.DataDir + group
+	st, err := os.Stat(dir)
+	if err != nil || !st.IsDir() {
+		return nil
+	}
+
+	_, hosts := s.load()
+
+	s.mutex.Lock()
+	datafile := s.modTime
+	cached, ok := s.dirs[dir]
+	s.mutex.Unlock()
+
+	if ok && cached.modTime.Equal(st.ModTime()) && cached.datafile.Equal(datafile) {
+		return cached.metrics
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	res := make(map[string]map[string]string)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		mf, ok := parseMuninFile(group+"/"+f.Name(), hosts)
+		if !ok {
+			continue
+		}
+
+		if _, ok := res[mf.Metric]; !ok {
+			res[mf.Metric] = make(map[string]string)
+		}
+		res[mf.Metric][mf.Field] = dir + "/" + f.Name()
+	}
+
+	if time.Since(st.ModTime()) > time.Second {
+		s.mutex.Lock()
+		if s.dirs == nil {
+			s.dirs = make(map[string]muninDir)
+		}
+		s.dirs[dir] = muninDir{modTime: st.ModTime(), datafile: datafile, metrics: res}
+		s.mutex.Unlock()
+	}
+
+	return res
+}
+
+func (s *MuninStorage) fields(metric string) (map[string]string, error) {
+	metric = SafeMetric(metric)
+
+	// The files of <group>/<host>/<plugin> are in the group directory.
+	group := ""
+	if items := strings.Split(metric, "/"); len(items) >= 3 {
+		group = strings.Join(items[:len(items)-2], "/")
+	}
+
+	fields, ok := s.scanDir(group)[metric]
+	if group == "" || !ok {
+		return nil, fmt.Errorf("Metric '%v' not found", metric)
+	}
+	return fields, nil
+}
+
+func (s *MuninStorage) ListMetrics(prefix string) ([]string, error) {
+	prefix = SafeMetric(strings.TrimRight(prefix, "/"))
+	metrics := s.scan(prefix)
+	_, exact := metrics[prefix]
+
+	res := []string{}
+	for m := range metrics {
+		if hasMetricPrefix(m, prefix, exact) {
+			res = append(res, m)
+		}
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *MuninStorage) DataSources(metric string) ([]string, error) {
+	fields, err := s.fields(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for f := range fields {
+		res = append(res, f)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *MuninStorage) Info(metric string) (MetricInfo, error) {
+	fields, err := s.fields(metric)
+	if err != nil {
+		return MetricInfo{}, err
+	}
+
+	res := MetricInfo{}
+	for field, file := range fields {
+		inf, err := s.Reader.Info(file)
+		if err != nil {
+			return MetricInfo{}, err
+		}
+
+		if res.Step == 0 || inf.Step < res.Step {
+			res.Step = inf.Step
+		}
+		if inf.LastUpdate.After(res.LastUpdate) {
+			res.LastUpdate = inf.LastUpdate
+		}
+		res.DS = append(res.DS, field)
+	}
+	sort.Strings(res.DS)
+
+	if g := s.Graph(metric); g != nil {
+		res.Title = g.Title
+		res.Labels = g.Labels
+	}
+
+	return res, nil
+}
+
+// Fetch reads the files of all fields, the fields with the CDEF in the
+// datafile are calculated from the raw values like munin draws them.
+func (s *MuninStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	files, err := s.fields(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []string{}
+	for f := range files {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	data := make([]*FetchResult, len(fields))
+	for i, f := range fields {
+		data[i], err = s.Reader.Fetch(ctx, files[f], cf, start, end, step)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The fields share the step and the rows of the first one.
+	res := &FetchResult{
+		Start:   data[0].Start,
+		Step:    data[0].Step,
+		DsNames: fields,
+		RowCnt:  data[0].RowCnt,
+		Values:  make([]float64, data[0].RowCnt*len(fields)),
+	}
+
+	st := int64(res.Step / time.Second)
+	if st <= 0 {
+		return nil, fmt.Errorf("Incorrect step of the metric '%v'", metric)
+	}
+
+	raw := func(i int, t int64) float64 {
+		d := data[i]
+		if d.Step != res.Step {
+			return math.NaN()
+		}
+		r := (t-d.Start.Unix())/st - 1
+		if r < 0 || r >= int64(d.RowCnt) {
+			return math.NaN()
+		}
+		return d.ValueAt(0, int(r))
+	}
+
+	index := make(map[string]int)
+	for i, f := range fields {
+		index[f] = i
+	}
+
+	cdefs := make(map[int]RPN)
+	if g := s.Graph(metric); g != nil {
+		for field, expr := range g.CDefs {
+			i, ok := index[field]
+			if !ok {
+				continue
+			}
+
+			rpn, err := ParseRPN(expr, func(v string) bool { _, ok := index[v]; return ok })
+			if err != nil {
+				return nil, fmt.Errorf("Incorrect cdef '%v' of the field '%v' in '%v': %v", expr, field, metric, err)
+			}
+			cdefs[i] = rpn
+		}
+	}
+
+	for r := 0; r < res.RowCnt; r++ {
+		t := res.Start.Unix() + int64(r+1)*st
+		for i := range fields {
+			v := raw(i, t)
+
+			if rpn, ok := cdefs[i]; ok {
+				ctx := &rpnContext{
+					time:  t,
+					step:  st,
+					count: r + 1,
+					prev:  math.NaN(),
+					vars:  func(vname string, t int64) float64 { return raw(index[vname], t) },
+				}
+				if v, err = rpn.eval(ctx); err != nil {
+					return nil, err
+				}
+			}
+
+			res.Values[r*len(fields)+i] = v
+		}
+	}
+
+	return res, nil
+}
+
+// Graph returns the graph of the metric from the datafile, nil if the
+// datafile doesn't describe it.
+func (s *MuninStorage) Graph(metric string) *MuninGraph {
+	graphs, _ := s.load()
+	return graphs[SafeMetric(metric)]
+}
+
+// load returns the graphs and the <group>/<host> names of the datafile, it's
+// read again when changed. The missing datafile has no graphs.
+func (s *MuninStorage) load() (map[string]*MuninGraph, map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := s.DataDir + "datafile"
+	st, err := os.Stat(name)
+	if err != nil {
+		return nil, nil
+	}
+
+	if s.graphs == nil || !st.ModTime().Equal(s.modTime) {
+		graphs, err := readMuninDatafile(name)
+		if err != nil {
+			return nil, nil
+		}
+
+		s.graphs, s.modTime = graphs, st.ModTime()
+		s.hosts = make(map[string]bool)
+		for metric := range graphs {
+			s.hosts[metric[:strings.LastIndex(metric, "/")]] = true
+		}
+	}
+
+	return s.graphs, s.hosts
+}
+
+// readMuninDatafile reads the lines like "group;host:plugin.graph_title Load"
+// and "group;host:plugin.field.label load", the plugin name of the
+// multigraph plugins can contain dots.
+func readMuninDatafile(name string) (map[string]*MuninGraph, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]*MuninGraph)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key, value := kv[0], strings.TrimSpace(kv[1])
+		colon := strings.Index(key, ":")
+		if colon < 0 {
+			continue
+		}
+
+		// The nested groups are separated by ';' as well.
+		semi := strings.LastIndex(key[:colon], ";")
+		if semi <= 0 || colon <= semi+1 {
+			continue
+		}
+
+		group := strings.Replace(key[:semi], ";", "/", -1)
+		host := key[semi+1 : colon]
+		attrs := strings.Split(key[colon+1:], ".")
+		if len(attrs) < 2 {
+			continue
+		}
+
+		var plugin, field, attr string
+		attr = attrs[len(attrs)-1]
+		if strings.HasPrefix(attr, "graph_") {
+			plugin = strings.Join(attrs[:len(attrs)-1], ".")
+		} else if len(attrs) >= 3 {
+			plugin = strings.Join(attrs[:len(attrs)-2], ".")
+			field = attrs[len(attrs)-2]
+		} else {
+			continue
+		}
+
+		metric := group + "/" + host + "/" + plugin
+		g, ok := res[metric]
+		if !ok {
+			g = &MuninGraph{Labels: make(map[string]string), CDefs: make(map[string]string)}
+			res[metric] = g
+		}
+
+		switch {
+		case attr == "graph_title":
+			g.Title = value
+		case attr == "graph_vlabel":
+			g.VLabel = value
+		case field != "" && attr == "label":
+			g.Labels[field] = value
+		case field != "" && attr == "cdef":
+			g.CDefs[field] = value
+		}
+	}
+
+	return res, scanner.Err()
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReader returns the same data for every file, the value of the row
+// is the number of the file plus the row index.
+type testReader struct {
+	files map[string]float64
+}
+
+func (r testReader) Info(file string) (MetricInfo, error) {
+	if _, ok := r.files[file]; !ok {
+		return MetricInfo{}, fmt.Errorf("File '%v' not found", file)
+	}
+	return MetricInfo{Step: 5 * time.Minute, LastUpdate: time.Unix(testFirstRow, 0), DS: []string{"42"}}, nil
+}
+
+func (r testReader) Fetch(ctx context.Context, file string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	base, ok := r.files[file]
+	if !ok {
+		return nil, fmt.Errorf("File '%v' not found", file)
+	}
+
+	res := &FetchResult{
+		Start:   time.Unix(testFirstRow-600, 0),
+		Step:    5 * time.Minute,
+		DsNames: []string{"42"},
+		RowCnt:  2,
+	}
+	for i := 0; i < res.RowCnt; i++ {
+		res.Values = append(res.Values, base+float64(i))
+	}
+	return res, nil
+}
+
+func TestParseMuninFile(test *testing.T) {
+	hosts := map[string]bool{"example.com/web-1.example.com": true}
+
+	cases := []struct {
+		name string
+		want muninFile
+		ok   bool
+	}{
+		{"example.com/db1.example.com-load-load-g.rrd", muninFile{"example.com/db1.example.com/load", "load", "g"}, true},
+		{"example.com/db1.example.com-if_eth0-down-d.rrd", muninFile{"example.com/db1.example.com/if_eth0", "down", "d"}, true},
+		{"example.com/db-2.example.com-load-load-g.rrd", muninFile{"example.com/db-2.example.com/load", "load", "g"}, true},
+		{"example.com/web-1.example.com-load-load-g.rrd", muninFile{"example.com/web-1.example.com/load", "load", "g"}, true},
+		{"example.com/web-1.example.com-diskstats_latency-sda-avgwait-g.rrd", muninFile{"example.com/web-1.example.com/diskstats_latency.sda", "avgwait", "g"}, true},
+		{"example.com/db1.example.com-load-load-x.rrd", muninFile{}, false},
+		{"db1.example.com-load-load-g.rrd", muninFile{}, false},
+		{"example.com/db1.example.com-load-g.rrd", muninFile{}, false},
+		{"example.com/datafile", muninFile{}, false},
+	}
+
+	for _, c := range cases {
+		res, ok := parseMuninFile(c.name, hosts)
+		if ok != c.ok || res != c.want {
+			test.Errorf("File: %s\nResult: %+v %v\nWant:   %+v %v\n", c.name, res, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestMuninStorage(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	reader := testReader{files: make(map[string]float64)}
+	for i, f := range []string{
+		"example.com/web-1.example.com-if_eth0-down-d.rrd",
+		"example.com/web-1.example.com-if_eth0-up-d.rrd",
+		"example.com/web-1.example.com-load-load-g.rrd",
+		"other.net/db1.other.net-load-load-g.rrd",
+	} {
+		if err := os.MkdirAll(filepath.Dir(dir+f), 0700); err != nil {
+			test.Fatalf("Can't create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(dir+f, []byte{}, 0600); err != nil {
+			test.Fatalf("Can't write test file: %v", err)
+		}
+		reader.files[dir+f] = float64((i + 1) * 100)
+	}
+
+	datafile := strings.Join([]string{
+		"version 2.0.33",
+		"example.com;web-1.example.com:if_eth0.graph_title eth0 traffic",
+		"example.com;web-1.example.com:if_eth0.graph_vlabel bits in (-) / out (+) per second",
+		"example.com;web-1.example.com:if_eth0.down.label received",
+		"example.com;web-1.example.com:if_eth0.down.cdef down,8,*",
+		"example.com;web-1.example.com:if_eth0.up.label bps",
+		"example.com;web-1.example.com:if_eth0.up.cdef up,down,+",
+		"example.com;web-1.example.com:load.graph_title Load average",
+		"example.com;web-1.example.com:load.load.label load",
+	}, "\n")
+	if err := ioutil.WriteFile(dir+"datafile", []byte(datafile), 0600); err != nil {
+		test.Fatalf("Can't write datafile: %v", err)
+	}
+
+	storage := NewMuninStorage(dir)
+	storage.Reader = reader
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"example.com/web-1.example.com/if_eth0", "example.com/web-1.example.com/load", "other.net/db1.other.net/load"}},
+		{"example.com/web", []string{"example.com/web-1.example.com/if_eth0", "example.com/web-1.example.com/load"}},
+		{"example.com/web-1.example.com/load", []string{"example.com/web-1.example.com/load"}},
+		{"oth", []string{"other.net/db1.other.net/load"}},
+		{"notexists/", []string{}},
+	}
+
+	for _, c := range cases {
+		res, err := storage.ListMetrics(c.prefix)
+		if err != nil || !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Prefix: %s\nResult: %v %v\nWant:   %v\n", c.prefix, res, err, c.want)
+		}
+	}
+
+	inf, err := storage.Info("example.com/web-1.example.com/if_eth0")
+	if err != nil || inf.Step != 5*time.Minute || !reflect.DeepEqual(inf.DS, []string{"down", "up"}) ||
+		inf.Title != "eth0 traffic" || inf.Labels["down"] != "received" {
+		test.Errorf("Incorrect info: %+v %v", inf, err)
+	}
+
+	res, err := storage.Fetch(context.Background(), "example.com/web-1.example.com/if_eth0", CFAVERAGE,
+		time.Unix(testFirstRow-300, 0), time.Unix(testFirstRow, 0), time.Second)
+	if err != nil {
+		test.Fatalf("Fetch error: %v", err)
+	}
+
+	// down = raw*8, up = raw up + raw down
+	want := []float64{800, 300, 808, 302}
+	if !reflect.DeepEqual(res.DsNames, []string{"down", "up"}) || res.RowCnt != 2 || fmt.Sprint(res.Values) != fmt.Sprint(want) {
+		test.Errorf("Fetch result: %v %v %v\nWant:         %v", res.DsNames, res.RowCnt, res.Values, want)
+	}
+
+	// The graph without datafile entry has the raw values.
+	res, err = storage.Fetch(context.Background(), "other.net/db1.other.net/load", CFAVERAGE,
+		time.Unix(testFirstRow-300, 0), time.Unix(testFirstRow, 0), time.Second)
+	if err != nil || fmt.Sprint(res.Values) != fmt.Sprint([]float64{400, 401}) {
+		test.Errorf("Fetch result: %+v %v", res, err)
+	}
+
+	// The files aren't read after the query is aborted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.Fetch(ctx, "other.net/db1.other.net/load", CFAVERAGE,
+		time.Unix(testFirstRow-300, 0), time.Unix(testFirstRow, 0), time.Second); err != context.Canceled {
+		test.Errorf("Canceled error expected, got %v", err)
+	}
+
+	if _, err := storage.Info("example.com/notexists/load"); err == nil {
+		test.Errorf("Error expected for the missing metric")
+	}
+
+	// The fields are cached until the directory is changed.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir+"other.net", past, past); err != nil {
+		test.Fatalf("Can't change directory time: %v", err)
+	}
+	if ds, err := storage.DataSources("other.net/db1.other.net/load"); err != nil || !reflect.DeepEqual(ds, []string{"load"}) {
+		test.Errorf("Incorrect data sources: %v %v", ds, err)
+	}
+
+	if err := ioutil.WriteFile(dir+"other.net/db1.other.net-load-extra-g.rrd", []byte{}, 0600); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	for i, want := range [][]string{{"load"}, {"extra", "load"}} {
+		t := past.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(dir+"other.net", t, t); err != nil {
+			test.Fatalf("Can't change directory time: %v", err)
+		}
+		if ds, err := storage.DataSources("other.net/db1.other.net/load"); err != nil || !reflect.DeepEqual(ds, want) {
+			test.Errorf("Data sources: %v %v\nWant:         %v", ds, err, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamError is the failure of the upstream rrdserver. The federated
+// requests report it and continue with the data of the rest of the storages.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("Upstream '%v': %v", e.Upstream, e.Err)
+}
+
+// PartialError is returned together with the partial result.
+type PartialError struct {
+	Errors []error
+}
+
+func (e *PartialError) Error() string {
+	msgs := []string{}
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// RemoteStorage reads the metrics from the upstream rrdserver API.
+type RemoteStorage struct {
+	Name     string
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+
+	mutex sync.Mutex
+	ds    map[string][]string
+}
+
+// NewRemoteStorage creates the storage for the upstream API, the url is the
+// API prefix like http://dc1.example.com:8085/api/.
+func NewRemoteStorage(name, url string, timeout time.Duration) *RemoteStorage {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+
+	return &RemoteStorage{
+		Name:   name,
+		URL:    url,
+		Client: &http.Client{Timeout: timeout},
+		ds:     make(map[string][]string),
+	}
+}
+
+// post sends the request to the upstream, the request is aborted when the
+// context is done.
+func (s *RemoteStorage) post(ctx context.Context, path string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return &UpstreamError{s.Name, err}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, "POST", s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return &UpstreamError{s.Name, err}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if s.User != "" {
+		r.SetBasicAuth(s.User, s.Password)
+	}
+
+	resp, err := s.Client.Do(r)
+	if err != nil {
+		return &UpstreamError{s.Name, err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &UpstreamError{s.Name, err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := ErrorResponse{}
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return &UpstreamError{s.Name, fmt.Errorf("%v", e.Message)}
+		}
+		return &UpstreamError{s.Name, fmt.Errorf("%v", resp.Status)}
+	}
+
+	if err := json.Unmarshal(data, res); err != nil {
+		return &UpstreamError{s.Name, err}
+	}
+	return nil
+}
+
+func (s *RemoteStorage) suggest(query string) (SuggestMetricsResponse, error) {
+	res := SuggestMetricsResponse{}
+	if err := s.post(context.Background(), "suggest/metrics", SuggestMetricsRequest{Query: query, WithDS: true}, &res); err != nil {
+		return nil, err
+	}
+
+	// The data sources are kept for the following DataSources calls.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range res {
+		s.ds[m.Metric] = m.DS
+	}
+
+	return res, nil
+}
+
+func (s *RemoteStorage) ListMetrics(prefix string) ([]string, error) {
+	metrics, err := s.suggest(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, m := range metrics {
+		res = append(res, m.Metric)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *RemoteStorage) DataSources(metric string) ([]string, error) {
+	s.mutex.Lock()
+	ds, ok := s.ds[metric]
+	s.mutex.Unlock()
+	if ok {
+		return ds, nil
+	}
+
+	metrics, err := s.suggest(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range metrics {
+		if m.Metric == metric {
+			return m.DS, nil
+		}
+	}
+	return nil, &UpstreamError{s.Name, fmt.Errorf("Metric '%v' not found", metric)}
+}
+
+// Info of the remote metric has only the data sources, the API doesn't
+// return the rest of the file information.
+func (s *RemoteStorage) Info(metric string) (MetricInfo, error) {
+	ds, err := s.DataSources(metric)
+	if err != nil {
+		return MetricInfo{}, err
+	}
+	return MetricInfo{DS: ds}, nil
+}
+
+// Fetch requests all data sources of the metric from the upstream /query,
+// the step is taken from the timestamps of the result.
+func (s *RemoteStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	ds, err := s.DataSources(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	if step < time.Second {
+		step = time.Second
+	}
+
+	req := struct {
+		Start   int64               `json:"start"`
+		End     int64               `json:"end"`
+		Step    string              `json:"step"`
+		Queries []QueryRequestQuery `json:"queries"`
+	}{
+		Start: start.Unix(),
+		End:   end.Unix(),
+		Step:  step.String(),
+	}
+
+	for i, d := range ds {
+		req.Queries = append(req.Queries, QueryRequestQuery{
+			Query: fmt.Sprintf("DEF:v%d=%s:%s:%s", i, metric, d, cf.String()),
+		})
+	}
+
+	resp := struct {
+		Result []struct {
+			Values map[string]*float64 `json:"dps"`
+		} `json:"result"`
+	}{}
+
+	if err := s.post(ctx, "query", req, &resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Result) != len(ds) {
+		return nil, &UpstreamError{s.Name, fmt.Errorf("Incorrect count of results for '%v'", metric)}
+	}
+
+	values := make([]map[int64]float64, len(ds))
+	times := []int64{}
+	seen := make(map[int64]bool)
+
+	for i, r := range resp.Result {
+		values[i] = make(map[int64]float64)
+		for k, v := range r.Values {
+			t, err := strconv.ParseInt(k, 10, 64)
+			if err != nil {
+				return nil, &UpstreamError{s.Name, fmt.Errorf("Incorrect time '%v'", k)}
+			}
+
+			if v != nil {
+				values[i][t] = *v
+			}
+
+			if !seen[t] {
+				seen[t] = true
+				times = append(times, t)
+			}
+		}
+	}
+
+	if len(times) == 0 {
+		return nil, &UpstreamError{s.Name, fmt.Errorf("Empty result for '%v'", metric)}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	st := int64(step / time.Second)
+	if len(times) > 1 {
+		st = times[1] - times[0]
+	}
+
+	res := &FetchResult{
+		Start:   time.Unix(times[0]-st, 0),
+		Step:    time.Duration(st) * time.Second,
+		DsNames: ds,
+		RowCnt:  int((times[len(times)-1]-times[0])/st) + 1,
+	}
+
+	for r := 0; r < res.RowCnt; r++ {
+		t := times[0] + int64(r)*st
+		for i := range ds {
+			if v, ok := values[i][t]; ok {
+				res.Values = append(res.Values, v)
+			} else {
+				res.Values = append(res.Values, math.NaN())
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUpstream starts rrdserver API on top of the storage.
+func newTestUpstream(storage Storage) *httptest.Server {
+	api := NewAPI("")
+	api.Storage = storage
+
+	router := mux.NewRouter()
+	api.Serve(router.PathPrefix("/api/").Subrouter())
+	return httptest.NewServer(router)
+}
+
+func newTestFederation() (*MultiStorage, func()) {
+	dc2 := NewMemoryStorage()
+	dc2.Add("server2.net/load/load", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"shortterm"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{0.5}, {0.7}},
+	})
+
+	up1 := newTestUpstream(newTestMemoryStorage())
+	up2 := newTestUpstream(dc2)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("[]"))
+	}))
+
+	storage := NewMultiStorage()
+	storage.Add("dc1", NewRemoteStorage("dc1", up1.URL+"/api", time.Second))
+	storage.Add("dc2", NewRemoteStorage("dc2", up2.URL+"/api/", time.Second))
+	storage.Add("slow", NewRemoteStorage("slow", slow.URL+"/api/", 100*time.Millisecond))
+
+	return storage, func() {
+		up1.Close()
+		up2.Close()
+		slow.Close()
+	}
+}
+
+func TestRemoteStorage(test *testing.T) {
+	storage, done := newTestFederation()
+	defer done()
+
+	res, err := storage.ListMetrics("")
+	want := []string{
+		"dc1/server1.net/cpu-0/cpu-system",
+		"dc1/server1.net/cpu-1/cpu-system",
+		"dc1/server1.net/cpu-1/cpu-system2",
+		"dc1/server1.net/interface-eth0/if_packets",
+		"dc2/server2.net/load/load",
+	}
+	if !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics: %v\nWant:               %v", res, want)
+	}
+
+	partial, ok := err.(*PartialError)
+	if !ok || len(partial.Errors) != 1 || partial.Errors[0].(*UpstreamError).Upstream != "slow" {
+		test.Errorf("Partial error expected for the slow upstream: %v", err)
+	}
+
+	res, err = storage.ListMetrics("dc1/server1.net/cpu-1/")
+	want = []string{"dc1/server1.net/cpu-1/cpu-system", "dc1/server1.net/cpu-1/cpu-system2"}
+	if err != nil || !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics: %v %v\nWant:               %v", res, err, want)
+	}
+
+	ds, err := storage.DataSources("dc1/server1.net/interface-eth0/if_packets")
+	if err != nil || !reflect.DeepEqual(ds, []string{"rx", "tx"}) {
+		test.Errorf("Incorrect DS: %v %v", ds, err)
+	}
+
+	data, err := storage.Fetch(context.Background(), "dc2/server2.net/load/load", CFAVERAGE,
+		time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow+60, 0), time.Second)
+	if err != nil {
+		test.Fatalf("Fetch error: %v", err)
+	}
+
+	if data.Start.Unix() != testFirstRow-60 || data.Step != time.Minute || data.RowCnt != 2 ||
+		fmt.Sprint(data.Values) != fmt.Sprint([]float64{0.5, 0.7}) {
+		test.Errorf("Incorrect fetch result: %v %v %v %v", data.Start.Unix(), data.Step, data.RowCnt, data.Values)
+	}
+
+	if _, err := storage.Fetch(context.Background(), "dc1/notexists", CFAVERAGE, time.Unix(testFirstRow, 0), time.Unix(testFirstRow+60, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the missing metric")
+	}
+
+	// The request of the done query isn't sent.
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.Fetch(canceled, "dc2/server2.net/load/load", CFAVERAGE,
+		time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow+60, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the canceled fetch")
+	}
+}
+
+func TestFederationHandlers(test *testing.T) {
+	storage, done := newTestFederation()
+	defer done()
+
+	api := NewAPI("")
+	api.Storage = storage
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1", nil)
+	w := httptest.NewRecorder()
+	api.SuggestMetricsGetHandler(w, req)
+
+	suggest := SuggestMetricsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &suggest); err != nil || w.Code != http.StatusOK || len(suggest) != 5 {
+		test.Errorf("Incorrect suggest response: %v %v", w.Code, w.Body.String())
+	}
+
+	if h := w.Header().Get("X-Upstream-Error"); !strings.Contains(h, "'slow'") {
+		test.Errorf("Incorrect X-Upstream-Error header: '%v'", h)
+	}
+
+	j := MakePostRequest(test, api.QueryPostHandler, fmt.Sprintf(`{
+		"start": %d,
+		"end":   %d,
+		"queries": [
+			{"query": "DEF:rx=dc1/server1.net/interface-eth0/if_packets:rx:AVERAGE"},
+			{"query": "DEF:slow=slow/server3.net/load/load:shortterm:AVERAGE"}
+		]}`, testFirstRow-60, testFirstRow+60))
+
+	resp := struct {
+		Result []struct {
+			Name   string              `json:"name"`
+			Values map[string]*float64 `json:"dps"`
+		} `json:"result"`
+		Errors []string `json:"errors"`
+	}{}
+
+	if err := json.Unmarshal([]byte(j), &resp); err != nil || len(resp.Result) != 2 {
+		test.Fatalf("Incorrect query response '%v': %v", j, err)
+	}
+
+	rx := resp.Result[0].Values
+	if len(rx) != 2 || *rx[fmt.Sprint(testFirstRow)] != 100 || *rx[fmt.Sprint(testFirstRow+60)] != 110 {
+		test.Errorf("Incorrect values of the upstream metric: %v", j)
+	}
+
+	for t, v := range resp.Result[1].Values {
+		if v != nil {
+			test.Errorf("Null expected at %v for the failed upstream: %v", t, *v)
+		}
+	}
+
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0], "'slow'") {
+		test.Errorf("Incorrect errors of the query: %v", resp.Errors)
+	}
+}
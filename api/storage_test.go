@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestMemoryStorage() *MemoryStorage {
+	storage := NewMemoryStorage()
+	for _, m := range []string{
+		"server1.net/cpu-0/cpu-system",
+		"server1.net/cpu-1/cpu-system",
+		"server1.net/cpu-1/cpu-system2",
+	} {
+		storage.Add(m, MemoryMetric{
+			Step:  time.Minute,
+			DS:    []string{"value"},
+			First: time.Unix(testFirstRow, 0),
+			Rows:  [][]float64{{1}, {2}, {3}},
+		})
+	}
+
+	storage.Add("server1.net/interface-eth0/if_packets", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"tx", "rx"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{300, 100}, {320, 110}},
+	})
+
+	return storage
+}
+
+func TestMemoryStorage(test *testing.T) {
+	storage := newTestMemoryStorage()
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"server1.net/cpu-0/cpu-system", "server1.net/cpu-1/cpu-system", "server1.net/cpu-1/cpu-system2", "server1.net/interface-eth0/if_packets"}},
+		{"server1.net/cpu-", []string{"server1.net/cpu-0/cpu-system", "server1.net/cpu-1/cpu-system", "server1.net/cpu-1/cpu-system2"}},
+		{"server1.net/cpu-1/cpu-system", []string{"server1.net/cpu-1/cpu-system"}},
+		{"server1.net/cpu-1/cpu-system/", []string{"server1.net/cpu-1/cpu-system"}},
+		{"notexists", []string{}},
+	}
+
+	for _, c := range cases {
+		res, err := storage.ListMetrics(c.prefix)
+		if err != nil || !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Prefix: %s\nResult: %v %v\nWant:   %v\n", c.prefix, res, err, c.want)
+		}
+	}
+
+	inf, err := storage.Info("server1.net/interface-eth0/if_packets")
+	if err != nil || inf.Step != time.Minute || inf.LastUpdate.Unix() != testFirstRow+60 || !reflect.DeepEqual(inf.DS, []string{"rx", "tx"}) {
+		test.Errorf("Incorrect info: %+v %v", inf, err)
+	}
+
+	res, err := storage.Fetch(context.Background(), "server1.net/interface-eth0/if_packets", CFAVERAGE,
+		time.Unix(testFirstRow-61, 0), time.Unix(testFirstRow+30, 0), time.Second)
+	if err != nil {
+		test.Fatalf("Fetch error: %v", err)
+	}
+
+	nan := math.NaN()
+	want := []float64{nan, nan, 300, 100, 320, 110}
+	if res.Start.Unix() != testFirstRow-120 || res.RowCnt != 3 || fmt.Sprint(res.Values) != fmt.Sprint(want) {
+		test.Errorf("Fetch result: %v %v %v\nWant:         %v %v %v", res.Start.Unix(), res.RowCnt, res.Values, testFirstRow-120, 3, want)
+	}
+
+	if _, err := storage.Fetch(context.Background(), "notexists", CFAVERAGE, time.Unix(testFirstRow, 0), time.Unix(testFirstRow+60, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the missing metric")
+	}
+}
+
+func TestSuggestMetricsStorage(test *testing.T) {
+	api := NewAPI("")
+	api.Storage = newTestMemoryStorage()
+
+	cases := []struct {
+		Get  string
+		Want string
+	}{
+		{
+			`?query=server1.net/cpu-1`,
+			`[
+			{"metric": "server1.net/cpu-1/cpu-system",  "ds": ["value"]},
+			{"metric": "server1.net/cpu-1/cpu-system2", "ds": ["value"]}
+		]`,
+		},
+		{
+			`?query=server1.net/interface-eth0/if_packets:t`,
+			`[
+			{"metric": "server1.net/interface-eth0/if_packets", "ds": ["tx"]}
+		]`,
+		},
+		{
+			`?query=server1.net/&tags=plugin=cpu,type_instance=system&withtags=true`,
+			`[
+			{"metric": "server1.net/cpu-0/cpu-system", "ds": ["value"],
+			 "tags": {"host": "server1.net", "plugin": "cpu", "plugin_instance": "0", "type": "cpu", "type_instance": "system"}},
+			{"metric": "server1.net/cpu-1/cpu-system", "ds": ["value"],
+			 "tags": {"host": "server1.net", "plugin": "cpu", "plugin_instance": "1", "type": "cpu", "type_instance": "system"}}
+		]`,
+		},
+		{
+			`?tags=host=server*,plugin_instance=eth*&withds=false`,
+			`[
+			{"metric": "server1.net/interface-eth0/if_packets", "ds": []}
+		]`,
+		},
+	}
+
+	for _, c := range cases {
+		want := SuggestMetricsResponse{}
+		resp := SuggestMetricsResponse{}
+
+		if err := json.Unmarshal([]byte(c.Want), &want); err != nil {
+			test.Fatalf("Incorrect want '%v': %v", c.Want, err)
+		}
+
+		j := MakeGetRequest(test, api.SuggestMetricsGetHandler, c.Get)
+		if err := json.Unmarshal([]byte(j), &resp); err != nil {
+			test.Errorf("Query: '%s'\nIncorrect response '%v': %v\n", c.Get, j, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(resp, want) {
+			test.Errorf("Query: '%s'\n\nResult: %v\n\nWant:   %v\n", c.Get, resp, want)
+		}
+	}
+}
+
+// writeTestWhisper writes the Whisper file with one archive, the points
+// are stored from the first one.
+func writeTestWhisper(name string, step uint32, first uint32, values []float64) error {
+	be := binary.BigEndian
+	buf := make([]byte, 28+len(values)*12)
+
+	be.PutUint32(buf[0:], 1) // average
+	be.PutUint32(buf[4:], step*uint32(len(values)))
+	be.PutUint32(buf[8:], math.Float32bits(0.5))
+	be.PutUint32(buf[12:], 1)
+	be.PutUint32(buf[16:], 28)
+	be.PutUint32(buf[20:], step)
+	be.PutUint32(buf[24:], uint32(len(values)))
+
+	for i, v := range values {
+		be.PutUint32(buf[28+i*12:], first+uint32(i)*step)
+		be.PutUint64(buf[32+i*12:], math.Float64bits(v))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, buf, 0600)
+}
+
+func TestWhisperStorage(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	if err := writeTestWhisper(dir+"server1/load/x.wsp", 60, testFirstRow, []float64{1, 2, 3}); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if err := writeTestWhisper(dir+"server1/load/y.wsp", 60, testFirstRow, []float64{10, 20, 30}); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if err := ioutil.WriteFile(dir+"server1/load/z.rrd", []byte{}, 0600); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+
+	storage := NewWhisperStorage(dir)
+	metrics, err := storage.ListMetrics("server1/")
+	if err != nil || !reflect.DeepEqual(metrics, []string{"server1/load/x", "server1/load/y"}) {
+		test.Errorf("Incorrect metrics: %v %v", metrics, err)
+	}
+
+	inf, err := storage.Info("server1/load/x")
+	if err != nil || inf.Step != time.Minute || inf.LastUpdate.Unix() != testFirstRow+120 || !reflect.DeepEqual(inf.DS, []string{"value"}) {
+		test.Errorf("Incorrect info: %+v %v", inf, err)
+	}
+
+	api := NewAPI("")
+	api.Storage = storage
+
+	res, err := api.xport(context.Background(), QueryRequest{
+		Start: Time(time.Unix(testFirstRow-60, 0)),
+		End:   Time(time.Unix(testFirstRow+60, 0)),
+		Step:  Duration(time.Second),
+		Queries: []QueryRequestQuery{
+			{Query: "DEF:X=server1/load/x:value:AVERAGE", Hidden: true},
+			{Query: "DEF:Y=server1/load/y:value:MAX", Hidden: true},
+			{Query: "CDEF:SUM=X,Y,+"},
+		},
+	})
+	if err != nil {
+		test.Fatalf("Query error: %v", err)
+	}
+
+	got := []float64{}
+	for r := 0; r < res.RowCnt; r++ {
+		got = append(got, res.ValueAt(0, r))
+	}
+
+	// The row after the end is added by xport the same way as rrd_xport does.
+	want := []float64{11, 22, math.NaN()}
+	if res.Start.Unix() != testFirstRow-60 || fmt.Sprint(got) != fmt.Sprint(want) {
+		test.Errorf("Query result: %v %v\nWant:         %v %v", res.Start.Unix(), got, testFirstRow-60, want)
+	}
+
+	// The files aren't read after the query is aborted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.Fetch(ctx, "server1/load/x", CFAVERAGE, time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow+60, 0), time.Second); err != context.Canceled {
+		test.Errorf("Canceled error expected, got %v", err)
+	}
+
+	files := &FileStorage{DataDir: dir, Reader: testReader{files: map[string]float64{dir + "server1/load/z.rrd": 1}}}
+	if _, err := files.Fetch(ctx, "server1/load/z", CFAVERAGE, time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow+60, 0), time.Second); err != context.Canceled {
+		test.Errorf("Canceled error expected, got %v", err)
+	}
+}
+
+func TestMultiStorage(test *testing.T) {
+	metric := MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"value"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{1}},
+	}
+
+	collectd := NewMemoryStorage()
+	collectd.Add("server1.net/load/load", metric)
+	collectd.Add("munin/load", metric) // Shadowed by the munin namespace.
+
+	munin := NewMemoryStorage()
+	munin.Add("server1.net/load-load", metric)
+
+	munin2 := NewMemoryStorage()
+	munin2.Add("server2.net/load-load", metric)
+
+	storage := NewMultiStorage()
+	storage.Add("", collectd)
+	storage.Add("munin", munin)
+	storage.Add("munin2", munin2)
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"munin/server1.net/load-load", "munin2/server2.net/load-load", "server1.net/load/load"}},
+		{"mun", []string{"munin/server1.net/load-load", "munin2/server2.net/load-load"}},
+		{"munin", []string{"munin/server1.net/load-load", "munin2/server2.net/load-load"}},
+		{"munin/", []string{"munin/server1.net/load-load"}},
+		{"munin/server1.net/load-load", []string{"munin/server1.net/load-load"}},
+		{"server1", []string{"server1.net/load/load"}},
+		{"notexists", []string{}},
+	}
+
+	for _, c := range cases {
+		res, err := storage.ListMetrics(c.prefix)
+		if err != nil || !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Prefix: %s\nResult: %v %v\nWant:   %v\n", c.prefix, res, err, c.want)
+		}
+	}
+
+	for _, m := range []string{"server1.net/load/load", "munin/server1.net/load-load", "munin2/server2.net/load-load"} {
+		if ds, err := storage.DataSources(m); err != nil || !reflect.DeepEqual(ds, []string{"value"}) {
+			test.Errorf("Metric: %s\nIncorrect DS: %v %v\n", m, ds, err)
+		}
+	}
+
+	if _, err := storage.Info("munin/load"); err == nil {
+		test.Errorf("Error expected for the shadowed metric")
+	}
+
+	nsOnly := NewMultiStorage()
+	nsOnly.Add("munin", munin)
+	if _, err := nsOnly.Fetch(context.Background(), "server1.net/load-load", CFAVERAGE, time.Unix(testFirstRow, 0), time.Unix(testFirstRow+60, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the metric without namespace")
+	}
+}
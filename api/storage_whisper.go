@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"github.com/rrdserver/rrdserver/whisper"
+	"time"
+)
+
+// WhisperStorage keeps the metrics in the Graphite Whisper files of the data
+// directory. Every file has the single data source "value", the consolidation
+// function of the DEF is ignored: the file keeps one aggregation method.
+type WhisperStorage struct {
+	DataDir string
+}
+
+func NewWhisperStorage(dataDir string) *WhisperStorage {
+	return &WhisperStorage{DataDir: dataDir}
+}
+
+func (s *WhisperStorage) FileForMetric(metric string) string {
+	return s.DataDir + SafeMetric(metric) + ".wsp"
+}
+
+func (s *WhisperStorage) ListMetrics(prefix string) ([]string, error) {
+	res := []string{}
+	for _, f := range findFiles(s.DataDir, prefix, ".wsp") {
+		res = append(res, f[len(s.DataDir):len(f)-4])
+	}
+	return res, nil
+}
+
+func (s *WhisperStorage) DataSources(metric string) ([]string, error) {
+	if _, err := whisper.Open(s.FileForMetric(metric)); err != nil {
+		return nil, err
+	}
+	return []string{"value"}, nil
+}
+
+func (s *WhisperStorage) Info(metric string) (MetricInfo, error) {
+	f, err := whisper.Open(s.FileForMetric(metric))
+	if err != nil {
+		return MetricInfo{}, err
+	}
+
+	last, err := f.LastUpdate()
+	if err != nil {
+		return MetricInfo{}, err
+	}
+
+	return MetricInfo{
+		Step:       time.Duration(f.Archives[0].Step) * time.Second,
+		LastUpdate: last,
+		DS:         []string{"value"},
+	}, nil
+}
+
+func (s *WhisperStorage) Fetch(ctx context.Context, metric string, cf Consolidation, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := whisper.Open(s.FileForMetric(metric))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.Fetch(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FetchResult{
+		Start:   res.Start,
+		Step:    res.Step,
+		DsNames: []string{"value"},
+		RowCnt:  len(res.Values),
+		Values:  res.Values,
+	}, nil
+}
@@ -2,30 +2,57 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/ziutek/rrd"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 )
 
 type SuggestMetricsRequest struct {
-	Query  string `json:"query"`
-	WithDS bool   `json:"withds"`
+	Query    string `json:"query"`
+	WithDS   bool   `json:"withds"`
+	WithTags bool   `json:"withtags"`
+
+	// Tags is the collectd tag filter like "host=web*,plugin=interface".
+	Tags string `json:"tags"`
+
+	// Mode is prefix (default), substring, fuzzy, regex or glob. The regex
+	// is matched against the metric only, the "metric:ds" form is used by
+	// the rest of the modes. The fuzzy results are sorted by the score, the
+	// glob segments are matched like the ACL globs ("web*/**").
+	Mode   string `json:"mode"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
 }
 
 type SuggestMetric struct {
-	Metric string   `json:"metric"`
-	DS     []string `json:"ds"`
+	Metric string        `json:"metric"`
+	DS     []string      `json:"ds"`
+	Tags   *CollectdTags `json:"tags,omitempty"`
+}
+
+func (req *SuggestMetricsRequest) Check() error {
+	if _, err := ParseTagFilter(req.Tags); err != nil {
+		return fmt.Errorf("Incorrect request: %v", err)
+	}
+
+	if _, err := newMatcher(req.Mode, req.Query); err != nil {
+		return fmt.Errorf("Incorrect request: %v", err)
+	}
+
+	if req.Limit < 0 || req.Offset < 0 {
+		return errors.New("Incorrect request: limit and offset should not be negative")
+	}
+	return nil
 }
 
 type SuggestMetricsResponse []SuggestMetric
 
 func (api *API) SuggestMetricsGetHandler(w http.ResponseWriter, r *http.Request) {
+	api = api.forRequest(r)
 	var err error
 	api.CommonHeader(w, r)
 
@@ -52,7 +79,40 @@ func (api *API) SuggestMetricsGetHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	res, err := api.SuggestMetrics(req)
+	if v, ok := r.Form["withtags"]; ok {
+		req.WithTags, err = strconv.ParseBool(v[0])
+		if err != nil {
+			BadRequest(w, "%v", err)
+			return
+		}
+	}
+
+	if v, ok := r.Form["tags"]; ok {
+		req.Tags = v[0]
+	}
+
+	if v, ok := r.Form["mode"]; ok {
+		req.Mode = v[0]
+	}
+
+	for name, p := range map[string]*int{"limit": &req.Limit, "offset": &req.Offset} {
+		if v, ok := r.Form[name]; ok {
+			*p, err = strconv.Atoi(v[0])
+			if err != nil {
+				BadRequest(w, "Incorrect %v '%v': %v", name, v[0], err)
+				return
+			}
+		}
+	}
+
+	if err = req.Check(); err != nil {
+		BadRequest(w, "%v", err)
+		return
+	}
+
+	res, total, err := api.suggestMetrics(req)
+	err = PartialErrorHeader(w, err)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 
 	if err != nil {
 		InternalServerError(w, "%v", err)
@@ -67,6 +127,7 @@ func (api *API) SuggestMetricsGetHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (api *API) SuggestMetricsPostHandler(w http.ResponseWriter, r *http.Request) {
+	api = api.forRequest(r)
 	api.CommonHeader(w, r)
 
 	if r.Body == nil {
@@ -89,7 +150,14 @@ func (api *API) SuggestMetricsPostHandler(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	res, err := api.SuggestMetrics(req)
+	if err = req.Check(); err != nil {
+		BadRequest(w, "%v", err)
+		return
+	}
+
+	res, total, err := api.suggestMetrics(req)
+	err = PartialErrorHeader(w, err)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 
 	if err != nil {
 		InternalServerError(w, "%v", err)
@@ -112,91 +180,139 @@ func splitSuggestMetricsRequestQuery(query string) (metric, ds string) {
 	return metric, ds
 }
 
+// SuggestMetrics returns *PartialError with the result when some of the
+// upstreams failed.
 func (api API) SuggestMetrics(req SuggestMetricsRequest) (SuggestMetricsResponse, error) {
-	dataDirLen := len(api.DataDir)
+	res, _, err := api.suggestMetrics(req)
+	return res, err
+}
 
+// suggestMetrics returns the requested page of the result and the count of
+// all matched metrics.
+func (api API) suggestMetrics(req SuggestMetricsRequest) (SuggestMetricsResponse, int, error) {
 	reqMetric, reqDS := splitSuggestMetricsRequestQuery(req.Query)
+	switch req.Mode {
+	case SearchRegex:
+		reqMetric, reqDS = req.Query, ""
+	case "", SearchPrefix:
+		// The prefix is the metric path the same way the storages see it.
+		reqMetric = SafeMetric(strings.TrimRight(reqMetric, "/"))
+	}
 
-	res := SuggestMetricsResponse{}
+	filter, err := ParseTagFilter(req.Tags)
+	if err != nil {
+		return SuggestMetricsResponse{}, 0, err
+	}
 
-	for _, f := range api.findRRDFiles(reqMetric) {
+	match, err := newMatcher(req.Mode, reqMetric)
+	if err != nil {
+		return SuggestMetricsResponse{}, 0, err
+	}
+
+	matchDS, err := newMatcher(req.Mode, reqDS)
+	if err != nil {
+		return SuggestMetricsResponse{}, 0, err
+	}
+
+	// Only the prefix and glob searches can be narrowed by the storage, the
+	// index finds the prefix in the sorted names.
+	prefix := ""
+	switch req.Mode {
+	case "", SearchPrefix:
+		prefix = reqMetric
+	case SearchGlob:
+		prefix = globPrefix(reqMetric)
+	}
+
+	metrics, err := api.Storage.ListMetrics(prefix)
+	partial, ok := err.(*PartialError)
+	if err != nil && !ok {
+		return SuggestMetricsResponse{}, 0, err
+	}
+	if !ok {
+		partial = &PartialError{}
+	}
+
+	matched := SuggestMetricsResponse{}
+	scores := make(map[string]int)
+	for _, m := range metrics {
+		score := match(m)
+		if score < 0 || !filter.Match(m) {
+			continue
+		}
 
 		item := SuggestMetric{
-			Metric: f[dataDirLen : len(f)-4],
+			Metric: m,
 			DS:     []string{},
 		}
 
-		if req.WithDS {
-			ds, err := api.GetDataSources(f)
+		if req.WithTags {
+			if tags, ok := ParseCollectdMetric(m); ok {
+				item.Tags = &tags
+			}
+		}
+
+		matched = append(matched, item)
+		scores[m] = score
+	}
+
+	if req.Mode == SearchFuzzy {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return scores[matched[i].Metric] > scores[matched[j].Metric]
+		})
+	}
+
+	// The data sources are read only for the page, unless the DS query
+	// decides which metrics match.
+	total := len(matched)
+	paged := !req.WithDS || reqDS == ""
+	if paged {
+		matched = pageMetrics(matched, req.Offset, req.Limit)
+	}
+
+	res := matched
+	if req.WithDS {
+		res = SuggestMetricsResponse{}
+		for _, item := range matched {
+			ds, err := api.Storage.DataSources(item.Metric)
+			if uerr, ok := err.(*UpstreamError); ok {
+				partial.Errors = append(partial.Errors, uerr)
+				continue
+			}
 			if err != nil {
-				return SuggestMetricsResponse{}, err
+				return SuggestMetricsResponse{}, 0, err
 			}
 
 			for _, d := range ds {
-				if strings.HasPrefix(d, reqDS) {
+				if matchDS(d) >= 0 {
 					item.DS = append(item.DS, d)
 				}
 			}
 
-		}
-
-		if !req.WithDS || len(item.DS) > 0 {
-			res = append(res, item)
+			if len(item.DS) > 0 {
+				res = append(res, item)
+			}
 		}
 	}
 
-	return res, nil
-}
-
-func (api API) GetDataSources(rddFile string) ([]string, error) {
-	res := []string{}
-
-	inf, err := rrd.Info(rddFile)
-	if err != nil {
-		return nil, fmt.Errorf("Can't get info for %s file: %v", rddFile, err)
+	if !paged {
+		total = len(res)
+		res = pageMetrics(res, req.Offset, req.Limit)
 	}
 
-	switch v := inf["ds.type"].(type) {
-	case map[string]interface{}:
-		for ds := range v {
-			res = append(res, ds)
-		}
-	default:
-		return nil, fmt.Errorf("Can't get ds.type from info for %s file", rddFile)
+	if len(partial.Errors) > 0 {
+		return res, total, partial
 	}
-
-	sort.Strings(res)
-	return res, nil
+	return res, total, nil
 }
 
-func (api *API) findRRDFiles(query string) []string {
-	path := api.DataDir + SafeMetric(strings.TrimRight(query, "/"))
-	dir := filepath.Dir(path)
-
-	if isFile(path + ".rrd") {
-		return []string{path + ".rrd"}
+func pageMetrics(res SuggestMetricsResponse, offset, limit int) SuggestMetricsResponse {
+	if offset >= len(res) {
+		return SuggestMetricsResponse{}
 	}
-
-	var startPath string
-	if isDir(path) {
-		startPath = path
-	} else {
-		startPath = dir
+	res = res[offset:]
+	if limit > 0 && limit < len(res) {
+		res = res[:limit]
 	}
-
-	res := []string{}
-	filepath.Walk(startPath, func(file string, f os.FileInfo, e error) error {
-
-		if e != nil {
-			return e
-		}
-
-		if !f.IsDir() && strings.HasSuffix(file, ".rrd") && strings.HasPrefix(file, path) {
-			res = append(res, file)
-		}
-		return nil
-	})
-
-	sort.Strings(res)
 	return res
 }
@@ -87,10 +87,10 @@ func TestFindRRDFiles(test *testing.T) {
 			Expected{dir + "server1.net/interface-eth0/if_packets.rrd"}},
 	}
 
-	api := NewAPI(rrd.Directory)
+	storage := NewFileStorage(rrd.Directory)
 	for _, c := range cases {
 
-		r := api.findRRDFiles(c.query)
+		r := storage.findRRDFiles(c.query)
 
 		if !comparePaths(r, c.expected) {
 			sort.Strings(c.expected)
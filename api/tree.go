@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TreeNode is the child of the tree path: the leaf is the metric, the
+// expandable node has metrics under it. The node can be both when the
+// metric and the directory share the name.
+type TreeNode struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Leaf       bool   `json:"leaf"`
+	Expandable bool   `json:"expandable"`
+	Count      int    `json:"count"`
+}
+
+type TreeResponse []TreeNode
+
+func (api *API) TreeHandler(w http.ResponseWriter, r *http.Request) {
+	api = api.forRequest(r)
+	var err error
+	api.CommonHeader(w, r)
+
+	path := ""
+	if v, ok := r.URL.Query()["path"]; ok {
+		path, err = Unquote(v[0])
+		if err != nil {
+			BadRequest(w, "Incorrect path '%v': %v\n", v[0], err)
+			return
+		}
+	}
+
+	res, err := api.Tree(path)
+	err = PartialErrorHeader(w, err)
+
+	if err != nil {
+		InternalServerError(w, "%v", err)
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(res); err != nil {
+		InternalServerError(w, "%v", err)
+		return
+	}
+}
+
+// Tree returns one level of the children of the path, Count is the number
+// of the metrics under the child. It returns *PartialError with the result
+// when some of the upstreams failed.
+func (api API) Tree(path string) (TreeResponse, error) {
+	path = SafeMetric(strings.Trim(path, "/"))
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	metrics, err := api.Storage.ListMetrics(prefix)
+	partial, ok := err.(*PartialError)
+	if err != nil && !ok {
+		return TreeResponse{}, err
+	}
+
+	nodes := make(map[string]*TreeNode)
+	for _, m := range metrics {
+		if !strings.HasPrefix(m, prefix) || m == prefix {
+			continue
+		}
+
+		items := strings.SplitN(m[len(prefix):], "/", 2)
+		node, ok := nodes[items[0]]
+		if !ok {
+			node = &TreeNode{Name: items[0], Path: prefix + items[0]}
+			nodes[items[0]] = node
+		}
+
+		node.Count++
+		if len(items) == 1 {
+			node.Leaf = true
+		} else {
+			node.Expandable = true
+		}
+	}
+
+	res := TreeResponse{}
+	for _, node := range nodes {
+		res = append(res, *node)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	if partial != nil && len(partial.Errors) > 0 {
+		return res, partial
+	}
+	return res, nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTree(test *testing.T) {
+	storage := newTestMemoryStorage()
+	metric := MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"value"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{1}},
+	}
+	storage.Add("server1.net/load", metric)
+	storage.Add("server1.net/load/load", metric)
+	storage.Add("server2.net/load/load", metric)
+
+	api := NewAPI("")
+	api.Storage = storage
+
+	cases := []struct {
+		Get  string
+		Want string
+	}{
+		{
+			``,
+			`[
+			{"name": "server1.net", "path": "server1.net", "leaf": false, "expandable": true, "count": 6},
+			{"name": "server2.net", "path": "server2.net", "leaf": false, "expandable": true, "count": 1}
+		]`,
+		},
+		{
+			`?path=server1.net`,
+			`[
+			{"name": "cpu-0",          "path": "server1.net/cpu-0",          "leaf": false, "expandable": true, "count": 1},
+			{"name": "cpu-1",          "path": "server1.net/cpu-1",          "leaf": false, "expandable": true, "count": 2},
+			{"name": "interface-eth0", "path": "server1.net/interface-eth0", "leaf": false, "expandable": true, "count": 1},
+			{"name": "load",           "path": "server1.net/load",           "leaf": true,  "expandable": true, "count": 2}
+		]`,
+		},
+		{
+			`?path="server1.net/cpu-1/"`,
+			`[
+			{"name": "cpu-system",  "path": "server1.net/cpu-1/cpu-system",  "leaf": true, "expandable": false, "count": 1},
+			{"name": "cpu-system2", "path": "server1.net/cpu-1/cpu-system2", "leaf": true, "expandable": false, "count": 1}
+		]`,
+		},
+		{
+			`?path=server1.net/load`,
+			`[
+			{"name": "load", "path": "server1.net/load/load", "leaf": true, "expandable": false, "count": 1}
+		]`,
+		},
+		{`?path=server1.net/cpu-1/cpu-system`, `[]`},
+		{`?path=server1`, `[]`},
+		{`?path=notexists`, `[]`},
+	}
+
+	for _, c := range cases {
+		want := TreeResponse{}
+		resp := TreeResponse{}
+
+		if err := json.Unmarshal([]byte(c.Want), &want); err != nil {
+			test.Fatalf("Incorrect want '%v': %v", c.Want, err)
+		}
+
+		j := MakeGetRequest(test, api.TreeHandler, c.Get)
+		if err := json.Unmarshal([]byte(j), &resp); err != nil {
+			test.Errorf("Query: '%s'\nIncorrect response '%v': %v\n", c.Get, j, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(resp, want) {
+			test.Errorf("Query: '%s'\n\nResult: %v\n\nWant:   %v\n", c.Get, resp, want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/rrdserver/rrdserver/writer"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a single line of the InfluxDB line protocol:
+// <measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+// Metric maps a point to the collectd like path:
+// <host>/<measurement>[-<tag key>_<tag value>...] where the rest of the tags
+// are sorted by the key. The keys keep {a=x} and {b=x} apart.
+func (p Point) Metric() string {
+	keys := []string{}
+	for k := range p.Tags {
+		if k != "host" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := p.Measurement
+	for _, k := range keys {
+		res += "-" + strings.Replace(k+"_"+p.Tags[k], "/", "_", -1)
+	}
+
+	if host, ok := p.Tags["host"]; ok && host != "" {
+		res = strings.Replace(host, "/", "_", -1) + "/" + res
+	}
+
+	return res
+}
+
+func precisionMultiplier(precision string) (int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return 1, nil
+	case "u", "us":
+		return int64(time.Microsecond), nil
+	case "ms":
+		return int64(time.Millisecond), nil
+	case "s":
+		return int64(time.Second), nil
+	case "m":
+		return int64(time.Minute), nil
+	case "h":
+		return int64(time.Hour), nil
+	}
+	return 0, fmt.Errorf("Incorrect precision '%v'", precision)
+}
+
+func ParseLineProtocol(data string, precision string, now time.Time) ([]Point, error) {
+	mult, err := precisionMultiplier(precision)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Point{}
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := parseLine(line, mult, now)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n+1, err)
+		}
+
+		if len(p.Fields) > 0 {
+			res = append(res, p)
+		}
+	}
+
+	return res, nil
+}
+
+func parseLine(line string, mult int64, now time.Time) (Point, error) {
+	sections := []string{}
+	for _, s := range splitUnescaped(line, ' ', true) {
+		if s != "" {
+			sections = append(sections, s)
+		}
+	}
+
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, fmt.Errorf("Incorrect line '%v'", line)
+	}
+
+	res := Point{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]float64),
+		Time:   now,
+	}
+
+	// Measurement and tags ...........
+	items := splitUnescaped(sections[0], ',', false)
+	res.Measurement = unescape(items[0])
+	if res.Measurement == "" {
+		return Point{}, fmt.Errorf("Missing measurement in the line '%v'", line)
+	}
+
+	for _, t := range items[1:] {
+		kv := splitUnescaped(t, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return Point{}, fmt.Errorf("Incorrect tag '%v' in the line '%v'", t, line)
+		}
+		res.Tags[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	// Fields .........................
+	for _, f := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(f, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return Point{}, fmt.Errorf("Incorrect field '%v' in the line '%v'", f, line)
+		}
+
+		v, ok, err := parseFieldValue(kv[1])
+		if err != nil {
+			return Point{}, fmt.Errorf("Incorrect value of the field '%v' in the line '%v': %v", kv[0], line, err)
+		}
+
+		// String fields can't be stored in RRD files.
+		if ok {
+			res.Fields[unescape(kv[0])] = v
+		}
+	}
+
+	// Timestamp ......................
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("Incorrect timestamp '%v' in the line '%v'", sections[2], line)
+		}
+		ts *= mult
+		res.Time = time.Unix(ts/int64(time.Second), ts%int64(time.Second))
+	}
+
+	return res, nil
+}
+
+func parseFieldValue(s string) (float64, bool, error) {
+	if strings.HasPrefix(s, `"`) {
+		return 0, false, nil
+	}
+
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil, err
+}
+
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	res := []string{}
+	inQuotes := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(res, s[start:])
+}
+
+func unescape(s string) string {
+	r := strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+	return r.Replace(s)
+}
+
+// MaxBodySize limits the write request body, the gzipped one is limited
+// both before and after decompression.
+var MaxBodySize int64 = 32 << 20
+
+type BodyTooLargeError struct {
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("Request body is larger than %d bytes", e.Limit)
+}
+
+// readBody reads the request body, the ingestion clients often send it gzipped.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MaxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, bodyError(err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, MaxBodySize+1))
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if int64(len(data)) > MaxBodySize {
+		return nil, &BodyTooLargeError{Limit: MaxBodySize}
+	}
+	return data, nil
+}
+
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &BodyTooLargeError{Limit: MaxBodySize}
+	}
+	return err
+}
+
+func (api *API) WriteHandler(w http.ResponseWriter, r *http.Request) {
+	api.CommonHeader(w, r)
+
+	if api.Writer == nil {
+		InternalServerError(w, "Write API is disabled.")
+		return
+	}
+
+	if r.Body == nil {
+		BadRequest(w, "Empty request.")
+		return
+	}
+
+	data, err := readBody(w, r)
+	if err != nil {
+		statusError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	points, err := ParseLineProtocol(string(data), r.FormValue("precision"), time.Now())
+	if err != nil {
+		BadRequest(w, "%v", err)
+		return
+	}
+
+	allow := api.accessCheck(r)
+	for _, p := range points {
+		// The ACL is checked against the name the writer stores.
+		if m := writer.SafeMetric(p.Metric()); !allow(m) {
+			statusError(w, http.StatusForbidden, &ForbiddenError{Metric: m})
+			return
+		}
+	}
+
+	if errs := api.writePoints(points); len(errs) > 0 {
+		BadRequest(w, "partial write: %d of %d points failed, first error: %v", len(errs), len(points), errs[0])
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePoints merges the fields of points which share metric and timestamp,
+// RRD doesn't allow two updates for the same second.
+func (api *API) writePoints(points []Point) []error {
+	type key struct {
+		metric string
+		time   int64
+	}
+
+	keys := []key{}
+	values := make(map[key][]writer.DataSource)
+
+	for _, p := range points {
+		k := key{p.Metric(), p.Time.Unix()}
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+		}
+
+		names := []string{}
+		for f := range p.Fields {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+
+		for _, f := range names {
+			values[k] = append(values[k], writer.DataSource{Name: f, Type: "GAUGE", Value: p.Fields[f]})
+		}
+	}
+
+	errs := []error{}
+	for _, k := range keys {
+		if err := api.Writer.Write(k.metric, time.Unix(k.time, 0), values[k]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
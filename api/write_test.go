@@ -0,0 +1,206 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineProtocol(test *testing.T) {
+	now := time.Unix(1000000000, 0)
+
+	cases := []struct {
+		data      string
+		precision string
+		want      []Point
+	}{
+		{
+			`cpu,host=server1.net,cpu=cpu0 usage_user=1.5,usage_system=2 1430031094000000000`,
+			"",
+			[]Point{{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "server1.net", "cpu": "cpu0"},
+				Fields:      map[string]float64{"usage_user": 1.5, "usage_system": 2},
+				Time:        time.Unix(1430031094, 0),
+			}},
+		},
+		// *******************************
+		{
+			`mem,host=server1.net used=100i,free=200u,ok=true 1430031094`,
+			"s",
+			[]Point{{
+				Measurement: "mem",
+				Tags:        map[string]string{"host": "server1.net"},
+				Fields:      map[string]float64{"used": 100, "free": 200, "ok": 1},
+				Time:        time.Unix(1430031094, 0),
+			}},
+		},
+		// *******************************
+		{
+			`weather\ station,location=us\,midwest temp=82,note="a, b=c" 1430031094000`,
+			"ms",
+			[]Point{{
+				Measurement: "weather station",
+				Tags:        map[string]string{"location": "us,midwest"},
+				Fields:      map[string]float64{"temp": 82},
+				Time:        time.Unix(1430031094, 0),
+			}},
+		},
+		// *******************************
+		{
+			`
+			# comment
+			load value=0.5
+
+			load value=0.7 1430031094000000
+			`,
+			"u",
+			[]Point{{
+				Measurement: "load",
+				Tags:        map[string]string{},
+				Fields:      map[string]float64{"value": 0.5},
+				Time:        now,
+			}, {
+				Measurement: "load",
+				Tags:        map[string]string{},
+				Fields:      map[string]float64{"value": 0.7},
+				Time:        time.Unix(1430031094, 0),
+			}},
+		},
+		// *******************************
+	}
+
+	for _, c := range cases {
+		res, err := ParseLineProtocol(c.data, c.precision, now)
+		if err != nil {
+			test.Errorf("Data: %s\nError parse: %v\n", c.data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Data: %s\nResult: %+v\nWant:   %+v\n", c.data, res, c.want)
+		}
+	}
+
+	errCases := []struct {
+		data      string
+		precision string
+	}{
+		{`cpu`, ""},
+		{`cpu,host usage=1`, ""},
+		{`cpu usage`, ""},
+		{`cpu usage=abc`, ""},
+		{`cpu usage=1 abc`, ""},
+		{`cpu usage=1 1 2`, ""},
+		{`cpu usage=1`, "xx"},
+	}
+
+	for _, c := range errCases {
+		if res, err := ParseLineProtocol(c.data, c.precision, now); err == nil {
+			test.Errorf("Data: %s\nError expected, got %+v\n", c.data, res)
+		}
+	}
+}
+
+func TestPointMetric(test *testing.T) {
+	cases := []struct {
+		point Point
+		want  string
+	}{
+		{Point{Measurement: "load"}, "load"},
+		{Point{Measurement: "load", Tags: map[string]string{"host": "server1.net"}}, "server1.net/load"},
+		{Point{Measurement: "cpu", Tags: map[string]string{"host": "server1.net", "cpu": "cpu0"}}, "server1.net/cpu-cpu_cpu0"},
+		{Point{Measurement: "disk", Tags: map[string]string{"host": "srv", "path": "/", "fstype": "ext4"}}, "srv/disk-fstype_ext4-path__"},
+		{Point{Measurement: "m", Tags: map[string]string{"a": "x"}}, "m-a_x"},
+		{Point{Measurement: "m", Tags: map[string]string{"b": "x"}}, "m-b_x"},
+	}
+
+	for _, c := range cases {
+		if res := c.point.Metric(); res != c.want {
+			test.Errorf("Point: %+v\nResult: %v\nWant:   %v\n", c.point, res, c.want)
+		}
+	}
+}
+
+func TestWriteBodyLimit(test *testing.T) {
+	limit := MaxBodySize
+	MaxBodySize = 128
+	defer func() { MaxBodySize = limit }()
+
+	cases := []struct {
+		body string
+		gzip bool
+		code int
+	}{
+		{"load,host=server1.net value=1 946774740", false, http.StatusNoContent},
+		{strings.Repeat("load,host=server1.net value=1 946774740\n", 4), false, http.StatusRequestEntityTooLarge},
+		{strings.Repeat("load,host=server1.net value=1 946774740\n", 100), true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		body := []byte(c.body)
+		if c.gzip {
+			buf := &bytes.Buffer{}
+			gz := gzip.NewWriter(buf)
+			gz.Write(body)
+			gz.Close()
+			body = buf.Bytes()
+
+			// The decompressed body is limited too.
+			if int64(len(body)) > MaxBodySize {
+				test.Fatalf("The gzipped body is too large: %d bytes", len(body))
+			}
+		}
+
+		api := NewAPI("")
+		api.Writer = &testSink{}
+
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/write?precision=s", bytes.NewReader(body))
+		if c.gzip {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		api.WriteHandler(w, r)
+
+		if w.Code != c.code {
+			test.Errorf("Body: %d bytes, gzip %v\nResult: %v %s\nWant:   %v\n", len(body), c.gzip, w.Code, w.Body.String(), c.code)
+		}
+	}
+}
+
+func TestWriteACL(test *testing.T) {
+	cases := []struct {
+		body string
+		code int
+	}{
+		{"load,host=teamb value=1 946774740", http.StatusNoContent},
+		{"load,host=teama value=1 946774740", http.StatusForbidden},
+
+		// The writer stores it as team_b/load, not teamb/load.
+		{"load,host=team|b value=1 946774740", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		sink := &testSink{}
+		api := NewAPI("")
+		api.Writer = sink
+		api.Allow = func(r *http.Request) func(string) bool {
+			return func(metric string) bool {
+				return strings.HasPrefix(metric, "teamb/")
+			}
+		}
+
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/write?precision=s", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		api.WriteHandler(w, r)
+
+		if w.Code != c.code || (c.code != http.StatusNoContent && len(*sink) != 0) {
+			test.Errorf("Body: %s\nResult: %v %s, %d writes\nWant:   %v\n", c.body, w.Code, w.Body.String(), len(*sink), c.code)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// series is the data of DEF or CDEF, values[i] covers the interval
+// (start + i*step, start + (i+1)*step].
+type series struct {
+	start  int64
+	step   int64
+	values []float64
+}
+
+func (s *series) end() int64 {
+	return s.start + int64(len(s.values))*s.step
+}
+
+// valueAt returns the value of the row which covers the time t.
+func (s *series) valueAt(t int64) float64 {
+	if t <= s.start {
+		return math.NaN()
+	}
+
+	i := (t-s.start+s.step-1)/s.step - 1
+	if i >= int64(len(s.values)) {
+		return math.NaN()
+	}
+	return s.values[i]
+}
+
+// reduce consolidates the series to the bigger step the same way as
+// reduce_data in rrd_graph.c does.
+func (s *series) reduce(cf Consolidation, step int64) *series {
+	factor := (step + s.step - 1) / s.step
+	res := &series{start: s.start, step: s.step * factor}
+
+	src := s.values
+	end := s.end()
+
+	if offset := res.start % res.step; offset != 0 {
+		res.start -= offset
+		skip := factor - offset/s.step
+		if skip > int64(len(src)) {
+			skip = int64(len(src))
+		}
+		src = src[skip:]
+		res.values = append(res.values, math.NaN())
+	}
+
+	endOffset := end % res.step
+	if endOffset != 0 {
+		drop := endOffset / s.step
+		if drop > int64(len(src)) {
+			drop = int64(len(src))
+		}
+		src = src[:int64(len(src))-drop]
+	}
+
+	for ; int64(len(src)) >= factor; src = src[factor:] {
+		v, valid := math.NaN(), 0
+		for _, x := range src[:factor] {
+			if math.IsNaN(x) {
+				continue
+			}
+			valid++
+
+			switch {
+			case math.IsNaN(v):
+				v = x
+			case cf == CFAVERAGE:
+				v += x
+			case cf == CFMIN:
+				v = math.Min(v, x)
+			case cf == CFMAX:
+				v = math.Max(v, x)
+			case cf == CFLAST:
+				v = x
+			}
+		}
+
+		if cf == CFAVERAGE && valid > 0 {
+			v /= float64(valid)
+		}
+		res.values = append(res.values, v)
+	}
+
+	// Not enough rows for the last interval.
+	if endOffset != 0 {
+		res.values = append(res.values, math.NaN())
+	}
+
+	return res
+}
+
+// DefOptions are the optional parameters of DEF:
+// [:step=<step>][:start=<time>][:end=<time>][:reduce=<CF>]
+type DefOptions struct {
+	Step   time.Duration
+	Start  time.Time
+	End    time.Time
+	Reduce Consolidation
+}
+
+// ParseDefOptions parses the DEF options, start and end are the defaults
+// for the times. The time is the number of seconds since the epoch, "now"
+// or a reference ("s", "start", "e", "end", "n", "now") with the optional
+// offset, like e-3600 or s+2h.
+func ParseDefOptions(options string, cf Consolidation, start, end time.Time, step time.Duration) (DefOptions, error) {
+	res := DefOptions{Step: step, Start: start, End: end, Reduce: cf}
+	startStr, endStr := "", ""
+
+	if options == "" {
+		return res, nil
+	}
+
+	for _, opt := range strings.Split(options, ":") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return DefOptions{}, fmt.Errorf("Incorrect DEF option '%v'", opt)
+		}
+
+		var err error
+		switch kv[0] {
+		case "step":
+			var n uint64
+			if n, err = strconv.ParseUint(kv[1], 10, 64); err == nil && n > 0 {
+				res.Step = time.Duration(n) * time.Second
+			} else {
+				err = errors.New("should be the positive number of seconds")
+			}
+		case "start":
+			startStr = kv[1]
+		case "end":
+			endStr = kv[1]
+		case "reduce":
+			res.Reduce, err = ConsolidationFromString(kv[1])
+		default:
+			err = errors.New("unknown option")
+		}
+
+		if err != nil {
+			return DefOptions{}, fmt.Errorf("Incorrect DEF option '%v': %v", opt, err)
+		}
+	}
+
+	startRef, _ := splitTimeRef(startStr)
+	endRef, _ := splitTimeRef(endStr)
+
+	if startRef == "e" && endRef == "s" {
+		return DefOptions{}, errors.New("The start and the end of DEF can't refer to each other")
+	}
+
+	// The time which refers to the other one is resolved last.
+	var err error
+	if startRef == "e" {
+		if res.End, err = defTime(endStr, res.End, res.Start, res.End); err != nil {
+			return DefOptions{}, err
+		}
+		if res.Start, err = defTime(startStr, res.Start, res.Start, res.End); err != nil {
+			return DefOptions{}, err
+		}
+	} else {
+		if res.Start, err = defTime(startStr, res.Start, res.Start, res.End); err != nil {
+			return DefOptions{}, err
+		}
+		if res.End, err = defTime(endStr, res.End, res.Start, res.End); err != nil {
+			return DefOptions{}, err
+		}
+	}
+
+	if res.End.Before(res.Start) {
+		return DefOptions{}, fmt.Errorf("The DEF end (%v) should be grater then start (%v)", res.End, res.Start)
+	}
+
+	return res, nil
+}
+
+// splitTimeRef splits the DEF time to the reference (s, e or n) and the offset.
+func splitTimeRef(str string) (ref, offset string) {
+	for _, r := range []struct{ name, ref string }{
+		{"start", "s"}, {"end", "e"}, {"now", "n"}, {"s", "s"}, {"e", "e"}, {"n", "n"},
+	} {
+		if strings.HasPrefix(str, r.name) {
+			return r.ref, str[len(r.name):]
+		}
+	}
+	return "", str
+}
+
+// defTime resolves the DEF time, def is the value used for the empty string.
+func defTime(str string, def, start, end time.Time) (time.Time, error) {
+	if str == "" {
+		return def, nil
+	}
+
+	ref, offset := splitTimeRef(str)
+
+	var base time.Time
+	switch ref {
+	case "s":
+		base = start
+	case "e":
+		base = end
+	case "n":
+		base = time.Now()
+	default:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Incorrect DEF time '%v'", str)
+		}
+		return time.Unix(n, 0), nil
+	}
+
+	if offset == "" {
+		return base, nil
+	}
+
+	if offset[0] != '+' && offset[0] != '-' {
+		return time.Time{}, fmt.Errorf("Incorrect DEF time '%v'", str)
+	}
+
+	d, err := defOffset(offset[1:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Incorrect DEF time '%v': %v", str, err)
+	}
+
+	if offset[0] == '-' {
+		d = -d
+	}
+	return base.Add(d), nil
+}
+
+func defOffset(str string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"":  time.Second,
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+
+	i := strings.IndexFunc(str, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(str)
+	}
+
+	unit, ok := units[str[i:]]
+	if !ok || i == 0 {
+		return 0, errors.New("incorrect offset")
+	}
+
+	n, err := strconv.ParseInt(str[:i], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// XportResult is the result of the query in the same form as rrd_xport
+// returns it, the row k is the value at Start + (k+1)*Step.
+type XportResult struct {
+	Start   time.Time
+	End     time.Time
+	Step    time.Duration
+	Legends []string
+	RowCnt  int
+	values  []float64
+
+	// Errors of the failed upstreams, their DEFs are empty.
+	Errors []string
+}
+
+func (r *XportResult) ValueAt(legendIndex, rowIndex int) float64 {
+	return r.values[len(r.Legends)*rowIndex+legendIndex]
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func lcm(a, b int64) int64 {
+	return a / gcd(a, b) * b
+}
+
+// estimatePoints returns the number of the points the DEFs of the request
+// fetch with the requested steps, the incorrect DEFs are reported later.
+func estimatePoints(req QueryRequest) int {
+	start, end, step := time.Time(req.Start), time.Time(req.End), time.Duration(req.Step)
+
+	res := 0
+	for _, q := range req.Queries {
+		def, err := QueryDefFromString(q.Query)
+		if err != nil || def.Type != "DEF" {
+			continue
+		}
+
+		opts, err := ParseDefOptions(def.Options, def.CF, start, end, step)
+		if err != nil || opts.Step <= 0 {
+			continue
+		}
+		res += int(opts.End.Sub(opts.Start) / opts.Step)
+	}
+	return res
+}
+
+// resolveMetric returns the metric of the DEF, the tag selector should match
+// exactly one of the metrics.
+func (api API) resolveMetric(metric string) (string, error) {
+	filter, ok, err := ParseTagSelector(metric)
+	if !ok || err != nil {
+		return metric, err
+	}
+
+	metrics, err := api.Storage.ListMetrics("")
+	if _, partial := err.(*PartialError); err != nil && !partial {
+		return "", err
+	}
+
+	res := []string{}
+	for _, m := range metrics {
+		if filter.Match(m) {
+			res = append(res, m)
+		}
+	}
+
+	switch len(res) {
+	case 0:
+		return "", fmt.Errorf("No metric matches the tags '%v'", metric)
+	case 1:
+		return res[0], nil
+	}
+	return "", fmt.Errorf("The tags '%v' match %v metrics, should match one", metric, len(res))
+}
+
+// fetchDef reads the DEF data and reduces it to the requested step, the
+// metric of the DEF can be the collectd tag selector.
+func (api API) fetchDef(ctx context.Context, def QueryDef, start, end time.Time, step time.Duration) (*series, error) {
+	opts, err := ParseDefOptions(def.Options, def.CF, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+
+	if def.Metric, err = api.resolveMetric(def.Metric); err != nil {
+		return nil, err
+	}
+
+	data, err := api.Storage.Fetch(ctx, def.Metric, def.CF, opts.Start, opts.End, opts.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := -1
+	for i, ds := range data.DsNames {
+		if ds == def.DS {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("No DS called '%v' in '%v'", def.DS, def.Metric)
+	}
+
+	res := &series{
+		start:  data.Start.Unix(),
+		step:   int64(data.Step / time.Second),
+		values: make([]float64, data.RowCnt),
+	}
+	for r := range res.values {
+		res.values[r] = data.ValueAt(idx, r)
+	}
+
+	if res.step <= 0 {
+		return nil, fmt.Errorf("Incorrect step of the data in '%v'", def.Metric)
+	}
+
+	if want := int64(opts.Step / time.Second); res.step < want {
+		res = res.reduce(opts.Reduce, want)
+	}
+
+	return res, nil
+}
+
+// emptySeries is the series of NaN values covering the interval, it replaces
+// the DEF of the failed upstream.
+func emptySeries(start, end time.Time, step time.Duration) *series {
+	st := int64(step / time.Second)
+	if st < 1 {
+		st = 1
+	}
+
+	s, e := start.Unix(), end.Unix()
+	s -= s % st
+
+	res := &series{start: s, step: st}
+	for t := s + st; t < e+st; t += st {
+		res.values = append(res.values, math.NaN())
+	}
+	return res
+}
+
+// calcCDef calculates the RPN expression on the common step of the used
+// variables for the interval all of them cover.
+func calcCDef(expr string, vars map[string]*series) (*series, error) {
+	rpn, err := ParseRPN(expr, func(s string) bool { _, ok := vars[s]; return ok })
+	if err != nil {
+		return nil, err
+	}
+
+	used := rpn.Vars()
+	if len(used) == 0 {
+		return nil, fmt.Errorf("The expression '%v' should use at least one DEF or CDEF", expr)
+	}
+
+	res := &series{start: math.MinInt64, step: 1}
+	end := int64(math.MaxInt64)
+	for _, v := range used {
+		s := vars[v]
+		res.step = lcm(res.step, s.step)
+		if s.start > res.start {
+			res.start = s.start
+		}
+		if s.end() < end {
+			end = s.end()
+		}
+	}
+
+	ctx := &rpnContext{
+		step: res.step,
+		prev: math.NaN(),
+		vars: func(vname string, t int64) float64 { return vars[vname].valueAt(t) },
+	}
+
+	for t := res.start + res.step; t <= end; t += res.step {
+		ctx.time = t
+		ctx.count++
+
+		v, err := rpn.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.values = append(res.values, v)
+		ctx.prev = v
+	}
+
+	return res, nil
+}
+
+// canceled returns CanceledError if the context of the query is done.
+func (api API) canceled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Timeout: api.QueryTimeout, Err: err}
+	}
+	return nil
+}
+
+// xport evaluates the queries like rrd_xport, the exported series are put on
+// the grid with the least common multiple of their steps. The queries are
+// aborted when the context is done. The points limit is checked by the
+// requested steps before the fetches and by the fetched points after them.
+func (api API) xport(ctx context.Context, req QueryRequest) (*XportResult, error) {
+	if api.MaxPoints > 0 && estimatePoints(req) > api.MaxPoints {
+		return nil, &PointsLimitError{Limit: api.MaxPoints}
+	}
+
+	if err := api.Xports.Acquire(ctx); err != nil {
+		if cerr := api.canceled(ctx); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+	defer api.Xports.Release()
+
+	start, end, step := time.Time(req.Start), time.Time(req.End), time.Duration(req.Step)
+
+	vars := make(map[string]*series)
+	exported := []string{}
+	upstreamErrors := []string{}
+	files, points := 0, 0
+	defer func() { addAccessStats(ctx, files, points) }()
+
+	for _, q := range req.Queries {
+		if err := api.canceled(ctx); err != nil {
+			return nil, err
+		}
+
+		def, err := QueryDefFromString(q.Query)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := vars[def.Name]; ok {
+			return nil, fmt.Errorf("Duplicate name '%v' in the query '%v'", def.Name, q.Query)
+		}
+
+		var s *series
+		switch def.Type {
+		case "DEF":
+			s, err = api.fetchDef(ctx, def, start, end, step)
+			files++
+			if cerr := api.canceled(ctx); err != nil && cerr != nil {
+				return nil, cerr
+			}
+			if uerr, ok := err.(*UpstreamError); ok {
+				log.Warning("%v", uerr)
+				upstreamErrors = append(upstreamErrors, uerr.Error())
+				s, err = emptySeries(start, end, step), nil
+			}
+		case "CDEF":
+			s, err = calcCDef(def.Metric, vars)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		points += len(s.values)
+		if api.MaxPoints > 0 && points > api.MaxPoints {
+			return nil, &PointsLimitError{Limit: api.MaxPoints}
+		}
+
+		vars[def.Name] = s
+		if !q.Hidden {
+			exported = append(exported, def.Name)
+		}
+	}
+
+	if len(exported) == 0 {
+		return nil, errors.New("Nothing to export, all queries are hidden")
+	}
+
+	if err := api.canceled(ctx); err != nil {
+		return nil, err
+	}
+
+	st := int64(1)
+	for _, name := range exported {
+		st = lcm(st, vars[name].step)
+	}
+
+	s, e := start.Unix(), end.Unix()
+	s -= s % st
+	e = e - e%st + st
+
+	res := &XportResult{
+		Start:   time.Unix(s, 0),
+		End:     time.Unix(e, 0),
+		Step:    time.Duration(st) * time.Second,
+		Legends: exported,
+		RowCnt:  int((e - s) / st),
+	}
+	if len(upstreamErrors) > 0 {
+		res.Errors = upstreamErrors
+	}
+
+	res.values = make([]float64, 0, res.RowCnt*len(exported))
+	for r := 0; r < res.RowCnt; r++ {
+		t := s + int64(r+1)*st
+		for _, name := range exported {
+			res.values = append(res.values, vars[name].valueAt(t))
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRPN(test *testing.T) {
+	nan := math.NaN()
+	vars := map[string]float64{"A": 10, "B": 4, "U": nan}
+	_, offset := time.Unix(1000000000, 0).Zone()
+
+	cases := []struct {
+		expr string
+		want float64
+	}{
+		{"A,B,+", 14},
+		{"A,B,-", 6},
+		{"A,B,*", 40},
+		{"A,B,/", 2.5},
+		{"A,B,%", 2},
+		{"A,U,+", nan},
+		{"A,U,ADDNAN", 10},
+		{"U,U,ADDNAN", nan},
+		{"A,B,LT", 0},
+		{"A,B,GT", 1},
+		{"A,U,GT", nan},
+		{"U,UN", 1},
+		{"INF,ISINF", 1},
+		{"A,B,GT,1,2,IF", 1},
+		{"U,1,2,IF", 1},
+		{"0,1,2,IF", 2},
+		{"A,B,MIN", 4},
+		{"A,B,MAX", 10},
+		{"A,0,5,LIMIT", nan},
+		{"B,0,5,LIMIT", 4},
+		{"A,DUP,*", 100},
+		{"A,B,POP", 10},
+		{"A,B,EXC,-", -6},
+		{"-2.5,ABS", 2.5},
+		{"2.5,FLOOR", 2},
+		{"2.5,CEIL", 3},
+		{"16,SQRT", 4},
+		{"A,B,U,3,AVG", 7},
+		{"STEPWIDTH", 60},
+		{"TIME", 1000000000},
+		{"COUNT", 3},
+		{"PREV", 42},
+		{"180,DEG2RAD", math.Pi},
+		{"2,10,POW", 1024},
+		{"A,B,DEPTH,+,+", 16},
+		{"A,B,2,COPY,+,+,+", 28},
+		{"A,B,2,INDEX,-,+", 4},
+		{"1,2,3,3,1,ROLL,POP,-", 2},
+		{"1,2,3,3,-1,ROLL,POP,-", -1},
+		{"3,1,2,3,SORT,POP,-", -1},
+		{"3,1,2,3,REV,POP,-", 1},
+		{"A,B,U,1,4,MEDIAN", 4},
+		{"A,B,U,3,MEDIAN", 7},
+		{"A,B,2,STDEV", 3},
+		{"1,2,3,4,4,50,PERCENT", 2},
+		{"1,2,3,4,100,5,MAD", 1},
+		{"A,B,U,3,SMIN", 4},
+		{"A,B,U,3,SMAX", 10},
+		{"A,120,TREND", 10},
+		{"A,600,TREND", nan},
+		{"U,60,TRENDNAN", nan},
+		{"86400,1,120,A,PREDICT", 10},
+		{"86400,-2,120,A,PREDICTSIGMA", 0},
+		{"3600,1,60,50,B,PREDICTPERC", 4},
+		{"LTIME,TIME,-", float64(offset)},
+		{"NEWDAY", 0},
+	}
+
+	isVar := func(s string) bool { _, ok := vars[s]; return ok }
+	ctx := &rpnContext{
+		time:  1000000000,
+		step:  60,
+		count: 3,
+		prev:  42,
+		vars:  func(vname string, t int64) float64 { return vars[vname] },
+	}
+
+	for _, c := range cases {
+		rpn, err := ParseRPN(c.expr, isVar)
+		if err != nil {
+			test.Errorf("Expression: %s\nError parse: %v\n", c.expr, err)
+			continue
+		}
+
+		res, err := rpn.eval(ctx)
+		if err != nil {
+			test.Errorf("Expression: %s\nError: %v\n", c.expr, err)
+			continue
+		}
+
+		if fmt.Sprint(res) != fmt.Sprint(c.want) {
+			test.Errorf("Expression: %s\nResult: %v\nWant:   %v\n", c.expr, res, c.want)
+		}
+	}
+
+	for _, expr := range []string{"A,+", "A,B", "A,C,+", "A,,+", "1,60,TREND", "A,5,SORT", "1,PREDICT", "A,0,INDEX"} {
+		rpn, err := ParseRPN(expr, isVar)
+		if err == nil {
+			_, err = rpn.eval(ctx)
+		}
+
+		if err == nil {
+			test.Errorf("Expression: %s\nError expected\n", expr)
+		}
+	}
+}
+
+func TestSeriesReduce(test *testing.T) {
+	nan := math.NaN()
+	// The rows end at 3600 ... 3960.
+	s := &series{start: 3540, step: 60, values: []float64{100, 110, 120, 130, 140, 150, nan}}
+
+	cases := []struct {
+		cf        Consolidation
+		step      int64
+		wantStart int64
+		want      []float64
+	}{
+		{CFAVERAGE, 120, 3480, []float64{nan, 115, 135, 150}},
+		{CFMAX, 120, 3480, []float64{nan, 120, 140, 150}},
+		{CFMIN, 180, 3420, []float64{nan, 110, 140}},
+		{CFLAST, 300, 3300, []float64{nan, 150, nan}},
+	}
+
+	for _, c := range cases {
+		res := s.reduce(c.cf, c.step)
+		if res.start != c.wantStart || res.step != c.step || fmt.Sprint(res.values) != fmt.Sprint(c.want) {
+			test.Errorf("Reduce %v to %v:\nResult: %v %v %v\nWant:   %v %v %v\n", c.cf.String(), c.step,
+				res.start, res.step, res.values, c.wantStart, c.step, c.want)
+		}
+	}
+}
+
+func TestParseDefOptions(test *testing.T) {
+	start, end := time.Unix(1000000000, 0), time.Unix(1000003600, 0)
+
+	cases := []struct {
+		options   string
+		wantStart int64
+		wantEnd   int64
+		wantStep  time.Duration
+		wantCF    Consolidation
+	}{
+		{"", 1000000000, 1000003600, time.Second, CFAVERAGE},
+		{"step=300:reduce=MAX", 1000000000, 1000003600, 5 * time.Minute, CFMAX},
+		{"start=e-600", 1000003000, 1000003600, time.Second, CFAVERAGE},
+		{"start=end-1h:end=999999999", 999996399, 999999999, time.Second, CFAVERAGE},
+		{"end=s+10m", 1000000000, 1000000600, time.Second, CFAVERAGE},
+		{"start=1000000100:end=start+1d", 1000000100, 1000086500, time.Second, CFAVERAGE},
+	}
+
+	for _, c := range cases {
+		res, err := ParseDefOptions(c.options, CFAVERAGE, start, end, time.Second)
+		if err != nil {
+			test.Errorf("Options: %s\nError parse: %v\n", c.options, err)
+			continue
+		}
+
+		if res.Start.Unix() != c.wantStart || res.End.Unix() != c.wantEnd || res.Step != c.wantStep || res.Reduce != c.wantCF {
+			test.Errorf("Options: %s\nResult: %v %v %v %v\nWant:   %v %v %v %v\n", c.options,
+				res.Start.Unix(), res.End.Unix(), res.Step, res.Reduce.String(),
+				c.wantStart, c.wantEnd, c.wantStep, c.wantCF.String())
+		}
+	}
+
+	for _, opt := range []string{"step=0", "step", "foo=1", "start=e-1x", "start=e-1:end=s+1", "reduce=FOO", "end=s-1"} {
+		if _, err := ParseDefOptions(opt, CFAVERAGE, start, end, time.Second); err == nil {
+			test.Errorf("Options: %s\nError expected\n", opt)
+		}
+	}
+}
+
+const testFirstRow = 946774740 // 2000.01.02 00:59:00 UTC
+
+func TestXport(test *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Add("if_packets", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"rx", "tx"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{100, 300}, {100, 320}, {110, 320}, {120, 340}, {130, 360}, {140, 380}, {150, 400}},
+	})
+
+	storage.Add("web1.net/interface-eth0/if_packets", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"rx", "tx"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{1, 2}, {3, 4}},
+	})
+	storage.Add("web2.net/interface-eth0/if_packets", MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"rx", "tx"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{5, 6}, {7, 8}, {9, 10}},
+	})
+
+	api := NewAPI("")
+	api.Storage = storage
+
+	const (
+		start = testFirstRow + 59 // 00:59:59
+		end   = testFirstRow + 360
+	)
+
+	nan := math.NaN()
+	cases := []struct {
+		step      time.Duration
+		queries   []QueryRequestQuery
+		wantStart int64
+		want      [][]float64
+	}{
+		{
+			time.Second,
+			[]QueryRequestQuery{{Query: "DEF:A=if_packets:rx:AVERAGE"}},
+			testFirstRow,
+			[][]float64{{100}, {110}, {120}, {130}, {140}, {150}, {nan}},
+		},
+		{
+			2 * time.Minute,
+			[]QueryRequestQuery{{Query: "DEF:A=if_packets:rx:AVERAGE"}},
+			testFirstRow - 60,
+			[][]float64{{nan}, {115}, {135}, {150}},
+		},
+		{
+			time.Second,
+			[]QueryRequestQuery{
+				{Query: "DEF:RX=if_packets:rx:AVERAGE", Hidden: true},
+				{Query: "DEF:TX=if_packets:tx:AVERAGE:start=e-120"},
+				{Query: "CDEF:RTX=RX,TX,+"},
+			},
+			testFirstRow,
+			[][]float64{{nan, nan}, {nan, nan}, {nan, nan}, {nan, nan}, {380, 520}, {400, 550}, {nan, nan}},
+		},
+		{
+			time.Second,
+			[]QueryRequestQuery{{Query: "DEF:A={host=web2*,plugin=interface}:tx:AVERAGE"}},
+			testFirstRow,
+			[][]float64{{8}, {10}, {nan}, {nan}, {nan}, {nan}, {nan}},
+		},
+	}
+
+	for _, c := range cases {
+		req := QueryRequest{
+			Start:   Time(time.Unix(start, 0)),
+			End:     Time(time.Unix(end, 0)),
+			Step:    Duration(c.step),
+			Queries: c.queries,
+		}
+
+		res, err := api.xport(context.Background(), req)
+		if err != nil {
+			test.Errorf("Queries: %+v\nError: %v\n", c.queries, err)
+			continue
+		}
+
+		got := [][]float64{}
+		for r := 0; r < res.RowCnt; r++ {
+			row := []float64{}
+			for i := range res.Legends {
+				row = append(row, res.ValueAt(i, r))
+			}
+			got = append(got, row)
+		}
+
+		if res.Start.Unix() != c.wantStart || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			test.Errorf("Queries: %+v\nResult: %v %v\nWant:   %v %v\n", c.queries, res.Start.Unix(), got, c.wantStart, c.want)
+		}
+	}
+
+	for _, q := range []string{"DEF:A=missing:rx:AVERAGE", "DEF:A=if_packets:foo:AVERAGE", "CDEF:A=1,2,+",
+		"DEF:A={host=web*}:rx:AVERAGE", "DEF:A={host=db*}:rx:AVERAGE", "DEF:A={}:rx:AVERAGE", "DEF:A={color=red}:rx:AVERAGE"} {
+		req := QueryRequest{
+			Start:   Time(time.Unix(start, 0)),
+			End:     Time(time.Unix(end, 0)),
+			Step:    Duration(time.Second),
+			Queries: []QueryRequestQuery{{Query: q}},
+		}
+
+		if _, err := api.xport(context.Background(), req); err == nil {
+			test.Errorf("Query: %s\nError expected\n", q)
+		}
+	}
+}
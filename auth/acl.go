@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"path"
+	"strings"
+)
+
+// Rule allows the Users and the members of the Groups to access the metrics
+// matching the Allow globs.
+type Rule struct {
+	Users  []string
+	Groups []string
+	Allow  []string
+}
+
+func (rule Rule) applies(user User) bool {
+	for _, u := range rule.Users {
+		if u == user.Name {
+			return true
+		}
+	}
+
+	for _, g := range rule.Groups {
+		for _, ug := range user.Groups {
+			if g == ug {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACL limits the metrics of the users by the rules, the user without the
+// rules can't access any metric. The Admins authenticated by the password
+// aren't limited.
+type ACL struct {
+	Rules  []Rule
+	Admins map[string]bool
+}
+
+// Allow returns the access check of the user's metrics, nil means the user
+// can access all of them.
+func (acl *ACL) Allow(user User) func(metric string) bool {
+	if user.Method == MethodPassword && acl.Admins[user.Name] {
+		return nil
+	}
+
+	patterns := []string{}
+	for _, rule := range acl.Rules {
+		if rule.applies(user) {
+			patterns = append(patterns, rule.Allow...)
+		}
+	}
+
+	return func(metric string) bool {
+		for _, p := range patterns {
+			if MatchPath(p, metric) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchPath matches the metric path against the glob, the segments are
+// matched by path.Match and "**" matches any number of the segments:
+// "web*/**" matches all metrics of the web hosts.
+func MatchPath(pattern, metric string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(strings.Trim(metric, "/"), "/"))
+}
+
+func matchSegments(pattern, metric []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(metric); i++ {
+				if matchSegments(pattern[1:], metric[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(metric) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(pattern[0], metric[0]); err != nil || !ok {
+			return false
+		}
+		pattern, metric = pattern[1:], metric[1:]
+	}
+
+	return len(metric) == 0
+}
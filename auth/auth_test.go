@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bcryptHash(test *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		test.Fatalf("Can't hash password: %v", err)
+	}
+	return string(hash)
+}
+
+func argon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeUsers(test *testing.T, file, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		test.Fatalf("Can't write users file: %v", err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		test.Fatalf("Can't change users file time: %v", err)
+	}
+}
+
+func TestUsers(test *testing.T) {
+	f, err := ioutil.TempFile("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	writeUsers(test, f.Name(), "# users\n"+
+		"alice:"+bcryptHash(test, "alicepass")+"\n"+
+		"bob:"+argon2Hash("bobpass")+"\n"+
+		"carol:plainpass\n", time.Unix(1000, 0))
+
+	users := NewUsers(f.Name())
+	users.AddStatic("admin", "superpass")
+
+	cases := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "alicepass", true},
+		{"alice", "bobpass", false},
+		{"bob", "bobpass", true},
+		{"bob", "bobpas", false},
+		{"carol", "plainpass", false},
+		{"admin", "superpass", true},
+		{"admin", "", false},
+		{"dave", "alicepass", false},
+	}
+
+	for _, c := range cases {
+		if res := users.Check(c.user, c.password); res != c.want {
+			test.Errorf("User: %v\nPassword: %v\nResult: %v\nWant:   %v\n", c.user, c.password, res, c.want)
+		}
+	}
+
+	// The changed file is reread.
+	writeUsers(test, f.Name(), "dave:"+bcryptHash(test, "davepass")+"\n", time.Unix(2000, 0))
+
+	if !users.Check("dave", "davepass") || users.Check("alice", "alicepass") {
+		test.Errorf("The users file isn't reread")
+	}
+
+	// The broken file doesn't drop the users.
+	writeUsers(test, f.Name(), "dave\n", time.Unix(3000, 0))
+
+	if err := users.Load(); err == nil {
+		test.Errorf("Error expected for the incorrect users file")
+	}
+	if !users.Check("dave", "davepass") {
+		test.Errorf("The users are lost after the incorrect users file")
+	}
+}
+
+func TestCompareHash(test *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("pass"), []byte("0123456789abcdef"), 1, 1024, 1, 32))
+
+	cases := []struct {
+		params string
+		want   bool
+	}{
+		{"m=1024,t=1,p=1", true},
+		{"m=1024,t=0,p=1", false},
+		{"m=1024,t=1,p=0", false},
+		{"m=2097152,t=1,p=1", false},
+		{"m=1024,t=1", false},
+	}
+
+	for _, c := range cases {
+		hash := fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, c.params, salt, key)
+		if res := compareHash(hash, "pass"); res != c.want {
+			test.Errorf("Hash: %v\nResult: %v\nWant:   %v\n", hash, res, c.want)
+		}
+	}
+}
+
+func TestHandler(test *testing.T) {
+	users := NewUsers("")
+	users.AddStatic("admin", "superpass")
+
+	handler := NewHandler(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := FromRequest(r)
+		w.Write([]byte(user.Name))
+	}))
+
+	cases := []struct {
+		method   string
+		user     string
+		password string
+		code     int
+		body     string
+	}{
+		{"GET", "admin", "superpass", http.StatusOK, "admin"},
+		{"GET", "admin", "wrongpass", http.StatusUnauthorized, "401 Unauthorized\n"},
+		{"GET", "", "", http.StatusUnauthorized, "401 Unauthorized\n"},
+		{"OPTIONS", "", "", http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://127.0.0.1/", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != c.code || w.Body.String() != c.body {
+			test.Errorf("Method: %v\nUser: %v\nResult: %v '%v'\nWant:   %v '%v'\n", c.method, c.user, w.Code, w.Body.String(), c.code, c.body)
+		}
+
+		if c.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			test.Errorf("Method: %v\nUser: %v\nWWW-Authenticate header expected", c.method, c.user)
+		}
+	}
+}
+
+func TestTokens(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens, err := LoadTokens(dir + "/tokens.json")
+	if err != nil {
+		test.Fatalf("Can't load tokens: %v", err)
+	}
+	tokens.Admins["admin"] = true
+
+	users := NewUsers("")
+	users.AddStatic("admin", "superpass")
+	users.AddStatic("alice", "alicepass")
+
+	router := mux.NewRouter()
+	tokens.Serve(router)
+	router.Methods("GET", "POST").PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := FromRequest(r)
+		w.Write([]byte(user.Name))
+	})
+
+	handler := NewHandler(users, router)
+	handler.Tokens = tokens
+	handler.ClientCerts = true
+	handler.WriteRequest = func(r *http.Request) bool { return r.URL.Path == "/write" }
+
+	request := func(method, path, body string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://127.0.0.1"+path, strings.NewReader(body))
+		auth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(secret string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+secret) }
+	}
+	cert := func(cn string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		}
+	}
+
+	create := func(body string) CreateTokenResponse {
+		res := CreateTokenResponse{}
+		w := request("POST", "/auth/tokens", body, basic("admin", "superpass"))
+		if w.Code != http.StatusCreated {
+			test.Fatalf("Can't create token %v: %v %v", body, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			test.Fatalf("Incorrect response '%v': %v", w.Body.String(), err)
+		}
+		return res
+	}
+
+	grafana := create(`{"name": "grafana", "user": "alice"}`)
+	collector := create(`{"name": "collector", "scope": "write"}`)
+	expires := time.Now().Add(500 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	short := create(`{"name": "short", "expires": "` + expires + `"}`)
+
+	if grafana.Scope != ScopeRead || grafana.User != "alice" || collector.User != "admin" || grafana.Hash != "" {
+		test.Errorf("Incorrect tokens: %+v %+v", grafana, collector)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		auth   func(r *http.Request)
+		code   int
+		body   string
+	}{
+		{"GET", "/query", bearer(grafana.Secret), http.StatusOK, "alice"},
+		{"POST", "/write", bearer(grafana.Secret), http.StatusForbidden, ""},
+		{"POST", "/write", bearer(collector.Secret), http.StatusOK, "admin"},
+		{"GET", "/query", bearer(short.Secret), http.StatusOK, "admin"},
+		{"GET", "/query", bearer("rrd_0123"), http.StatusUnauthorized, ""},
+		{"GET", "/auth/tokens", bearer(collector.Secret), http.StatusForbidden, ""},
+		{"GET", "/auth/tokens", basic("alice", "alicepass"), http.StatusForbidden, ""},
+		{"GET", "/query", cert("admin"), http.StatusOK, "admin"},
+		{"GET", "/auth/tokens", cert("admin"), http.StatusForbidden, ""},
+		{"POST", "/auth/tokens", basic("admin", "superpass"), http.StatusBadRequest, ""},
+		{"DELETE", "/auth/tokens/notexists", basic("admin", "superpass"), http.StatusNotFound, ""},
+	}
+
+	for _, c := range cases {
+		w := request(c.method, c.path, "", c.auth)
+		if w.Code != c.code || (c.body != "" && w.Body.String() != c.body) {
+			test.Errorf("%v %v\nResult: %v '%v'\nWant:   %v '%v'\n", c.method, c.path, w.Code, w.Body.String(), c.code, c.body)
+		}
+	}
+
+	// The tokens are persisted without the secrets.
+	loaded, err := LoadTokens(dir + "/tokens.json")
+	if err != nil || len(loaded.List()) != 3 {
+		test.Fatalf("Incorrect persisted tokens: %v %v", loaded, err)
+	}
+	if _, ok := loaded.Check(grafana.Secret); !ok {
+		test.Errorf("The persisted token isn't valid")
+	}
+
+	w := request("DELETE", "/auth/tokens/"+grafana.ID, "", basic("admin", "superpass"))
+	if w.Code != http.StatusNoContent {
+		test.Errorf("Can't revoke token: %v %v", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/query", "", bearer(grafana.Secret)); w.Code != http.StatusUnauthorized {
+		test.Errorf("The revoked token is accepted: %v", w.Code)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if w := request("GET", "/query", "", bearer(short.Secret)); w.Code != http.StatusUnauthorized {
+		test.Errorf("The expired token is accepted: %v", w.Code)
+	}
+
+	list := []Token{}
+	w = request("GET", "/auth/tokens", "", basic("admin", "superpass"))
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 2 || strings.Contains(w.Body.String(), "hash") {
+		test.Errorf("Incorrect token list: %v", w.Body.String())
+	}
+}
+
+func TestACL(test *testing.T) {
+	acl := &ACL{
+		Rules: []Rule{
+			{Groups: []string{"web"}, Allow: []string{"web*/**"}},
+			{Users: []string{"carol"}, Allow: []string{"lb-?/load/*", "db1/**/if_octets"}},
+		},
+		Admins: map[string]bool{"admin": true},
+	}
+
+	alice := User{Name: "alice", Groups: []string{"web"}}
+	carol := User{Name: "carol"}
+
+	cases := []struct {
+		user   User
+		metric string
+		want   bool
+	}{
+		{alice, "web1/load/load", true},
+		{alice, "web1", true},
+		{alice, "db1/load/load", false},
+		{carol, "web1/load/load", false},
+		{carol, "lb-1/load/load", true},
+		{carol, "lb-10/load/load", false},
+		{carol, "lb-1/load", false},
+		{carol, "db1/if_octets", true},
+		{carol, "db1/interface-eth0/if_octets", true},
+		{carol, "db1/interface-eth0/if_packets", false},
+		{User{Name: "dave"}, "web1/load/load", false},
+		{User{Name: "alice", Token: "1234"}, "web1/load/load", false},
+
+		// Only the password users are the admins.
+		{User{Name: "admin", Method: MethodJWT}, "web1/load/load", false},
+		{User{Name: "admin", Method: MethodCert}, "web1/load/load", false},
+		{User{Name: "admin", Method: MethodToken, Token: "1234"}, "web1/load/load", false},
+	}
+
+	for _, c := range cases {
+		allow := acl.Allow(c.user)
+		if allow == nil {
+			test.Errorf("User: %v\nThe access check expected", c.user)
+			continue
+		}
+
+		if res := allow(c.metric); res != c.want {
+			test.Errorf("User: %v\nMetric: %v\nResult: %v\nWant:   %v\n", c.user, c.metric, res, c.want)
+		}
+	}
+
+	if acl.Allow(User{Name: "admin", Method: MethodPassword}) != nil {
+		test.Errorf("The admin is limited by the ACL")
+	}
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The authentication methods of User.
+const (
+	MethodPassword = "password"
+	MethodToken    = "token"
+	MethodJWT      = "jwt"
+	MethodCert     = "cert"
+)
+
+// User is the authenticated user of the request. The token users have the
+// token ID and scope, the password users aren't limited by the scope.
+// The names of the JWT and client certificate users are given by their
+// issuers, so only the password users can be the admins.
+type User struct {
+	Name   string
+	Groups []string
+	Token  string
+	Scope  string
+	Method string
+}
+
+// CanWrite returns false for the read only tokens.
+func (u User) CanWrite() bool {
+	return u.Scope != ScopeRead
+}
+
+type contextKey int
+
+const userKey contextKey = 0
+
+func NewContext(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+func FromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey).(User)
+	return user, ok
+}
+
+// FromRequest returns the user of the request authenticated by Handler.
+func FromRequest(r *http.Request) (User, bool) {
+	return FromContext(r.Context())
+}
+
+// Handler authenticates the requests with the Basic auth, the bearer API
+// token, JWT or the verified client certificate (its CN is the user) and
+// passes them to the next handler with the user in the context.
+// The CORS preflight requests don't have the credentials, so they are passed
+// as is. WriteRequest tells the requests the read only tokens can't make,
+// Groups are the groups of the users.
+type Handler struct {
+	Users        *Users
+	Tokens       *Tokens
+	JWT          *JWTValidator
+	ClientCerts  bool
+	WriteRequest func(r *http.Request) bool
+	Groups       map[string][]string
+	Realm        string
+
+	handler http.Handler
+}
+
+func NewHandler(users *Users, handler http.Handler) *Handler {
+	return &Handler{Users: users, Realm: "RRD server", handler: handler}
+}
+
+func (a *Handler) authenticate(r *http.Request) (User, bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		bearer := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+
+		if a.JWT != nil && IsJWT(bearer) {
+			user, err := a.JWT.Validate(bearer, time.Now())
+			if err != nil {
+				log.Warning("%v from %v", err, r.RemoteAddr)
+				return User{}, false
+			}
+			user.Method = MethodJWT
+			return user, true
+		}
+
+		if a.Tokens == nil {
+			return User{}, false
+		}
+
+		token, ok := a.Tokens.Check(bearer)
+		if !ok {
+			log.Warning("Incorrect or expired token from %v", r.RemoteAddr)
+			return User{}, false
+		}
+		return User{Name: token.User, Token: token.ID, Scope: token.Scope, Method: MethodToken}, true
+	}
+
+	// The credentials of the header go before the client certificate.
+	if r.Header.Get("Authorization") == "" && a.ClientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return User{Name: cn, Method: MethodCert}, true
+		}
+	}
+
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		if h := r.Header.Get("Authorization"); h != "" {
+			log.Warning("Incorrect authorization header from %v", r.RemoteAddr)
+		}
+		return User{}, false
+	}
+
+	if a.Users == nil || !a.Users.Check(name, password) {
+		log.Warning("Authentication of user '%v' from %v failed", name, r.RemoteAddr)
+		return User{}, false
+	}
+
+	return User{Name: name, Method: MethodPassword}, true
+}
+
+func (a *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if user, ok := a.authenticate(r); ok {
+		user.Groups = append(user.Groups, a.Groups[user.Name]...)
+
+		if !user.CanWrite() && a.WriteRequest != nil && a.WriteRequest(r) {
+			httpError(w, http.StatusForbidden, "Token '%v' has the read only scope", user.Token)
+			return
+		}
+
+		a.handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), user)))
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+a.Realm+`"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("401 Unauthorized\n"))
+}
+
+// httpError writes the error in the format of the API errors.
+func httpError(w http.ResponseWriter, httpStatus int, format string, args ...interface{}) {
+	log.Warning(format, args...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+
+	json.NewEncoder(w).Encode(struct {
+		Code    int    `json:"errorCode"`
+		Message string `json:"errorMessage"`
+	}{httpStatus, fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKS is the key set of the OIDC provider, it's read from the local file
+// (reread on change) or the URL (refetched every Refresh and on the unknown
+// key ID, but not more often than once a minute).
+type JWKS struct {
+	Source  string
+	Refresh time.Duration
+	Client  *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	modTime time.Time
+	fetched time.Time
+}
+
+func NewJWKS(source string) *JWKS {
+	return &JWKS{
+		Source:  source,
+		Refresh: time.Hour,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]crypto.PublicKey),
+	}
+}
+
+func (j *JWKS) isURL() bool {
+	return strings.HasPrefix(j.Source, "http://") || strings.HasPrefix(j.Source, "https://")
+}
+
+// Load reads the key set if it's changed.
+func (j *JWKS) Load() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.load(true)
+}
+
+// Key returns the key of the key ID, the empty ID matches the single key.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	key, ok := j.lookup(kid)
+	if err := j.load(!ok); err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	if key, ok = j.lookup(kid); !ok {
+		return nil, fmt.Errorf("Unknown key '%v'", kid)
+	}
+	return key, nil
+}
+
+func (j *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// load rereads the changed file or refetches the URL, missing is set if the
+// key isn't found. The mutex should be locked.
+func (j *JWKS) load(missing bool) error {
+	var data []byte
+
+	if j.isURL() {
+		age := time.Since(j.fetched)
+		if age < j.Refresh && (!missing || age < time.Minute) {
+			return nil
+		}
+		j.fetched = time.Now()
+
+		resp, err := j.Client.Get(j.Source)
+		if err != nil {
+			return fmt.Errorf("Can't fetch JWKS: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Can't fetch JWKS: %v", resp.Status)
+		}
+
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("Can't fetch JWKS: %v", err)
+		}
+	} else {
+		st, err := os.Stat(j.Source)
+		if err != nil {
+			return err
+		}
+		if st.ModTime().Equal(j.modTime) {
+			return nil
+		}
+
+		if data, err = ioutil.ReadFile(j.Source); err != nil {
+			return err
+		}
+		j.modTime = st.ModTime()
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("Incorrect JWKS '%v': %v", j.Source, err)
+	}
+	j.keys = keys
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key '%v': %v", k.Kid, err)
+		}
+		res[k.Kid] = key
+	}
+	return res, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("incorrect number '%v'", s)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%v'", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported key '%v' '%v'", k.Crv, k.X)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%v'", k.Kty)
+}
+
+// JWTValidator checks the signature and the claims of the JWT bearer tokens
+// and maps them to the users: the UserClaim is the user name, the
+// GroupsClaim (the string or the list) is the groups. The tokens without
+// the expiration time are rejected.
+type JWTValidator struct {
+	Keys        *JWKS
+	Issuer      string
+	Audience    []string
+	UserClaim   string
+	GroupsClaim string
+	Leeway      time.Duration
+}
+
+func NewJWTValidator(keys *JWKS) *JWTValidator {
+	return &JWTValidator{
+		Keys:        keys,
+		UserClaim:   "sub",
+		GroupsClaim: "groups",
+		Leeway:      30 * time.Second,
+	}
+}
+
+// IsJWT returns true if the bearer token looks like the JWT.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Validate returns the user of the valid token.
+func (v *JWTValidator) Validate(token string, now time.Time) (User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return User{}, errors.New("Incorrect JWT")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return User{}, fmt.Errorf("Incorrect JWT header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return User{}, fmt.Errorf("Incorrect JWT signature: %v", err)
+	}
+
+	key, err := v.Keys.Key(header.Kid)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return User{}, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return User{}, fmt.Errorf("Incorrect JWT claims: %v", err)
+	}
+
+	if err := v.checkClaims(claims, now); err != nil {
+		return User{}, err
+	}
+
+	name, _ := claims[v.UserClaim].(string)
+	if name == "" {
+		return User{}, fmt.Errorf("JWT claim '%v' isn't set", v.UserClaim)
+	}
+
+	user := User{Name: name}
+	switch g := claims[v.GroupsClaim].(type) {
+	case string:
+		user.Groups = []string{g}
+	case []interface{}:
+		for _, item := range g {
+			if s, ok := item.(string); ok {
+				user.Groups = append(user.Groups, s)
+			}
+		}
+	}
+	return user, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT expiration time isn't set")
+	}
+	if now.Add(-v.Leeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("JWT is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("JWT isn't valid yet")
+	}
+
+	if iss, _ := claims["iss"].(string); v.Issuer != "" && iss != v.Issuer {
+		return fmt.Errorf("Incorrect JWT issuer '%v'", iss)
+	}
+
+	if len(v.Audience) == 0 {
+		return nil
+	}
+
+	aud := []string{}
+	switch a := claims["aud"].(type) {
+	case string:
+		aud = append(aud, a)
+	case []interface{}:
+		for _, item := range a {
+			if s, ok := item.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+
+	for _, a := range aud {
+		for _, want := range v.Audience {
+			if a == want {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Incorrect JWT audience %v", aud)
+}
+
+// verifyJWT checks the signature of the algorithm, the key type should
+// match the algorithm, so the public key can't be used as the HMAC secret.
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if alg == "EdDSA" {
+		if k, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(k, []byte(signed), sig) {
+			return nil
+		}
+		return errors.New("Incorrect JWT signature")
+	}
+
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+
+	if hash == 0 {
+		return fmt.Errorf("Unsupported JWT algorithm '%v'", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var err error
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		default:
+			err = fmt.Errorf("Unsupported JWT algorithm '%v' for the RSA key", alg)
+		}
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return errors.New("Incorrect JWT signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			err = errors.New("Incorrect JWT signature")
+		}
+
+	default:
+		err = fmt.Errorf("Unsupported JWT algorithm '%v' for the key", alg)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Incorrect JWT signature: %v", err)
+	}
+	return nil
+}
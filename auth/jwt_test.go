@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT creates the token of the claims, the RS256, ES256 and EdDSA keys
+// are supported.
+func signJWT(test *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		if err == nil {
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		test.Fatalf("Can't sign JWT: %v", err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, edKey ed25519.PrivateKey) string {
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed1", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return string(data)
+}
+
+func TestJWT(test *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	f, err := ioutil.TempFile("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary file: %v", err)
+	}
+	f.WriteString(testJWKS(rsaKey, ecKey, edKey))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	v := NewJWTValidator(NewJWKS(f.Name()))
+	v.Issuer = "https://sso.example.com"
+	v.Audience = []string{"rrdserver"}
+	v.UserClaim = "preferred_username"
+
+	now := time.Unix(1700000000, 0)
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{
+			"iss":                "https://sso.example.com",
+			"aud":                []string{"grafana", "rrdserver"},
+			"sub":                "1234",
+			"preferred_username": "alice",
+			"groups":             []string{"web", "ops"},
+			"exp":                now.Unix() + 300,
+		}
+		for k, val := range changes {
+			if val == nil {
+				delete(res, k)
+			} else {
+				res[k] = val
+			}
+		}
+		return res
+	}
+
+	alg, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa1"})
+	payload, _ := json.Marshal(claims(nil))
+
+	cases := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"RS256", signJWT(test, "RS256", "rsa1", rsaKey, claims(nil)), "alice"},
+		{"ES256", signJWT(test, "ES256", "ec1", ecKey, claims(nil)), "alice"},
+		{"EdDSA", signJWT(test, "EdDSA", "ed1", edKey, claims(nil)), "alice"},
+		{"string aud", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"aud": "rrdserver"})), "alice"},
+		{"leeway", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"exp": now.Unix() - 10})), "alice"},
+		{"expired", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"exp": now.Unix() - 60})), ""},
+		{"no exp", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"exp": nil})), ""},
+		{"nbf", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"nbf": now.Unix() + 60})), ""},
+		{"issuer", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"iss": "https://evil.com"})), ""},
+		{"audience", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"aud": "grafana"})), ""},
+		{"no user", signJWT(test, "ES256", "ec1", ecKey, claims(map[string]interface{}{"preferred_username": nil})), ""},
+		{"other key", signJWT(test, "ES256", "ec1", otherKey, claims(nil)), ""},
+		{"wrong alg", signJWT(test, "ES256", "rsa1", ecKey, claims(nil)), ""},
+		{"unknown kid", signJWT(test, "ES256", "ec2", ecKey, claims(nil)), ""},
+		{"enc key", signJWT(test, "RS256", "enc1", rsaKey, claims(nil)), ""},
+		{"none", b64(alg) + "." + b64(payload) + ".", ""},
+		{"garbage", "a.b.c", ""},
+	}
+
+	for _, c := range cases {
+		user, err := v.Validate(c.token, now)
+		if c.want == "" {
+			if err == nil {
+				test.Errorf("%v: error expected, got user %v", c.name, user)
+			}
+			continue
+		}
+
+		if err != nil || user.Name != c.want || strings.Join(user.Groups, ",") != "web,ops" {
+			test.Errorf("%v: incorrect user %v: %v", c.name, user, err)
+		}
+	}
+}
+
+func TestJWTHandler(test *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(testJWKS(rsaKey, ecKey, edKey)))
+	}))
+	defer jwks.Close()
+
+	handler := NewHandler(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := FromRequest(r)
+		w.Write([]byte(user.Name + ":" + strings.Join(user.Groups, ",")))
+	}))
+	handler.JWT = NewJWTValidator(NewJWKS(jwks.URL))
+	handler.Groups = map[string][]string{"alice": {"admins"}}
+
+	token := func(exp time.Time, kid string) string {
+		return signJWT(test, "ES256", kid, ecKey, map[string]interface{}{
+			"sub":    "alice",
+			"groups": "web",
+			"exp":    exp.Unix(),
+		})
+	}
+
+	cases := []struct {
+		token string
+		code  int
+		body  string
+	}{
+		{token(time.Now().Add(time.Minute), "ec1"), http.StatusOK, "alice:web,admins"},
+		{token(time.Now().Add(-time.Hour), "ec1"), http.StatusUnauthorized, ""},
+		{token(time.Now().Add(time.Minute), "ec2"), http.StatusUnauthorized, ""},
+		{"rrd_0123", http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != c.code || (c.body != "" && w.Body.String() != c.body) {
+			test.Errorf("Token: %v\nResult: %v '%v'\nWant:   %v '%v'\n", c.token, w.Code, w.Body.String(), c.code, c.body)
+		}
+	}
+
+	// The unknown key refetches the key set, but not more often than once
+	// a minute.
+	if fetches != 1 {
+		test.Errorf("Incorrect number of the JWKS fetches: %v", fetches)
+	}
+}
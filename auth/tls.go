@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// CertStore keeps the server certificate and the CAs of the client
+// certificates, Reload rereads them without restarting the listener.
+type CertStore struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// NewCertStore loads the certificates, the empty clientCAFile disables
+// the client certificates.
+func NewCertStore(certFile, keyFile, clientCAFile string) (*CertStore, error) {
+	s := &CertStore{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload rereads the files, the previous certificates are kept on error.
+func (s *CertStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Can't load certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if s.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Can't load client CA: %v", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("Can't load client CA: no certificates in '%v'", s.ClientCAFile)
+		}
+	}
+
+	s.mutex.Lock()
+	s.cert = &cert
+	s.clientCAs = pool
+	s.mutex.Unlock()
+	return nil
+}
+
+// TLSConfig returns the config of the server with the current certificates.
+// The client certificates are verified if they're given, the requests
+// without them are authenticated by Handler in the other ways.
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return s.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+
+			if s.cert == nil {
+				return nil, errors.New("Certificate isn't loaded")
+			}
+
+			res := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+			}
+			if s.clientCAs != nil {
+				res.ClientAuth = tls.VerifyClientCertIfGiven
+				res.ClientCAs = s.clientCAs
+			}
+			return res, nil
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert creates the certificate signed by the parent, the nil parent
+// makes the self signed CA.
+func newTestCert(test *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		test.Fatalf("Can't create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) write(test *testing.T, certFile, keyFile string) {
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(certFile, c.pem, 0600); err != nil {
+		test.Fatalf("Can't write certificate: %v", err)
+	}
+	if keyFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		test.Fatalf("Can't write key: %v", err)
+	}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestCertStore(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(test, "Test CA", 1, nil)
+	otherCA := newTestCert(test, "Other CA", 2, nil)
+	ca.write(test, dir+"/ca.pem", "")
+	newTestCert(test, "server1", 3, ca).write(test, dir+"/cert.pem", dir+"/key.pem")
+
+	certs, err := NewCertStore(dir+"/cert.pem", dir+"/key.pem", dir+"/ca.pem")
+	if err != nil {
+		test.Fatalf("Can't load certificates: %v", err)
+	}
+
+	handler := NewHandler(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := FromRequest(r)
+		w.Write([]byte(user.Name))
+	}))
+	handler.ClientCerts = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Can't listen: %v", err)
+	}
+	server := &http.Server{Handler: handler, TLSConfig: certs.TLSConfig()}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(client *testCert) (*http.Response, string, error) {
+		cfg := &tls.Config{RootCAs: roots}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{client.tls()}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+		resp, err := c.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body), nil
+	}
+
+	resp, body, err := get(newTestCert(test, "alice", 4, ca))
+	if err != nil || resp.StatusCode != http.StatusOK || body != "alice" {
+		test.Errorf("The client certificate isn't accepted: %v %v", body, err)
+	}
+
+	if resp, _, err := get(nil); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		test.Errorf("The request without credentials is accepted: %v", err)
+	}
+
+	// The client doesn't send the certificate the server's CAs don't accept.
+	if resp, body, err := get(newTestCert(test, "mallory", 5, otherCA)); err == nil && resp.StatusCode != http.StatusUnauthorized {
+		test.Errorf("The client certificate of the other CA is accepted: %v", body)
+	}
+
+	// The reloaded certificate is used for the new connections.
+	newTestCert(test, "server2", 6, ca).write(test, dir+"/cert.pem", dir+"/key.pem")
+	if err := certs.Reload(); err != nil {
+		test.Fatalf("Can't reload certificates: %v", err)
+	}
+
+	resp, _, err = get(nil)
+	if err != nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "server2" {
+		test.Errorf("The certificate isn't reloaded: %v", err)
+	}
+
+	// The broken files don't drop the certificate.
+	ioutil.WriteFile(dir+"/cert.pem", []byte("broken"), 0600)
+	if err := certs.Reload(); err == nil {
+		test.Errorf("Error expected for the broken certificate")
+	}
+	if _, _, err := get(nil); err != nil {
+		test.Errorf("The certificate is lost after the broken reload: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The token scopes, the write scope allows the reads as well.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+const tokenPrefix = "rrd_"
+
+// Token is the bearer API token of the user, only its SHA-256 hash is kept.
+type Token struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	User    string     `json:"user"`
+	Scope   string     `json:"scope"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+// Tokens is the list of the API tokens persisted to the JSON file. The
+// tokens are created, listed and revoked by the Admins with the password
+// (not the token) authentication.
+type Tokens struct {
+	File   string
+	Admins map[string]bool
+
+	mutex  sync.RWMutex
+	tokens []Token
+}
+
+// LoadTokens reads the tokens file, the missing file is the empty list.
+func LoadTokens(file string) (*Tokens, error) {
+	res := &Tokens{File: file, Admins: make(map[string]bool), tokens: []Token{}}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &res.tokens); err != nil {
+		return nil, fmt.Errorf("Incorrect tokens file '%v': %v", file, err)
+	}
+	return res, nil
+}
+
+// save writes the tokens to the temporary file and renames it, so the
+// file is never half written. The mutex should be locked.
+func (t *Tokens) save() error {
+	data, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := t.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.File)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create adds the token of the user, the returned secret isn't stored and
+// can't be shown again.
+func (t *Tokens) Create(name, user, scope string, expires *time.Time) (Token, string, error) {
+	switch scope {
+	case ScopeRead, ScopeWrite:
+	default:
+		return Token{}, "", fmt.Errorf("Incorrect scope '%v', should be %v or %v", scope, ScopeRead, ScopeWrite)
+	}
+
+	if user == "" {
+		return Token{}, "", fmt.Errorf("Token user isn't set")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = tokenPrefix + secret
+
+	token := Token{
+		ID:      id,
+		Name:    name,
+		User:    user,
+		Scope:   scope,
+		Created: time.Now().UTC(),
+		Expires: expires,
+		Hash:    hashToken(secret),
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tokens = append(t.tokens, token)
+	if err := t.save(); err != nil {
+		t.tokens = t.tokens[:len(t.tokens)-1]
+		return Token{}, "", err
+	}
+
+	token.Hash = ""
+	return token, secret, nil
+}
+
+// List returns the tokens without the hashes.
+func (t *Tokens) List() []Token {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	res := make([]Token, len(t.tokens))
+	for i, token := range t.tokens {
+		token.Hash = ""
+		res[i] = token
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res
+}
+
+// Revoke removes the token, false means the token isn't found.
+func (t *Tokens) Revoke(id string) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, token := range t.tokens {
+		if token.ID != id {
+			continue
+		}
+
+		prev := t.tokens
+		t.tokens = append(append([]Token{}, prev[:i]...), prev[i+1:]...)
+		if err := t.save(); err != nil {
+			t.tokens = prev
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Check returns the valid token of the secret. The secrets are compared by
+// their hashes, so the comparison time doesn't depend on the secret.
+func (t *Tokens) Check(secret string) (Token, bool) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Token{}, false
+	}
+	hash := hashToken(secret)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, token := range t.tokens {
+		if token.Hash == hash {
+			return token, !token.Expired(time.Now())
+		}
+	}
+	return Token{}, false
+}
+
+// Serve adds the admin endpoints: GET /auth/tokens lists the tokens, POST
+// creates the token of CreateTokenRequest and DELETE /auth/tokens/{id}
+// revokes it.
+func (t *Tokens) Serve(router *mux.Router) {
+	router.Methods("GET").Path("/auth/tokens").HandlerFunc(t.admin(t.ListHandler))
+	router.Methods("POST").Path("/auth/tokens").HandlerFunc(t.admin(t.CreateHandler))
+	router.Methods("DELETE").Path("/auth/tokens/{id}").HandlerFunc(t.admin(t.RevokeHandler))
+}
+
+func (t *Tokens) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := FromRequest(r)
+		if !ok || user.Method != MethodPassword || !t.Admins[user.Name] {
+			httpError(w, http.StatusForbidden, "User '%v' can't manage the tokens", user.Name)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type CreateTokenRequest struct {
+	Name    string     `json:"name"`
+	User    string     `json:"user"`
+	Scope   string     `json:"scope"`
+	Expires *time.Time `json:"expires"`
+}
+
+type CreateTokenResponse struct {
+	Token
+	Secret string `json:"token"`
+}
+
+func (t *Tokens) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.List())
+}
+
+// CreateHandler creates the token of the request user, by default it's the
+// admin and the read scope.
+func (t *Tokens) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	req := CreateTokenRequest{Scope: ScopeRead}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "Can't parse request: %v", err)
+		return
+	}
+
+	if req.User == "" {
+		user, _ := FromRequest(r)
+		req.User = user.Name
+	}
+
+	if req.Expires != nil && req.Expires.Before(time.Now()) {
+		httpError(w, http.StatusBadRequest, "Token expires in the past: %v", req.Expires)
+		return
+	}
+
+	token, secret, err := t.Create(req.Name, req.User, req.Scope, req.Expires)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Can't create token: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateTokenResponse{Token: token, Secret: secret})
+}
+
+func (t *Tokens) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	found, err := t.Revoke(id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Can't revoke token '%v': %v", id, err)
+		return
+	}
+
+	if !found {
+		httpError(w, http.StatusNotFound, "Token '%v' isn't found", id)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+// Package auth authenticates the API requests, the authenticated user is
+// carried in the request context.
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dummyHash is compared for the unknown users, so the response time doesn't
+// tell if the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("rrdserver"), bcrypt.DefaultCost)
+
+// Users is the htpasswd style file, every line is "<user>:<hash>" with the
+// bcrypt ("htpasswd -B") or argon2id hash. The file is reread when its
+// modification time changes. Static users are the plain text passwords of
+// the config.
+type Users struct {
+	File string
+
+	mutex   sync.RWMutex
+	static  map[string]string
+	hashes  map[string]string
+	modTime time.Time
+}
+
+func NewUsers(file string) *Users {
+	return &Users{
+		File:   file,
+		static: make(map[string]string),
+		hashes: make(map[string]string),
+	}
+}
+
+// AddStatic adds the user with the plain text password.
+func (u *Users) AddStatic(name, password string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.static[name] = password
+}
+
+// Load reads the file if it's changed, the previous users are kept if the
+// file can't be read.
+func (u *Users) Load() error {
+	if u.File == "" {
+		return nil
+	}
+
+	st, err := os.Stat(u.File)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.RLock()
+	changed := !st.ModTime().Equal(u.modTime)
+	u.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	hashes, err := readUsersFile(u.File)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.hashes = hashes
+	u.modTime = st.ModTime()
+	u.mutex.Unlock()
+
+	log.Info("Loaded %v users from '%v'", len(hashes), u.File)
+	return nil
+}
+
+func readUsersFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("%v:%v: incorrect line, should be '<user>:<hash>'", file, n)
+		}
+
+		if !supportedHash(pair[1]) {
+			log.Warning("%v:%v: unsupported hash of user '%v', should be bcrypt or argon2id", file, n, pair[0])
+			continue
+		}
+		res[pair[0]] = pair[1]
+	}
+
+	return res, scanner.Err()
+}
+
+func supportedHash(hash string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns true if the password of the user is correct.
+func (u *Users) Check(name, password string) bool {
+	if err := u.Load(); err != nil {
+		log.Warning("Can't load users: %v", err)
+	}
+
+	u.mutex.RLock()
+	pass, static := u.static[name]
+	hash, ok := u.hashes[name]
+	u.mutex.RUnlock()
+
+	if static {
+		return subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	}
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return compareHash(hash, password)
+}
+
+// maxArgon2Memory is the limit of the argon2id hash memory in KiB, 1 GiB.
+const maxArgon2Memory = 1 << 20
+
+// compareHash checks the password against the bcrypt or argon2id hash,
+// the argon2id hash is "$argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<key>"
+// with the unpadded base64 salt and key.
+func compareHash(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	items := strings.Split(hash, "$")
+	if len(items) != 6 {
+		return false
+	}
+
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(items[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(items[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	// argon2.IDKey panics on the zero time or threads, and the huge memory
+	// of the broken hash would exhaust the server memory.
+	if iterations < 1 || threads < 1 || memory > maxArgon2Memory {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(items[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(items[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	res := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(res, key) == 1
+}
@@ -0,0 +1,250 @@
+// Package cluster shards the metrics across several rrdserver instances.
+// Every instance owns the hash range of the metric paths, the reads and
+// writes of the other metrics are proxied to their owners.
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rrdserver/rrdserver/api"
+	"github.com/rrdserver/rrdserver/auth"
+	"github.com/rrdserver/rrdserver/writer"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Node struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Location is the place of the metric file: the owner node and the file
+// path in its data directory.
+type Location struct {
+	Node  string `json:"node"`
+	URL   string `json:"url"`
+	File  string `json:"file"`
+	Local bool   `json:"local"`
+}
+
+type Cluster struct {
+	Self     string
+	DataDir  string
+	User     string
+	Password string
+	Client   *http.Client
+
+	replicas int
+	names    []string
+	nodes    map[string]Node
+	addrs    map[string]bool
+	ring     *Ring
+}
+
+// New creates the cluster of the nodes, the self node should be one of them.
+// All instances should be configured with the same nodes and replicas.
+func New(self, dataDir string, nodes []Node, replicas int, timeout time.Duration) (*Cluster, error) {
+	c := &Cluster{
+		Self:     self,
+		DataDir:  dataDir,
+		Client:   &http.Client{Timeout: timeout},
+		replicas: replicas,
+		nodes:    make(map[string]Node),
+		addrs:    make(map[string]bool),
+	}
+
+	for _, n := range nodes {
+		if n.Name == "" || n.URL == "" {
+			return nil, fmt.Errorf("Incorrect cluster node '%v %v'", n.Name, n.URL)
+		}
+
+		if _, ok := c.nodes[n.Name]; ok {
+			return nil, fmt.Errorf("Duplicate cluster node '%v'", n.Name)
+		}
+
+		n.URL = strings.TrimRight(n.URL, "/")
+		c.nodes[n.Name] = n
+		c.names = append(c.names, n.Name)
+
+		// The node which isn't resolved now is known only by the user, the
+		// self node doesn't send the requests to itself.
+		if u, err := url.Parse(n.URL); err == nil && n.Name != self {
+			addrs, _ := net.LookupHost(u.Hostname())
+			for _, a := range addrs {
+				c.addrs[a] = true
+			}
+		}
+	}
+	sort.Strings(c.names)
+
+	if _, ok := c.nodes[self]; !ok {
+		return nil, fmt.Errorf("The node '%v' isn't in the cluster", self)
+	}
+
+	c.ring = NewRing(c.names, replicas)
+	return c, nil
+}
+
+// Owner returns the node which keeps the metric.
+func (c *Cluster) Owner(metric string) Node {
+	return c.nodes[c.ring.Owner(api.SafeMetric(metric))]
+}
+
+func (c *Cluster) IsLocal(metric string) bool {
+	return c.Owner(metric).Name == c.Self
+}
+
+// IsNode tells the requests of the other nodes: the ones from the node
+// addresses or of the cluster user authenticated by the password.
+func (c *Cluster) IsNode(r *http.Request) bool {
+	if c.addrs[api.RemoteIP(r)] {
+		return true
+	}
+	user, ok := auth.FromRequest(r)
+	return ok && c.User != "" && user.Name == c.User && user.Method == auth.MethodPassword
+}
+
+// FileForMetric returns the owner node and the RRD file of the metric.
+func (c *Cluster) FileForMetric(metric string) Location {
+	owner := c.Owner(metric)
+	return Location{
+		Node:  owner.Name,
+		URL:   owner.URL,
+		File:  c.DataDir + api.SafeMetric(metric) + ".rrd",
+		Local: owner.Name == c.Self,
+	}
+}
+
+// Serve adds the cluster endpoints: /cluster is the status, the rest are
+// used by the other nodes. /cluster/api/ serves only the local metrics
+// and /cluster/write writes only locally, so the requests never loop.
+// They aren't limited by the ACL, so only the nodes can use them.
+func (c *Cluster) Serve(router *mux.Router, local api.Storage, sink writer.Sink) {
+	router.Methods("GET").Path("/cluster").HandlerFunc(c.StatusHandler)
+	router.Methods("GET").Path("/cluster/ping").HandlerFunc(c.PingHandler)
+	router.Methods("POST").Path("/cluster/write").Handler(c.nodeOnly(c.writeHandler(sink)))
+
+	localAPI := api.NewAPI(c.DataDir)
+	localAPI.Storage = local
+	localRouter := mux.NewRouter()
+	localAPI.Serve(localRouter.PathPrefix("/cluster/api/").Subrouter())
+	router.PathPrefix("/cluster/api/").Handler(c.nodeOnly(localRouter))
+}
+
+// nodeOnly passes the requests of the cluster user authenticated by the
+// password, the JWT or client certificate of the same name isn't the node.
+// The users' requests are checked by the node they come to, the requests
+// without the authentication are passed as is.
+func (c *Cluster) nodeOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := auth.FromRequest(r); ok && (c.User == "" || user.Name != c.User || user.Method != auth.MethodPassword) {
+			api.Forbidden(w, "User '%v' isn't the cluster node", user.Name)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (c *Cluster) newRequest(method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return req, nil
+}
+
+type NodeStatus struct {
+	Node
+	Self  bool   `json:"self"`
+	Alive bool   `json:"alive"`
+	Error string `json:"error,omitempty"`
+}
+
+type Status struct {
+	Self     string       `json:"self"`
+	Replicas int          `json:"replicas"`
+	Nodes    []NodeStatus `json:"nodes"`
+	Metric   *Location    `json:"metric,omitempty"`
+}
+
+// Status pings the nodes concurrently.
+func (c *Cluster) Status() Status {
+	res := Status{
+		Self:     c.Self,
+		Replicas: c.replicas,
+		Nodes:    make([]NodeStatus, len(c.names)),
+	}
+
+	wg := sync.WaitGroup{}
+	for i, name := range c.names {
+		res.Nodes[i] = NodeStatus{Node: c.nodes[name], Self: name == c.Self}
+		if name == c.Self {
+			res.Nodes[i].Alive = true
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *NodeStatus) {
+			defer wg.Done()
+			if err := c.ping(s.URL); err != nil {
+				s.Error = err.Error()
+			} else {
+				s.Alive = true
+			}
+		}(&res.Nodes[i])
+	}
+	wg.Wait()
+
+	return res
+}
+
+func (c *Cluster) ping(url string) error {
+	req, err := c.newRequest("GET", url+"/cluster/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
+
+func (c *Cluster) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	res := c.Status()
+	if metric := r.FormValue("metric"); metric != "" {
+		loc := c.FileForMetric(metric)
+		res.Metric = &loc
+	}
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		api.InternalServerError(w, "%v", err)
+	}
+}
+
+func (c *Cluster) PingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"node\": %q}\n", c.Self)))
+}
@@ -0,0 +1,325 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rrdserver/rrdserver/api"
+	"github.com/rrdserver/rrdserver/auth"
+	"github.com/rrdserver/rrdserver/writer"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testFirstRow = 946774740
+
+type testSink struct {
+	mutex  sync.Mutex
+	writes map[string][]writer.DataSource
+}
+
+func (s *testSink) Write(metric string, t time.Time, values []writer.DataSource) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writes[fmt.Sprintf("%v@%d", metric, t.Unix())] = values
+	return nil
+}
+
+type testNode struct {
+	server  *httptest.Server
+	router  *mux.Router
+	local   *api.MemoryStorage
+	sink    *testSink
+	cluster *Cluster
+}
+
+// newTestCluster starts the nodes, the node handlers are set after all
+// URLs are known.
+func newTestCluster(test *testing.T, names ...string) []*testNode {
+	res := []*testNode{}
+	nodes := []Node{}
+
+	for _, name := range names {
+		n := &testNode{
+			local: api.NewMemoryStorage(),
+			sink:  &testSink{writes: make(map[string][]writer.DataSource)},
+		}
+		n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n.router.ServeHTTP(w, r)
+		}))
+
+		res = append(res, n)
+		nodes = append(nodes, Node{Name: name, URL: n.server.URL + "/"})
+	}
+
+	for i, n := range res {
+		c, err := New(names[i], "/var/lib/rrd/", nodes, 128, time.Second)
+		if err != nil {
+			test.Fatalf("Can't create cluster: %v", err)
+		}
+
+		n.cluster = c
+		n.router = mux.NewRouter()
+		c.Serve(n.router, n.local, n.sink)
+	}
+
+	return res
+}
+
+// metricOf returns the metric owned by the node.
+func metricOf(test *testing.T, c *Cluster, node string) string {
+	for i := 0; i < 1000; i++ {
+		m := fmt.Sprintf("server%d.net/load/load", i)
+		if c.Owner(m).Name == node {
+			return m
+		}
+	}
+	test.Fatalf("No metric found for the node %v", node)
+	return ""
+}
+
+func TestCluster(test *testing.T) {
+	nodes := newTestCluster(test, "node1", "node2")
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+
+	c := nodes[0].cluster
+	m1 := metricOf(test, c, "node1")
+	m2 := metricOf(test, c, "node2")
+
+	if loc := c.FileForMetric(m2); loc.Node != "node2" || loc.Local || loc.File != "/var/lib/rrd/"+m2+".rrd" || loc.URL != nodes[1].server.URL {
+		test.Errorf("Incorrect location of %v: %+v", m2, loc)
+	}
+
+	if _, err := New("node3", "", []Node{{"node1", "http://127.0.0.1"}}, 128, time.Second); err == nil {
+		test.Errorf("Error expected for the self node outside the cluster")
+	}
+
+	// Writes ..........................
+	w := NewWriter(c, nodes[0].sink)
+	values := []writer.DataSource{{Name: "value", Type: "DERIVE", Value: 42}}
+
+	for _, m := range []string{m1, m2} {
+		if err := w.Write(m, time.Unix(testFirstRow, 0), values); err != nil {
+			test.Errorf("Write error: %v", err)
+		}
+	}
+
+	for i, m := range []string{m1, m2} {
+		key := fmt.Sprintf("%v@%d", m, testFirstRow)
+		if v := nodes[i].sink.writes[key]; !reflect.DeepEqual(v, values) {
+			test.Errorf("Metric %v isn't written to node%d: %v", m, i+1, nodes[i].sink.writes)
+		}
+		if len(nodes[i].sink.writes) != 1 {
+			test.Errorf("Unexpected writes of node%d: %v", i+1, nodes[i].sink.writes)
+		}
+	}
+
+	// Reads ...........................
+	for i, m := range []string{m1, m2} {
+		nodes[i].local.Add(m, api.MemoryMetric{
+			Step:  time.Minute,
+			DS:    []string{"value"},
+			First: time.Unix(testFirstRow, 0),
+			Rows:  [][]float64{{float64(i + 1)}},
+		})
+	}
+
+	storage := NewStorage(c, nodes[0].local)
+	want := []string{m1, m2}
+	if m1 > m2 {
+		want = []string{m2, m1}
+	}
+
+	if res, err := storage.ListMetrics(""); err != nil || !reflect.DeepEqual(res, want) {
+		test.Errorf("Incorrect metrics: %v %v\nWant:               %v", res, err, want)
+	}
+
+	if res, err := storage.ListMetrics(m2); err != nil || !reflect.DeepEqual(res, []string{m2}) {
+		test.Errorf("Incorrect metrics: %v %v", res, err)
+	}
+
+	for i, m := range []string{m1, m2} {
+		res, err := storage.Fetch(context.Background(), m, api.CFAVERAGE, time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow, 0), time.Second)
+		if err != nil || res.RowCnt < 1 || res.ValueAt(0, 0) != float64(i+1) {
+			test.Errorf("Incorrect fetch of %v: %+v %v", m, res, err)
+		}
+	}
+
+	// Status ..........................
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/cluster?metric="+m2, nil)
+	rec := httptest.NewRecorder()
+	nodes[0].router.ServeHTTP(rec, req)
+
+	status := Status{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		test.Fatalf("Incorrect status '%v': %v", rec.Body.String(), err)
+	}
+
+	if status.Self != "node1" || len(status.Nodes) != 2 || !status.Nodes[0].Self || !status.Nodes[1].Alive ||
+		status.Metric == nil || status.Metric.Node != "node2" {
+		test.Errorf("Incorrect status: %v", rec.Body.String())
+	}
+}
+
+func TestClusterWriteUnknown(test *testing.T) {
+	nodes := newTestCluster(test, "node1", "node2")
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+
+	c := nodes[0].cluster
+	m2 := metricOf(test, c, "node2")
+
+	values := []writer.DataSource{
+		{Name: "nan", Type: "GAUGE", Value: math.NaN()},
+		{Name: "inf", Type: "GAUGE", Value: math.Inf(1)},
+		{Name: "value", Type: "DDERIVE", Value: 1.5},
+	}
+	if err := NewWriter(c, nodes[0].sink).Write(m2, time.Unix(testFirstRow, 0), values); err != nil {
+		test.Fatalf("Write error: %v", err)
+	}
+
+	want := []writer.DataSource{
+		{Name: "nan", Type: "GAUGE", Value: math.NaN()},
+		{Name: "inf", Type: "GAUGE", Value: math.NaN()},
+		{Name: "value", Type: "DDERIVE", Value: 1.5},
+	}
+	res := nodes[1].sink.writes[fmt.Sprintf("%v@%d", m2, testFirstRow)]
+	if fmt.Sprint(res) != fmt.Sprint(want) {
+		test.Errorf("Incorrect write\nResult: %v\nWant:   %v\n", res, want)
+	}
+}
+
+func TestClusterNodeDown(test *testing.T) {
+	nodes := newTestCluster(test, "node1", "node2")
+	defer nodes[0].server.Close()
+	nodes[1].server.Close()
+
+	c := nodes[0].cluster
+	m1 := metricOf(test, c, "node1")
+	m2 := metricOf(test, c, "node2")
+
+	nodes[0].local.Add(m1, api.MemoryMetric{
+		Step:  time.Minute,
+		DS:    []string{"value"},
+		First: time.Unix(testFirstRow, 0),
+		Rows:  [][]float64{{1}},
+	})
+
+	storage := NewStorage(c, nodes[0].local)
+	res, err := storage.ListMetrics("")
+	if _, ok := err.(*api.PartialError); !ok || !reflect.DeepEqual(res, []string{m1}) {
+		test.Errorf("Partial result expected: %v %v", res, err)
+	}
+
+	if _, err := storage.Fetch(context.Background(), m2, api.CFAVERAGE, time.Unix(testFirstRow-60, 0), time.Unix(testFirstRow, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the metric of the failed node")
+	}
+
+	w := NewWriter(c, nodes[0].sink)
+	if err := w.Write(m2, time.Unix(testFirstRow, 0), []writer.DataSource{{Name: "value", Type: "GAUGE", Value: 1}}); err == nil {
+		test.Errorf("Error expected for the write to the failed node")
+	}
+
+	if s := c.Status(); s.Nodes[1].Alive || s.Nodes[1].Error == "" {
+		test.Errorf("Node2 should be down: %+v", s.Nodes[1])
+	}
+}
+
+func TestClusterNodeOnly(test *testing.T) {
+	nodes := newTestCluster(test, "node1")
+	defer nodes[0].server.Close()
+
+	c := nodes[0].cluster
+	c.User = "cluster"
+
+	cases := []struct {
+		user      *auth.User
+		forbidden bool
+	}{
+		{nil, false},
+		{&auth.User{Name: "cluster", Method: auth.MethodPassword}, false},
+		{&auth.User{Name: "alice", Method: auth.MethodPassword}, true},
+		{&auth.User{Name: "cluster", Token: "t1", Scope: auth.ScopeWrite, Method: auth.MethodToken}, true},
+		{&auth.User{Name: "cluster", Method: auth.MethodJWT}, true},
+		{&auth.User{Name: "cluster", Method: auth.MethodCert}, true},
+	}
+
+	for _, c := range cases {
+		for _, path := range []string{"/cluster/api/suggest/metrics", "/cluster/write"} {
+			r := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+			if c.user != nil {
+				r = r.WithContext(auth.NewContext(r.Context(), *c.user))
+			}
+
+			w := httptest.NewRecorder()
+			nodes[0].router.ServeHTTP(w, r)
+
+			if forbidden := w.Code == http.StatusForbidden; forbidden != c.forbidden {
+				test.Errorf("User %+v, %v: %v %v", c.user, path, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestClusterRateLimit(test *testing.T) {
+	nodes := newTestCluster(test, "node1", "node2")
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+
+	c := nodes[0].cluster
+	c.User = "cluster"
+
+	limit := api.NewRateLimitHandler(api.NewRateLimiter(0, 1), nodes[0].router)
+	limit.Key = func(r *http.Request) string {
+		if user, ok := auth.FromRequest(r); ok {
+			return user.Name
+		}
+		return api.RemoteIP(r)
+	}
+	limit.Skip = c.IsNode
+
+	cases := []struct {
+		user    *auth.User
+		addr    string
+		limited bool
+	}{
+		{&auth.User{Name: "cluster", Method: auth.MethodPassword}, "192.0.2.1:1234", false},
+		// node2 is at 127.0.0.1.
+		{nil, "127.0.0.1:1234", false},
+		{&auth.User{Name: "cluster", Method: auth.MethodJWT}, "192.0.2.1:1234", true},
+		{&auth.User{Name: "alice", Method: auth.MethodPassword}, "192.0.2.1:1234", true},
+	}
+
+	body := `{"metric": "` + metricOf(test, c, "node1") + `", "time": 946774740, "values": [{"name": "value", "type": "GAUGE", "value": 1}]}`
+	for _, c := range cases {
+		// The first request takes the only token of the burst.
+		codes := []int{}
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest("POST", "/cluster/write", strings.NewReader(body))
+			r.RemoteAddr = c.addr
+			if c.user != nil {
+				r = r.WithContext(auth.NewContext(r.Context(), *c.user))
+			}
+
+			w := httptest.NewRecorder()
+			limit.ServeHTTP(w, r)
+			codes = append(codes, w.Code)
+		}
+
+		written := codes[0] == http.StatusNoContent && codes[1] == http.StatusNoContent && codes[2] == http.StatusNoContent
+		if limited := codes[2] == http.StatusTooManyRequests; limited != c.limited || (!limited && !written) {
+			test.Errorf("User %+v from %v: %v", c.user, c.addr, codes)
+		}
+	}
+}
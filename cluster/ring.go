@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring is the consistent hash ring of the nodes. Every node has several
+// points on the ring, the metric belongs to the node of the first point
+// after its hash. Adding or removing a node moves only the metrics of
+// the ranges it gains or loses.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewRing places every node at replicas points of the ring.
+func NewRing(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	r := &Ring{owners: make(map[uint32]string)}
+
+	sorted := append([]string{}, nodes...)
+	sort.Strings(sorted)
+
+	for _, node := range sorted {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+
+			// The collision is resolved the same way on all instances:
+			// the point stays with the first node by name.
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = node
+			r.points = append(r.points, h)
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the node of the key, empty string for the empty ring.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
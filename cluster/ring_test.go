@@ -0,0 +1,51 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(test *testing.T) {
+	ring := NewRing([]string{"node1", "node2", "node3"}, 128)
+	same := NewRing([]string{"node3", "node1", "node2"}, 128)
+
+	count := make(map[string]int)
+	owners := make(map[string]string)
+
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("server%d.net/cpu-%d/cpu-system", i/8, i%8)
+		owners[key] = ring.Owner(key)
+		count[owners[key]]++
+
+		if o := same.Owner(key); o != owners[key] {
+			test.Errorf("Key: %v\nOwner depends on the order of nodes: %v %v", key, owners[key], o)
+		}
+	}
+
+	for _, node := range []string{"node1", "node2", "node3"} {
+		if count[node] < 600 {
+			test.Errorf("Unbalanced ring, node %v has %d of 3000 keys: %v", node, count[node], count)
+		}
+	}
+
+	// The new node takes the keys only from the others.
+	bigger := NewRing([]string{"node1", "node2", "node3", "node4"}, 128)
+	moved := 0
+	for key, owner := range owners {
+		o := bigger.Owner(key)
+		if o != owner {
+			moved++
+			if o != "node4" {
+				test.Errorf("Key: %v\nMoved from %v to %v instead of the new node", key, owner, o)
+			}
+		}
+	}
+
+	if moved == 0 || moved > 1200 {
+		test.Errorf("Incorrect count of moved keys: %d of 3000", moved)
+	}
+
+	if o := NewRing(nil, 128).Owner("metric"); o != "" {
+		test.Errorf("Empty owner expected for the empty ring: %v", o)
+	}
+}
@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"context"
+	"github.com/rrdserver/rrdserver/api"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage reads the local metrics from the local storage and the rest of
+// them from the owner nodes. The metric list is merged from all nodes.
+type Storage struct {
+	cluster *Cluster
+	Local   api.Storage
+	remotes map[string]*api.RemoteStorage
+}
+
+func NewStorage(c *Cluster, local api.Storage) *Storage {
+	s := &Storage{
+		cluster: c,
+		Local:   local,
+		remotes: make(map[string]*api.RemoteStorage),
+	}
+
+	for _, name := range c.names {
+		if name == c.Self {
+			continue
+		}
+
+		remote := api.NewRemoteStorage(name, c.nodes[name].URL+"/cluster/api/", c.Client.Timeout)
+		remote.User = c.User
+		remote.Password = c.Password
+		s.remotes[name] = remote
+	}
+
+	return s
+}
+
+// owner returns the storage of the node which keeps the metric.
+func (s *Storage) owner(metric string) api.Storage {
+	owner := s.cluster.Owner(metric)
+	if owner.Name == s.cluster.Self {
+		return s.Local
+	}
+	return s.remotes[owner.Name]
+}
+
+// ListMetrics requests all nodes concurrently, the failed nodes are returned
+// as *api.PartialError with the rest of the metrics.
+func (s *Storage) ListMetrics(prefix string) ([]string, error) {
+	storages := []api.Storage{s.Local}
+	for _, name := range s.cluster.names {
+		if remote, ok := s.remotes[name]; ok {
+			storages = append(storages, remote)
+		}
+	}
+
+	lists := make([][]string, len(storages))
+	errs := make([]error, len(storages))
+	wg := sync.WaitGroup{}
+
+	for i, storage := range storages {
+		wg.Add(1)
+		go func(i int, storage api.Storage) {
+			defer wg.Done()
+			lists[i], errs[i] = storage.ListMetrics(prefix)
+		}(i, storage)
+	}
+	wg.Wait()
+
+	res := []string{}
+	seen := make(map[string]bool)
+	partial := &api.PartialError{}
+
+	for i := range storages {
+		if errs[i] != nil {
+			if _, ok := errs[i].(*api.UpstreamError); !ok {
+				return nil, errs[i]
+			}
+			partial.Errors = append(partial.Errors, errs[i])
+			continue
+		}
+
+		for _, m := range lists[i] {
+			if !seen[m] {
+				seen[m] = true
+				res = append(res, m)
+			}
+		}
+	}
+
+	// The exact match on one node hides the metrics of the rest of them.
+	if exact := api.SafeMetric(strings.TrimRight(prefix, "/")); seen[exact] {
+		res = []string{exact}
+	}
+
+	sort.Strings(res)
+	if len(partial.Errors) > 0 {
+		return res, partial
+	}
+	return res, nil
+}
+
+func (s *Storage) DataSources(metric string) ([]string, error) {
+	return s.owner(metric).DataSources(metric)
+}
+
+func (s *Storage) Info(metric string) (api.MetricInfo, error) {
+	return s.owner(metric).Info(metric)
+}
+
+func (s *Storage) Fetch(ctx context.Context, metric string, cf api.Consolidation, start, end time.Time, step time.Duration) (*api.FetchResult, error) {
+	return s.owner(metric).Fetch(ctx, metric, cf, start, end, step)
+}
@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rrdserver/rrdserver/api"
+	"github.com/rrdserver/rrdserver/writer"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+)
+
+// writeRequest is the write forwarded to the owner node, the DS types are
+// kept as is unlike the line protocol of /write.
+type writeRequest struct {
+	Metric string       `json:"metric"`
+	Time   int64        `json:"time"`
+	Values []writeValue `json:"values"`
+}
+
+// writeValue is the value of the data source, JSON has no NaN and Inf, so
+// the unknown values are null.
+type writeValue struct {
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Value *float64 `json:"value"`
+}
+
+func encodeValues(values []writer.DataSource) []writeValue {
+	res := make([]writeValue, len(values))
+	for i, v := range values {
+		res[i] = writeValue{Name: v.Name, Type: v.Type}
+		if !math.IsNaN(v.Value) && !math.IsInf(v.Value, 0) {
+			value := v.Value
+			res[i].Value = &value
+		}
+	}
+	return res
+}
+
+func decodeValues(values []writeValue) []writer.DataSource {
+	res := make([]writer.DataSource, len(values))
+	for i, v := range values {
+		res[i] = writer.DataSource{Name: v.Name, Type: v.Type, Value: math.NaN()}
+		if v.Value != nil {
+			res[i].Value = *v.Value
+		}
+	}
+	return res
+}
+
+// Writer writes the local metrics into the local sink and forwards the
+// rest of them to the owner nodes.
+type Writer struct {
+	cluster *Cluster
+	Local   writer.Sink
+}
+
+func NewWriter(c *Cluster, local writer.Sink) *Writer {
+	return &Writer{cluster: c, Local: local}
+}
+
+func (w *Writer) Write(metric string, t time.Time, values []writer.DataSource) error {
+	// The owner is chosen by the file path the writer creates.
+	path := writer.SafeMetric(metric)
+	if path == "" {
+		return fmt.Errorf("Incorrect metric name '%v'", metric)
+	}
+	metric = path
+
+	owner := w.cluster.Owner(metric)
+	if owner.Name == w.cluster.Self {
+		return w.Local.Write(metric, t, values)
+	}
+
+	body, err := json.Marshal(writeRequest{Metric: metric, Time: t.Unix(), Values: encodeValues(values)})
+	if err != nil {
+		return err
+	}
+
+	req, err := w.cluster.newRequest("POST", owner.URL+"/cluster/write", body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.cluster.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't write '%v' to the node '%v': %v", metric, owner.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		e := api.ErrorResponse{}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("Can't write '%v' to the node '%v': %v", metric, owner.Name, e.Message)
+		}
+		return fmt.Errorf("Can't write '%v' to the node '%v': %v", metric, owner.Name, resp.Status)
+	}
+
+	return nil
+}
+
+// writeHandler accepts the writes forwarded by the other nodes.
+func (c *Cluster) writeHandler(sink writer.Sink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if sink == nil {
+			api.InternalServerError(w, "Write API is disabled.")
+			return
+		}
+
+		req := writeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.BadRequest(w, "%v", err)
+			return
+		}
+
+		if !c.IsLocal(req.Metric) {
+			api.BadRequest(w, "The metric '%v' belongs to the node '%v'", req.Metric, c.Owner(req.Metric).Name)
+			return
+		}
+
+		if err := sink.Write(req.Metric, time.Unix(req.Time, 0), decodeValues(req.Values)); err != nil {
+			api.InternalServerError(w, "%v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
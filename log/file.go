@@ -0,0 +1,53 @@
+package log
+
+import (
+	"os"
+	"sync"
+)
+
+// File is the log file opened for append, Reopen opens it again after
+// logrotate moves it.
+type File struct {
+	Name string
+
+	mutex sync.Mutex
+	f     *os.File
+}
+
+func OpenFile(name string) (*File, error) {
+	f := &File{Name: name}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reopen opens the file again, the previous one is kept on error.
+func (f *File) Reopen() error {
+	file, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	old := f.f
+	f.f = file
+	f.mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.f.Write(p)
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.f.Close()
+}
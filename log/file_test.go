@@ -0,0 +1,49 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFile(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFile(dir + "/access.log")
+	if err != nil {
+		test.Fatalf("Can't open file: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("first\n"))
+
+	// logrotate moves the file and sends SIGHUP.
+	if err := os.Rename(dir+"/access.log", dir+"/access.log.1"); err != nil {
+		test.Fatalf("Can't rename file: %v", err)
+	}
+	f.Write([]byte("second\n"))
+	if err := f.Reopen(); err != nil {
+		test.Fatalf("Can't reopen file: %v", err)
+	}
+	f.Write([]byte("third\n"))
+
+	for name, want := range map[string]string{"access.log.1": "first\nsecond\n", "access.log": "third\n"} {
+		data, _ := ioutil.ReadFile(dir + "/" + name)
+		if string(data) != want {
+			test.Errorf("%v\nResult: %q\nWant:   %q\n", name, data, want)
+		}
+	}
+
+	// The file is kept if it can't be reopened.
+	f.Name = dir + "/missing/access.log"
+	if err := f.Reopen(); err == nil {
+		test.Errorf("Error expected for the missing directory")
+	}
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		test.Errorf("The file is lost after the failed reopen: %v", err)
+	}
+}
@@ -1,9 +1,14 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/syslog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 var Facilities map[string]syslog.Priority
@@ -33,35 +38,218 @@ func init() {
 	}
 }
 
-var lSyslog *syslog.Writer
+// ParseFacility returns the syslog facility, the name is "local0" or
+// "LOG_LOCAL0", the empty one is LOG_DAEMON.
+func ParseFacility(name string) (syslog.Priority, error) {
+	if name == "" {
+		return syslog.LOG_DAEMON, nil
+	}
 
-func Log() *syslog.Writer {
-	if lSyslog == nil {
-		l, err := syslog.New(syslog.LOG_DEBUG, "rrdserver")
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "LOG_") {
+		name = "LOG_" + name
+	}
+
+	f, ok := Facilities[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown syslog facility '%v'", name)
+	}
+	return f, nil
+}
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "Debug"
+	case LevelInfo:
+		return "Info"
+	case LevelWarning:
+		return "Warning"
+	default:
+		return "Error"
+	}
+}
+
+// ParseLevel returns the level of debug, info (the default), warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("Unknown log level '%v'", s)
+}
+
+// Options is the logging setup: the messages of Level and above are written
+// to the Output, it's stderr (the default), syslog with the Facility or
+// File. JSON writes them as the JSON objects.
+type Options struct {
+	Level    Level
+	Output   string
+	File     string
+	Facility string
+	JSON     bool
+}
+
+var (
+	mutex   sync.Mutex
+	options = Options{Level: LevelInfo}
+	out     = io.Writer(os.Stderr)
+	lSyslog *syslog.Writer
+	lFile   *File
+)
+
+// Setup switches the output, the previous one is kept on error, e.g. if
+// syslog isn't available.
+func Setup(opts Options) error {
+	var w io.Writer
+	var sys *syslog.Writer
+	var file *File
+
+	switch strings.ToLower(opts.Output) {
+	case "", "stderr":
+		w = os.Stderr
+
+	case "syslog":
+		facility, err := ParseFacility(opts.Facility)
 		if err != nil {
-			panic(err.Error())
+			return err
 		}
-		lSyslog = l
+		if sys, err = syslog.New(facility|syslog.LOG_INFO, "rrdserver"); err != nil {
+			return fmt.Errorf("Can't connect to syslog: %v", err)
+		}
+
+	case "file":
+		var err error
+		if file, err = OpenFile(opts.File); err != nil {
+			return fmt.Errorf("Can't open log file: %v", err)
+		}
+		w = file
+
+	default:
+		return fmt.Errorf("Unknown log output '%v'", opts.Output)
 	}
-	return lSyslog
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	closeOutput()
+	options, out, lSyslog, lFile = opts, w, sys, file
+	return nil
+}
+
+// Reopen reopens the log file after logrotate.
+func Reopen() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if lFile == nil {
+		return nil
+	}
+	return lFile.Reopen()
+}
+
+// closeOutput closes syslog and the log file, the rest of the messages go
+// to stderr. The mutex should be locked.
+func closeOutput() {
+	if lSyslog != nil {
+		lSyslog.Close()
+	}
+	if lFile != nil {
+		lFile.Close()
+	}
+	out, lSyslog, lFile = os.Stderr, nil, nil
+}
+
+// formatMessage returns the message of the level, syslog adds the time
+// itself.
+func formatMessage(level Level, msg string, withTime bool) string {
+	if options.JSON {
+		rec := struct {
+			Time    *time.Time `json:"time,omitempty"`
+			Level   string     `json:"level"`
+			Message string     `json:"message"`
+		}{Level: strings.ToLower(level.String()), Message: msg}
+
+		if withTime {
+			now := time.Now()
+			rec.Time = &now
+		}
+
+		data, _ := json.Marshal(rec)
+		return string(data)
+	}
+
+	if withTime {
+		return time.Now().Format("2006-01-02T15:04:05.000Z07:00") + " " + level.String() + ": " + msg
+	}
+	return level.String() + ": " + msg
+}
+
+func write(level Level, format string, args ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if level < options.Level {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if lSyslog == nil {
+		fmt.Fprintln(out, formatMessage(level, msg, true))
+		return
+	}
+
+	msg = formatMessage(level, msg, false)
+	switch level {
+	case LevelDebug:
+		lSyslog.Debug(msg)
+	case LevelInfo:
+		lSyslog.Info(msg)
+	case LevelWarning:
+		lSyslog.Warning(msg)
+	default:
+		lSyslog.Err(msg)
+	}
+}
+
+func Debug(format string, args ...interface{}) {
+	write(LevelDebug, format, args...)
 }
 
 func Info(format string, args ...interface{}) {
-	fmt.Println("Info: " + fmt.Sprintf(format, args...))
-	Log().Info(fmt.Sprintf("Info: "+format, args...))
+	write(LevelInfo, format, args...)
 }
 
 func Warning(format string, args ...interface{}) {
-	fmt.Println("Warning: " + fmt.Sprintf(format, args...))
-	Log().Warning("Warning: " + fmt.Sprintf(format, args...))
+	write(LevelWarning, format, args...)
 }
 
 func Error(format string, args ...interface{}) {
-	fmt.Printf("Error: " + fmt.Sprintf(format, args...))
-	Log().Err("Error: " + fmt.Sprintf(format, args...))
+	write(LevelError, format, args...)
 }
 
+// Fatal logs the error, closes the output and exits.
 func Fatal(format string, args ...interface{}) {
 	Error(format, args...)
+
+	mutex.Lock()
+	closeOutput()
+	mutex.Unlock()
+
 	os.Exit(2)
 }
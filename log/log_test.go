@@ -0,0 +1,94 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParse(test *testing.T) {
+	levels := map[string]Level{"": LevelInfo, "debug": LevelDebug, "INFO": LevelInfo, "warn": LevelWarning, "warning": LevelWarning, "error": LevelError}
+	for s, want := range levels {
+		if l, err := ParseLevel(s); err != nil || l != want {
+			test.Errorf("Level '%v'\nResult: %v %v\nWant:   %v\n", s, l, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		test.Errorf("Error expected for the unknown level")
+	}
+
+	facilities := map[string]syslog.Priority{"": syslog.LOG_DAEMON, "local0": syslog.LOG_LOCAL0, "LOG_AUTH": syslog.LOG_AUTH}
+	for s, want := range facilities {
+		if f, err := ParseFacility(s); err != nil || f != want {
+			test.Errorf("Facility '%v'\nResult: %v %v\nWant:   %v\n", s, f, err, want)
+		}
+	}
+	if _, err := ParseFacility("local9"); err == nil {
+		test.Errorf("Error expected for the unknown facility")
+	}
+}
+
+func TestSetup(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdserver")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer Setup(Options{Level: LevelInfo})
+
+	if err := Setup(Options{Level: LevelWarning, Output: "file", File: dir + "/rrdserver.log"}); err != nil {
+		test.Fatalf("Can't set up file output: %v", err)
+	}
+
+	Info("skipped")
+	Warning("disk %v is full", "sda")
+	Error("can't write")
+
+	data, _ := ioutil.ReadFile(dir + "/rrdserver.log")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " Warning: disk sda is full") || !strings.HasSuffix(lines[1], " Error: can't write") {
+		test.Errorf("Incorrect text log:\n%s", data)
+	}
+
+	// The file is kept if the new output can't be opened.
+	if err := Setup(Options{Output: "file", File: dir + "/missing/rrdserver.log"}); err == nil {
+		test.Errorf("Error expected for the missing directory")
+	}
+	if err := Setup(Options{Output: "console"}); err == nil {
+		test.Errorf("Error expected for the unknown output")
+	}
+	Warning("kept")
+
+	if err := Setup(Options{Level: LevelDebug, Output: "file", File: dir + "/rrdserver.json", JSON: true}); err != nil {
+		test.Fatalf("Can't set up JSON output: %v", err)
+	}
+	Debug("query %v", 1)
+
+	if err := os.Rename(dir+"/rrdserver.json", dir+"/rrdserver.json.1"); err != nil {
+		test.Fatalf("Can't rename file: %v", err)
+	}
+	if err := Reopen(); err != nil {
+		test.Fatalf("Can't reopen file: %v", err)
+	}
+	Info("reopened")
+
+	data, _ = ioutil.ReadFile(dir + "/rrdserver.log")
+	if !strings.HasSuffix(strings.TrimSpace(string(data)), " Warning: kept") {
+		test.Errorf("The file is lost after the failed setup:\n%s", data)
+	}
+
+	for name, want := range map[string]string{"rrdserver.json.1": "debug query 1", "rrdserver.json": "info reopened"} {
+		data, _ := ioutil.ReadFile(dir + "/" + name)
+		rec := struct {
+			Time    string `json:"time"`
+			Level   string `json:"level"`
+			Message string `json:"message"`
+		}{}
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Time == "" || rec.Level+" "+rec.Message != want {
+			test.Errorf("%v\nResult: %s %v\nWant:   %v\n", name, data, err, want)
+		}
+	}
+}
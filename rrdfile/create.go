@@ -0,0 +1,215 @@
+package rrdfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	liveHeadSize = 16
+
+	// Scratch values of pdp_prep and cdp_prep.
+	pdpUnknownSec = 32
+	pdpValue      = 40
+	cdpValue      = 0
+	cdpUnknownPDP = 8
+	cdpPrimary    = 64
+	cdpSecondary  = 72
+)
+
+// layout is the offsets of the header parts of the version 3 and later
+// files, data is the offset of the first RRA.
+type layout struct {
+	dsCnt, rraCnt int64
+
+	ds, rra, live, pdp, cdp, ptr, data int64
+}
+
+func newLayout(dsCnt, rraCnt int) layout {
+	l := layout{dsCnt: int64(dsCnt), rraCnt: int64(rraCnt)}
+	l.ds = statHeadSize
+	l.rra = l.ds + l.dsCnt*dsDefSize
+	l.live = l.rra + l.rraCnt*rraDefSize
+	l.pdp = l.live + liveHeadSize
+	l.cdp = l.pdp + l.dsCnt*pdpPrepSize
+	l.ptr = l.cdp + l.rraCnt*l.dsCnt*cdpPrepSize
+	l.data = l.ptr + l.rraCnt*rraPtrSize
+	return l
+}
+
+func (l layout) pdpPrep(ds int) int {
+	return int(l.pdp) + ds*pdpPrepSize
+}
+
+func (l layout) cdpPrep(rra, ds int) int {
+	return int(l.cdp) + (rra*int(l.dsCnt)+ds)*cdpPrepSize
+}
+
+// header is the header of the file in the writable form.
+type header struct {
+	reader
+	layout
+}
+
+func (h header) putStr(offset, size int, s string) {
+	b := h.buf[offset : offset+size]
+	for i := range b {
+		b[i] = 0
+	}
+	copy(b[:size-1], s)
+}
+
+func (h header) putUint(offset int, v uint64) {
+	h.order.PutUint64(h.buf[offset:], v)
+}
+
+func (h header) putFloat(offset int, v float64) {
+	h.putUint(offset, math.Float64bits(v))
+}
+
+func isCounter(dsType string) bool {
+	switch dsType {
+	case "COUNTER", "DERIVE", "DCOUNTER", "DDERIVE":
+		return true
+	}
+	return false
+}
+
+func checkDefs(ds []DS, rra []RRA) error {
+	if len(ds) == 0 || len(rra) == 0 {
+		return fmt.Errorf("RRD file should have data sources and archives")
+	}
+
+	for _, d := range ds {
+		if d.Name == "" || len(d.Name) > 19 {
+			return fmt.Errorf("Incorrect DS name '%v'", d.Name)
+		}
+		switch d.Type {
+		case "GAUGE", "ABSOLUTE":
+		default:
+			if !isCounter(d.Type) {
+				return fmt.Errorf("Unsupported DS type '%v'", d.Type)
+			}
+		}
+		if d.Heartbeat == 0 {
+			return fmt.Errorf("Heartbeat of DS '%v' should be positive", d.Name)
+		}
+	}
+
+	for _, r := range rra {
+		switch r.CF {
+		case "AVERAGE", "MIN", "MAX", "LAST":
+		default:
+			return fmt.Errorf("Unsupported CF '%v'", r.CF)
+		}
+		if r.Rows == 0 || r.PDPPerRow == 0 || r.XFF < 0 || r.XFF >= 1 {
+			return fmt.Errorf("Incorrect RRA %v:%v:%v:%v", r.CF, r.XFF, r.PDPPerRow, r.Rows)
+		}
+	}
+	return nil
+}
+
+// Create creates the RRD file the same way as rrd_create, the data before
+// start isn't accepted. The files are written in the native layout of the
+// platform.
+func Create(name string, start time.Time, step uint64, ds []DS, rra []RRA) error {
+	if step == 0 {
+		return fmt.Errorf("Step should be positive")
+	}
+	if err := checkDefs(ds, rra); err != nil {
+		return err
+	}
+
+	l := newLayout(len(ds), len(rra))
+	h := header{reader: reader{buf: make([]byte, l.data), order: binary.NativeEndian}, layout: l}
+
+	version := "0003"
+	for _, d := range ds {
+		if strings.HasPrefix(d.Type, "D") {
+			version = "0004"
+		}
+	}
+
+	copy(h.buf, cookie)
+	copy(h.buf[4:], version)
+	h.putFloat(16, floatCookie)
+	h.putUint(24, uint64(len(ds)))
+	h.putUint(32, uint64(len(rra)))
+	h.putUint(40, step)
+
+	for i, d := range ds {
+		o := int(l.ds) + i*dsDefSize
+		h.putStr(o, 20, d.Name)
+		h.putStr(o+20, 20, d.Type)
+		h.putUint(o+40, d.Heartbeat)
+		h.putFloat(o+48, d.Min)
+		h.putFloat(o+56, d.Max)
+	}
+
+	for i, r := range rra {
+		o := int(l.rra) + i*rraDefSize
+		h.putStr(o, 20, r.CF)
+		h.putUint(o+24, r.Rows)
+		h.putUint(o+32, r.PDPPerRow)
+		h.putFloat(o+40, r.XFF)
+	}
+
+	last := uint64(start.Unix())
+	h.putUint(int(l.live), last)
+
+	unknownSec := last % step
+	for i := range ds {
+		o := l.pdpPrep(i)
+		h.putStr(o, 30, "U")
+		h.putUint(o+pdpUnknownSec, unknownSec)
+		h.putFloat(o+pdpValue, 0)
+	}
+
+	for j, r := range rra {
+		for i := range ds {
+			o := l.cdpPrep(j, i)
+			h.putFloat(o+cdpValue, math.NaN())
+			h.putUint(o+cdpUnknownPDP, ((last-unknownSec)%(step*r.PDPPerRow))/step)
+			h.putFloat(o+cdpPrimary, math.NaN())
+			h.putFloat(o+cdpSecondary, math.NaN())
+		}
+		h.putUint(int(l.ptr)+j*rraPtrSize, r.Rows-1)
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	// The updates of the new file fail until it's written.
+	if err := lock(f); err != nil {
+		f.Close()
+		os.Remove(name)
+		return fmt.Errorf("Can't lock %s file: %v", name, err)
+	}
+
+	w := bufio.NewWriter(f)
+	w.Write(h.buf)
+
+	nan := make([]byte, valueSize)
+	h.order.PutUint64(nan, math.Float64bits(math.NaN()))
+	for _, r := range rra {
+		for n := uint64(0); n < r.Rows*uint64(len(ds)); n++ {
+			w.Write(nan)
+		}
+	}
+
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return fmt.Errorf("Can't write %s file: %v", name, err)
+	}
+	return nil
+}
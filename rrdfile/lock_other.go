@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package rrdfile
+
+import "os"
+
+// lock does nothing, there are no fcntl locks on this platform.
+func lock(f *os.File) error {
+	return nil
+}
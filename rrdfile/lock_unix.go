@@ -0,0 +1,20 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package rrdfile
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lock takes the write lock of the whole file the same way as rrd_lock, so
+// the updates don't interleave with the ones of rrdtool and collectd. The
+// lock doesn't wait and it's released when the file is closed.
+func lock(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+	})
+}
@@ -0,0 +1,72 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package rrdfile
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestLockHelper holds the lock of the file in the other process, the fcntl
+// locks of the same process don't conflict.
+func TestLockHelper(test *testing.T) {
+	name := os.Getenv("RRDFILE_LOCK_HELPER")
+	if name == "" {
+		return
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		test.Fatalf("Can't open test file: %v", err)
+	}
+	defer f.Close()
+	if err := lock(f); err != nil {
+		test.Fatalf("Can't lock test file: %v", err)
+	}
+	os.Stdout.WriteString("locked\n")
+	ioutil.ReadAll(os.Stdin)
+}
+
+func TestUpdateLock(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdfile")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := dir + "/test.rrd"
+	start := time.Unix(1000000000, 0)
+	ds := []DS{{Name: "gauge", Type: "GAUGE", Heartbeat: 20, Min: math.NaN(), Max: math.NaN()}}
+	rra := []RRA{{CF: "AVERAGE", XFF: 0.5, PDPPerRow: 1, Rows: 10}}
+	if err := Create(name, start, 10, ds, rra); err != nil {
+		test.Fatalf("Can't create test file: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "RRDFILE_LOCK_HELPER="+name)
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		test.Fatalf("Can't start helper: %v", err)
+	}
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		stdin.Close()
+		cmd.Wait()
+		test.Fatalf("Helper didn't lock the file: %q", line)
+	}
+
+	if err := Update(name, start.Add(10*time.Second), []string{"gauge"}, []string{"1"}); err == nil {
+		test.Errorf("The locked file is updated")
+	}
+
+	stdin.Close()
+	cmd.Wait()
+	if err := Update(name, start.Add(10*time.Second), []string{"gauge"}, []string{"1"}); err != nil {
+		test.Errorf("Can't update the unlocked file: %v", err)
+	}
+}
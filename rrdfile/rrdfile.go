@@ -0,0 +1,377 @@
+// Package rrdfile reads and writes RRD files without librrd.
+//
+// Only the native layout of the 64 bit platforms (LP64) is supported,
+// both little and big endian files are detected by the float cookie.
+package rrdfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	cookie      = "RRD\x00"
+	floatCookie = 8.642135e130
+
+	statHeadSize = 128
+	dsDefSize    = 120
+	rraDefSize   = 120
+	pdpPrepSize  = 112
+	cdpPrepSize  = 80
+	rraPtrSize   = 8
+	valueSize    = 8
+)
+
+type DS struct {
+	Name      string
+	Type      string
+	Heartbeat uint64
+	Min       float64
+	Max       float64
+	LastDS    string
+	Value     float64
+	Unknown   uint64
+}
+
+type RRA struct {
+	CF        string
+	Rows      uint64
+	PDPPerRow uint64
+	XFF       float64
+	CurRow    uint64
+
+	offset int64
+}
+
+type File struct {
+	Name       string
+	Version    int
+	Step       uint64
+	LastUpdate time.Time
+	DS         []DS
+	RRA        []RRA
+
+	order binary.ByteOrder
+}
+
+type reader struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (r reader) str(offset, size int) string {
+	b := r.buf[offset : offset+size]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (r reader) uint(offset int) uint64 {
+	return r.order.Uint64(r.buf[offset:])
+}
+
+func (r reader) float(offset int) float64 {
+	return math.Float64frombits(r.order.Uint64(r.buf[offset:]))
+}
+
+func readAt(f *os.File, offset int64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("unexpected end of file")
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Open reads the header of the RRD file, the data is read by Fetch.
+func Open(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res, err := readHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s file: %v", name, err)
+	}
+	res.Name = name
+	return res, nil
+}
+
+func readHeader(f *os.File) (*File, error) {
+	buf, err := readAt(f, 0, statHeadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(buf[:4]) != cookie {
+		return nil, errors.New("not an RRD file")
+	}
+
+	res := &File{}
+	r := reader{buf: buf}
+
+	if res.Version, err = strconv.Atoi(r.str(4, 5)); err != nil || res.Version < 1 || res.Version > 5 {
+		return nil, fmt.Errorf("unsupported version '%v'", r.str(4, 5))
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		r.order = order
+		if r.float(16) == floatCookie {
+			res.order = order
+			break
+		}
+	}
+	if res.order == nil {
+		return nil, errors.New("unsupported platform layout (float cookie mismatch)")
+	}
+
+	dsCnt := r.uint(24)
+	rraCnt := r.uint(32)
+	res.Step = r.uint(40)
+
+	if dsCnt == 0 || dsCnt > 1<<16 || rraCnt == 0 || rraCnt > 1<<16 || res.Step == 0 {
+		return nil, errors.New("corrupted header")
+	}
+
+	offset := int64(statHeadSize)
+
+	// DS definitions .................
+	if buf, err = readAt(f, offset, int(dsCnt)*dsDefSize); err != nil {
+		return nil, err
+	}
+	r.buf = buf
+	for i := 0; i < int(dsCnt); i++ {
+		o := i * dsDefSize
+		res.DS = append(res.DS, DS{
+			Name:      r.str(o, 20),
+			Type:      r.str(o+20, 20),
+			Heartbeat: r.uint(o + 40),
+			Min:       r.float(o + 48),
+			Max:       r.float(o + 56),
+		})
+	}
+	offset += int64(dsCnt) * dsDefSize
+
+	// RRA definitions ................
+	if buf, err = readAt(f, offset, int(rraCnt)*rraDefSize); err != nil {
+		return nil, err
+	}
+	r.buf = buf
+	for i := 0; i < int(rraCnt); i++ {
+		o := i * rraDefSize
+		res.RRA = append(res.RRA, RRA{
+			CF:        r.str(o, 20),
+			Rows:      r.uint(o + 24),
+			PDPPerRow: r.uint(o + 32),
+			XFF:       r.float(o + 40),
+		})
+	}
+	offset += int64(rraCnt) * rraDefSize
+
+	// Live head ......................
+	liveHeadSize := 16
+	if res.Version < 3 {
+		liveHeadSize = 8
+	}
+	if buf, err = readAt(f, offset, liveHeadSize); err != nil {
+		return nil, err
+	}
+	r.buf = buf
+	usec := int64(0)
+	if res.Version >= 3 {
+		usec = int64(r.uint(8))
+	}
+	res.LastUpdate = time.Unix(int64(r.uint(0)), usec*1000)
+	offset += int64(liveHeadSize)
+
+	// PDP prep .......................
+	if buf, err = readAt(f, offset, int(dsCnt)*pdpPrepSize); err != nil {
+		return nil, err
+	}
+	r.buf = buf
+	for i := range res.DS {
+		o := i * pdpPrepSize
+		res.DS[i].LastDS = r.str(o, 30)
+		res.DS[i].Unknown = r.uint(o + 32)
+		res.DS[i].Value = r.float(o + 40)
+	}
+	offset += int64(dsCnt) * pdpPrepSize
+
+	// CDP prep .......................
+	offset += int64(rraCnt*dsCnt) * cdpPrepSize
+
+	// RRA pointers ...................
+	if buf, err = readAt(f, offset, int(rraCnt)*rraPtrSize); err != nil {
+		return nil, err
+	}
+	r.buf = buf
+	for i := range res.RRA {
+		res.RRA[i].CurRow = r.uint(i * rraPtrSize)
+	}
+	offset += int64(rraCnt) * rraPtrSize
+
+	// Ring buffers ...................
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for i := range res.RRA {
+		if res.RRA[i].Rows == 0 || res.RRA[i].CurRow >= res.RRA[i].Rows {
+			return nil, errors.New("corrupted RRA pointers")
+		}
+		if offset > info.Size() || res.RRA[i].Rows > uint64(info.Size()-offset)/(dsCnt*valueSize) {
+			return nil, errors.New("RRA is larger than the file")
+		}
+		res.RRA[i].offset = offset
+		offset += int64(res.RRA[i].Rows*dsCnt) * valueSize
+	}
+
+	return res, nil
+}
+
+func (f *File) DSNames() []string {
+	res := make([]string, len(f.DS))
+	for i, ds := range f.DS {
+		res[i] = ds.Name
+	}
+	return res
+}
+
+type FetchResult struct {
+	Start   time.Time
+	End     time.Time
+	Step    time.Duration
+	DsNames []string
+	RowCnt  int
+	values  []float64
+}
+
+// ValueAt returns the value of the row which ends at Start + (rowIndex+1)*Step.
+func (r *FetchResult) ValueAt(dsIndex, rowIndex int) float64 {
+	return r.values[len(r.DsNames)*rowIndex+dsIndex]
+}
+
+// chooseRRA picks the archive the same way rrd_fetch does: the one which
+// covers the whole interval with the step closest to the requested one,
+// otherwise the one with the best coverage.
+func (f *File) chooseRRA(cf string, start, end, step int64) (int, error) {
+	last := f.LastUpdate.Unix()
+
+	bestFull, bestPart := -1, -1
+	var bestFullDiff, bestPartDiff, bestMatch int64
+
+	for i, rra := range f.RRA {
+		if rra.CF != cf {
+			continue
+		}
+
+		rraStep := int64(rra.PDPPerRow * f.Step)
+		calEnd := last - last%rraStep
+		calStart := calEnd - rraStep*int64(rra.Rows)
+
+		diff := step - rraStep
+		if diff < 0 {
+			diff = -diff
+		}
+
+		if calStart <= start {
+			if bestFull < 0 || diff < bestFullDiff {
+				bestFull, bestFullDiff = i, diff
+			}
+			continue
+		}
+
+		match := end - start - (calStart - start)
+		if bestPart < 0 || bestMatch < match || (bestMatch == match && diff < bestPartDiff) {
+			bestPart, bestMatch, bestPartDiff = i, match, diff
+		}
+	}
+
+	if bestFull >= 0 {
+		return bestFull, nil
+	}
+
+	if bestPart >= 0 {
+		return bestPart, nil
+	}
+
+	return 0, fmt.Errorf("The RRD file %s does not contain an RRA matching the chosen CF %v", f.Name, cf)
+}
+
+// Fetch reads the data for (start, end] the same way as rrd_fetch.
+func (f *File) Fetch(cf string, start, end time.Time, step time.Duration) (*FetchResult, error) {
+	s, e := start.Unix(), end.Unix()
+	if e < s {
+		return nil, fmt.Errorf("Start (%v) should be less than end (%v)", start, end)
+	}
+
+	idx, err := f.chooseRRA(cf, s, e, int64(step/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	rra := f.RRA[idx]
+
+	rraStep := int64(rra.PDPPerRow * f.Step)
+	s -= s % rraStep
+	if e%rraStep != 0 {
+		e += rraStep - e%rraStep
+	}
+
+	dsCnt := len(f.DS)
+	res := &FetchResult{
+		Start:   time.Unix(s, 0),
+		End:     time.Unix(e, 0),
+		Step:    time.Duration(rraStep) * time.Second,
+		DsNames: f.DSNames(),
+		RowCnt:  int((e - s) / rraStep),
+	}
+	res.values = make([]float64, res.RowCnt*dsCnt)
+	for i := range res.values {
+		res.values[i] = math.NaN()
+	}
+
+	last := f.LastUpdate.Unix()
+	rraEnd := last - last%rraStep
+	rraStart := rraEnd - rraStep*int64(rra.Rows-1)
+
+	// Index of the first requested row in the archive, counted from the oldest one.
+	first := (s + rraStep - rraStart) / rraStep
+
+	file, err := os.Open(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := readAt(file, rra.offset, int(rra.Rows)*dsCnt*valueSize)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s file: %v", f.Name, err)
+	}
+	r := reader{buf: data, order: f.order}
+
+	for n := 0; n < res.RowCnt; n++ {
+		i := first + int64(n)
+		if i < 0 || i >= int64(rra.Rows) {
+			continue
+		}
+
+		row := (int64(rra.CurRow) + 1 + i) % int64(rra.Rows)
+		for d := 0; d < dsCnt; d++ {
+			res.values[n*dsCnt+d] = r.float(int(row)*dsCnt*valueSize + d*valueSize)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,235 @@
+package rrdfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testRRA struct {
+	cf     string
+	pdp    uint64
+	curRow uint64
+	rows   [][]float64
+}
+
+// writeTestFile writes the RRD file in the LP64 layout, rows of every RRA
+// are given in the on-disk (ring buffer) order.
+func writeTestFile(name string, order binary.ByteOrder, step uint64, lastUp int64, ds []string, rras []testRRA) error {
+	buf := []byte{}
+
+	str := func(s string, size int) {
+		b := make([]byte, size)
+		copy(b, s)
+		buf = append(buf, b...)
+	}
+	u64 := func(v uint64) {
+		b := make([]byte, 8)
+		order.PutUint64(b, v)
+		buf = append(buf, b...)
+	}
+	f64 := func(v float64) {
+		u64(math.Float64bits(v))
+	}
+	pad := func(size int) {
+		buf = append(buf, make([]byte, size)...)
+	}
+
+	// Static header
+	str(cookie, 4)
+	str("0003", 5)
+	pad(7)
+	f64(floatCookie)
+	u64(uint64(len(ds)))
+	u64(uint64(len(rras)))
+	u64(step)
+	pad(80)
+
+	for _, d := range ds {
+		str(d, 20)
+		str("GAUGE", 20)
+		u64(step * 2)
+		f64(math.NaN())
+		f64(math.NaN())
+		pad(56)
+	}
+
+	for _, r := range rras {
+		str(r.cf, 20)
+		pad(4)
+		u64(uint64(len(r.rows)))
+		u64(r.pdp)
+		f64(0.5)
+		pad(72)
+	}
+
+	// Live head
+	u64(uint64(lastUp))
+	u64(0)
+
+	for range ds {
+		str("UNKN", 30)
+		pad(2)
+		u64(0)
+		f64(0)
+		pad(64)
+	}
+
+	pad(len(rras) * len(ds) * cdpPrepSize)
+
+	for _, r := range rras {
+		u64(r.curRow)
+	}
+
+	for _, r := range rras {
+		for _, row := range r.rows {
+			for _, v := range row {
+				f64(v)
+			}
+		}
+	}
+
+	return ioutil.WriteFile(name, buf, 0600)
+}
+
+func TestOpen(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdfile")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nan := math.NaN()
+	rras := []testRRA{
+		{"AVERAGE", 1, 1, [][]float64{{3, 30}, {4, 40}, {nan, nan}, {1, 10}, {2, 20}}},
+		{"MAX", 2, 0, [][]float64{{9, 90}, {7, 70}, {8, 80}}},
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		name := fmt.Sprintf("%s/%v.rrd", dir, order)
+		if err := writeTestFile(name, order, 60, 1000000230, []string{"rx", "tx"}, rras); err != nil {
+			test.Fatalf("Can't write test file: %v", err)
+		}
+
+		f, err := Open(name)
+		if err != nil {
+			test.Fatalf("Can't open test file: %v", err)
+		}
+
+		if f.Step != 60 || f.Version != 3 || f.LastUpdate.Unix() != 1000000230 {
+			test.Errorf("%v: incorrect header %+v", order, f)
+		}
+
+		if !reflect.DeepEqual(f.DSNames(), []string{"rx", "tx"}) || f.DS[0].Type != "GAUGE" || f.DS[0].Heartbeat != 120 {
+			test.Errorf("%v: incorrect DS %+v", order, f.DS)
+		}
+
+		if len(f.RRA) != 2 || f.RRA[0].CF != "AVERAGE" || f.RRA[0].Rows != 5 || f.RRA[0].CurRow != 1 ||
+			f.RRA[1].CF != "MAX" || f.RRA[1].PDPPerRow != 2 || f.RRA[1].XFF != 0.5 {
+			test.Errorf("%v: incorrect RRA %+v", order, f.RRA)
+		}
+	}
+
+	// The rows of the first RRA don't fit into the file.
+	name := dir + "/rows.rrd"
+	if err := writeTestFile(name, binary.LittleEndian, 60, 1000000230, []string{"rx", "tx"}, rras); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		test.Fatalf("Can't read test file: %v", err)
+	}
+	binary.LittleEndian.PutUint64(data[statHeadSize+2*dsDefSize+24:], 1<<60)
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if _, err := Open(name); err == nil {
+		test.Errorf("Error expected for the corrupted rows count")
+	}
+
+	if err := ioutil.WriteFile(dir+"/bad.rrd", []byte("not an rrd file at all"), 0600); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if _, err := Open(dir + "/bad.rrd"); err == nil {
+		test.Errorf("Error expected for the incorrect file")
+	}
+}
+
+func TestFetch(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdfile")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Last update 1000000230 => the AVERAGE rows (oldest first) end at
+	// 999999960, 1000000020, 1000000080, 1000000140 and 1000000200.
+	nan := math.NaN()
+	rras := []testRRA{
+		{"AVERAGE", 1, 1, [][]float64{{4, 40}, {5, 50}, {1, 10}, {2, 20}, {3, nan}}},
+		{"MAX", 2, 0, [][]float64{{9, 90}, {7, 70}, {8, 80}}},
+	}
+
+	name := dir + "/test.rrd"
+	if err := writeTestFile(name, binary.LittleEndian, 60, 1000000230, []string{"rx", "tx"}, rras); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+
+	f, err := Open(name)
+	if err != nil {
+		test.Fatalf("Can't open test file: %v", err)
+	}
+
+	cases := []struct {
+		cf         string
+		start, end int64
+		step       time.Duration
+		wantStart  int64
+		wantStep   time.Duration
+		want       [][]float64
+	}{
+		// The first row ends at start + step, the last one at the end.
+		{"AVERAGE", 999999960, 1000000200, time.Second, 999999960, time.Minute,
+			[][]float64{{2, 20}, {3, nan}, {4, 40}, {5, 50}}},
+
+		{"AVERAGE", 1000000061, 1000000170, time.Second, 1000000020, time.Minute,
+			[][]float64{{3, nan}, {4, 40}, {5, 50}}},
+
+		{"AVERAGE", 1000000120, 1000000330, time.Second, 1000000080, time.Minute,
+			[][]float64{{4, 40}, {5, 50}, {nan, nan}, {nan, nan}, {nan, nan}}},
+
+		{"AVERAGE", 999999840, 999999960, time.Second, 999999840, time.Minute,
+			[][]float64{{nan, nan}, {1, 10}}},
+
+		// The MAX rows end at 999999960, 1000000080 and 1000000200.
+		{"MAX", 999999900, 1000000190, time.Second, 999999840, 2 * time.Minute,
+			[][]float64{{7, 70}, {8, 80}, {9, 90}}},
+	}
+
+	for _, c := range cases {
+		res, err := f.Fetch(c.cf, time.Unix(c.start, 0), time.Unix(c.end, 0), c.step)
+		if err != nil {
+			test.Errorf("Fetch %v %v-%v: %v", c.cf, c.start, c.end, err)
+			continue
+		}
+
+		got := [][]float64{}
+		for r := 0; r < res.RowCnt; r++ {
+			got = append(got, []float64{res.ValueAt(0, r), res.ValueAt(1, r)})
+		}
+
+		if res.Start.Unix() != c.wantStart || res.Step != c.wantStep || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			test.Errorf("Fetch %v %v-%v:\nResult: %v %v %v\nWant:   %v %v %v\n", c.cf, c.start, c.end,
+				res.Start.Unix(), res.Step, got, c.wantStart, c.wantStep, c.want)
+		}
+	}
+
+	if _, err := f.Fetch("LAST", time.Unix(999999960, 0), time.Unix(1000000200, 0), time.Second); err == nil {
+		test.Errorf("Error expected for the missing CF")
+	}
+}
@@ -0,0 +1,359 @@
+package rrdfile
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var integerValue = regexp.MustCompile(`^[-+]?[0-9]+$`)
+
+// newPDP returns the value of the new PDP of the data source, it's NaN for
+// the unknown value and the rate out of the limits.
+func newPDP(ds DS, lastDS, value string, interval float64) (float64, error) {
+	if value == "U" || interval > float64(ds.Heartbeat) {
+		return math.NaN(), nil
+	}
+
+	var pdp float64
+	switch ds.Type {
+	case "COUNTER", "DERIVE":
+		if !integerValue.MatchString(value) {
+			return 0, fmt.Errorf("not a simple %s integer: '%s'", ds.Type, value)
+		}
+		if lastDS == "U" {
+			return math.NaN(), nil
+		}
+
+		n, ok := new(big.Int).SetString(value, 10)
+		prev, prevOk := new(big.Int).SetString(lastDS, 10)
+		if !ok || !prevOk {
+			return math.NaN(), nil
+		}
+		diff := n.Sub(n, prev)
+
+		// Counter wraps at 32 or 64 bits.
+		if ds.Type == "COUNTER" && diff.Sign() < 0 {
+			diff.Add(diff, new(big.Int).Lsh(big.NewInt(1), 32))
+			if diff.Sign() < 0 {
+				diff.Add(diff, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 64), new(big.Int).Lsh(big.NewInt(1), 32)))
+			}
+		}
+		pdp, _ = new(big.Float).SetInt(diff).Float64()
+
+	case "DCOUNTER", "DDERIVE":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("conversion of '%s' to float not complete", value)
+		}
+		if lastDS == "U" {
+			return math.NaN(), nil
+		}
+		prev, err := strconv.ParseFloat(lastDS, 64)
+		if err != nil {
+			return math.NaN(), nil
+		}
+
+		// The counter reset is unknown, it doesn't wrap.
+		pdp = v - prev
+		if ds.Type == "DCOUNTER" && pdp < 0 {
+			return math.NaN(), nil
+		}
+
+	case "ABSOLUTE", "GAUGE":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("conversion of '%s' to float not complete", value)
+		}
+		pdp = v
+		if ds.Type == "GAUGE" {
+			pdp = v * interval
+		}
+
+	default:
+		return 0, fmt.Errorf("unsupported DS type '%v'", ds.Type)
+	}
+
+	rate := pdp / interval
+	if (!math.IsNaN(ds.Max) && rate > ds.Max) || (!math.IsNaN(ds.Min) && rate < ds.Min) {
+		return math.NaN(), nil
+	}
+	return pdp, nil
+}
+
+// Update adds the values of the data sources at the time t the same way as
+// rrd_update, the names are the template, the values are numbers or "U" and
+// the missing data sources are unknown.
+func Update(name string, t time.Time, names []string, values []string) error {
+	if len(names) != len(values) {
+		return errors.New("expected a value for every data source")
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lock(f); err != nil {
+		return fmt.Errorf("Can't lock %s file: %v", name, err)
+	}
+
+	file, err := readHeader(f)
+	if err != nil {
+		return fmt.Errorf("Can't read %s file: %v", name, err)
+	}
+	if file.Version < 3 {
+		return fmt.Errorf("Can't update %s file: version %v isn't supported", name, file.Version)
+	}
+	for _, rra := range file.RRA {
+		switch rra.CF {
+		case "AVERAGE", "MIN", "MAX", "LAST":
+		default:
+			return fmt.Errorf("Can't update %s file: CF %v isn't supported", name, rra.CF)
+		}
+	}
+
+	l := newLayout(len(file.DS), len(file.RRA))
+	buf, err := readAt(f, 0, int(l.data))
+	if err != nil {
+		return fmt.Errorf("Can't read %s file: %v", name, err)
+	}
+	h := header{reader: reader{buf: buf, order: file.order}, layout: l}
+
+	updates := make([]string, len(file.DS))
+	for i := range updates {
+		updates[i] = "U"
+	}
+	for i, n := range names {
+		found := false
+		for d, ds := range file.DS {
+			if ds.Name == n {
+				updates[d], found = values[i], true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown DS name '%s'", n)
+		}
+	}
+
+	step := int64(file.Step)
+	last := file.LastUpdate.Unix()
+	lastUsec := file.LastUpdate.Nanosecond() / 1000
+	now := t.Unix()
+
+	interval := float64(now-last) - float64(lastUsec)/1e6
+	if interval <= 0 {
+		return fmt.Errorf("illegal attempt to update using time %d when last update time is %d (minimum one second step)", now, last)
+	}
+
+	pdpNew := make([]float64, len(file.DS))
+	for i, ds := range file.DS {
+		if pdpNew[i], err = newPDP(ds, ds.LastDS, updates[i], interval); err != nil {
+			return err
+		}
+		h.putStr(l.pdpPrep(i), 30, updates[i])
+	}
+
+	procPDPSt := last - last%step
+	occuPDPSt := now - now%step
+
+	if occuPDPSt <= procPDPSt {
+		// The same PDP: only the values are accumulated.
+		for i := range file.DS {
+			o := l.pdpPrep(i)
+			if math.IsNaN(pdpNew[i]) {
+				h.putUint(o+pdpUnknownSec, h.uint(o+pdpUnknownSec)+uint64(math.Floor(interval)))
+			} else if v := h.float(o + pdpValue); math.IsNaN(v) {
+				h.putFloat(o+pdpValue, pdpNew[i])
+			} else {
+				h.putFloat(o+pdpValue, v+pdpNew[i])
+			}
+		}
+	} else {
+		preInt := float64(occuPDPSt-last) - float64(lastUsec)/1e6
+		postInt := float64(now % step)
+
+		pdpTemp := make([]float64, len(file.DS))
+		for i, ds := range file.DS {
+			o := l.pdpPrep(i)
+			val := h.float(o + pdpValue)
+			unknown := h.uint(o + pdpUnknownSec)
+
+			preUnknown := 0.0
+			if math.IsNaN(pdpNew[i]) {
+				preUnknown = preInt
+			} else {
+				if math.IsNaN(val) {
+					val = 0
+				}
+				val += pdpNew[i] / interval * preInt
+			}
+
+			if interval > float64(ds.Heartbeat) || float64(step)/2 < float64(unknown) {
+				pdpTemp[i] = math.NaN()
+			} else {
+				pdpTemp[i] = val / (float64(occuPDPSt-procPDPSt-int64(unknown)) - preUnknown)
+			}
+
+			if math.IsNaN(pdpNew[i]) {
+				h.putUint(o+pdpUnknownSec, uint64(math.Floor(postInt)))
+				h.putFloat(o+pdpValue, math.NaN())
+			} else {
+				h.putUint(o+pdpUnknownSec, 0)
+				h.putFloat(o+pdpValue, pdpNew[i]/interval*postInt)
+			}
+		}
+
+		if err := h.updateRRAs(f, file, pdpTemp, uint64(procPDPSt/step), uint64((occuPDPSt-procPDPSt)/step)); err != nil {
+			return fmt.Errorf("Can't update %s file: %v", name, err)
+		}
+	}
+
+	h.putUint(int(l.live), uint64(now))
+	h.putUint(int(l.live)+8, 0)
+
+	if _, err := f.WriteAt(h.buf, 0); err != nil {
+		return fmt.Errorf("Can't update %s file: %v", name, err)
+	}
+	return nil
+}
+
+// updateRRAs consolidates the elapsed PDPs into the CDPs and writes the
+// finished rows.
+func (h header) updateRRAs(f *os.File, file *File, pdpTemp []float64, procPDPCnt, elapsed uint64) error {
+	for j, rra := range file.RRA {
+		offset := rra.PDPPerRow - procPDPCnt%rra.PDPPerRow
+		stepCnt := uint64(0)
+		if elapsed >= offset {
+			stepCnt = (elapsed-offset)/rra.PDPPerRow + 1
+		}
+
+		primary := make([]float64, len(file.DS))
+		secondary := make([]float64, len(file.DS))
+		for i := range file.DS {
+			primary[i], secondary[i] = h.updateCDP(h.cdpPrep(j, i), rra, pdpTemp[i], elapsed, offset, stepCnt)
+		}
+
+		if stepCnt == 0 {
+			continue
+		}
+
+		ptr := int(h.ptr) + j*rraPtrSize
+		row := h.uint(ptr)
+		buf := make([]byte, len(file.DS)*valueSize)
+		for n := uint64(0); n < stepCnt && n < rra.Rows; n++ {
+			values := secondary
+			if n == 0 && stepCnt <= rra.Rows {
+				values = primary
+			}
+			for i, v := range values {
+				h.order.PutUint64(buf[i*valueSize:], math.Float64bits(v))
+			}
+
+			row = (row + 1) % rra.Rows
+			if _, err := f.WriteAt(buf, rra.offset+int64(row)*int64(len(buf))); err != nil {
+				return err
+			}
+		}
+		h.putUint(ptr, row)
+	}
+	return nil
+}
+
+func initialCDP(cf string) float64 {
+	switch cf {
+	case "AVERAGE":
+		return 0
+	case "MAX":
+		return math.Inf(-1)
+	case "MIN":
+		return math.Inf(1)
+	}
+	return math.NaN()
+}
+
+func ifNaN(v, def float64) float64 {
+	if math.IsNaN(v) {
+		return def
+	}
+	return v
+}
+
+// updateCDP returns the primary and the secondary values of the finished
+// rows like update_cdp of rrd_update: the primary one is consolidated from
+// the PDPs of the row, the secondary is the last PDP repeated.
+func (h header) updateCDP(o int, rra RRA, pdpTemp float64, elapsed, offset, stepCnt uint64) (float64, float64) {
+	cdp := h.float(o + cdpValue)
+	unknown := h.uint(o + cdpUnknownPDP)
+
+	if stepCnt == 0 {
+		if math.IsNaN(pdpTemp) {
+			h.putUint(o+cdpUnknownPDP, unknown+elapsed)
+			return 0, 0
+		}
+
+		switch {
+		case math.IsNaN(cdp) && rra.CF == "AVERAGE":
+			cdp = pdpTemp * float64(elapsed)
+		case math.IsNaN(cdp):
+			cdp = pdpTemp
+		case rra.CF == "AVERAGE":
+			cdp += pdpTemp * float64(elapsed)
+		case rra.CF == "MAX":
+			cdp = math.Max(cdp, pdpTemp)
+		case rra.CF == "MIN":
+			cdp = math.Min(cdp, pdpTemp)
+		default:
+			cdp = pdpTemp
+		}
+		h.putFloat(o+cdpValue, cdp)
+		return 0, 0
+	}
+
+	if math.IsNaN(pdpTemp) {
+		unknown += offset
+		h.putFloat(o+cdpSecondary, math.NaN())
+	} else {
+		h.putFloat(o+cdpSecondary, pdpTemp)
+	}
+
+	primary := math.NaN()
+	if float64(unknown) <= float64(rra.PDPPerRow)*rra.XFF {
+		switch rra.CF {
+		case "AVERAGE":
+			primary = (ifNaN(cdp, 0) + ifNaN(pdpTemp, 0)*float64(offset)) / float64(rra.PDPPerRow-unknown)
+		case "MAX":
+			primary = math.Max(ifNaN(cdp, math.Inf(-1)), ifNaN(pdpTemp, math.Inf(-1)))
+		case "MIN":
+			primary = math.Min(ifNaN(cdp, math.Inf(1)), ifNaN(pdpTemp, math.Inf(1)))
+		default:
+			primary = pdpTemp
+		}
+	}
+	h.putFloat(o+cdpPrimary, primary)
+
+	// The PDPs after the last finished row start the next one.
+	into := (elapsed - offset) % rra.PDPPerRow
+	switch {
+	case into == 0 || math.IsNaN(pdpTemp):
+		h.putFloat(o+cdpValue, initialCDP(rra.CF))
+	case rra.CF == "AVERAGE":
+		h.putFloat(o+cdpValue, pdpTemp*float64(into))
+	default:
+		h.putFloat(o+cdpValue, pdpTemp)
+	}
+
+	if math.IsNaN(pdpTemp) {
+		h.putUint(o+cdpUnknownPDP, into)
+	} else {
+		h.putUint(o+cdpUnknownPDP, 0)
+	}
+
+	return primary, h.float(o + cdpSecondary)
+}
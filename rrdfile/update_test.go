@@ -0,0 +1,103 @@
+package rrdfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpdate(test *testing.T) {
+	dir, err := ioutil.TempDir("", "rrdfile")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nan := math.NaN()
+	name := dir + "/test.rrd"
+	start := time.Unix(1000000000, 0)
+
+	ds := []DS{
+		{Name: "gauge", Type: "GAUGE", Heartbeat: 20, Min: nan, Max: nan},
+		{Name: "derive", Type: "DERIVE", Heartbeat: 20, Min: 0, Max: nan},
+		{Name: "dderive", Type: "DDERIVE", Heartbeat: 20, Min: nan, Max: nan},
+	}
+	rra := []RRA{
+		{CF: "AVERAGE", XFF: 0.5, PDPPerRow: 1, Rows: 10},
+		{CF: "MAX", XFF: 0.5, PDPPerRow: 2, Rows: 5},
+	}
+
+	if err := Create(name, start, 10, ds, rra); err != nil {
+		test.Fatalf("Can't create test file: %v", err)
+	}
+	if err := Create(name, start, 10, ds, rra); err == nil {
+		test.Errorf("The existing file is overwritten")
+	}
+
+	updates := [][]string{
+		{"1", "0", "0.5"},
+		{"2", "100", "1.5"},
+		{"3", "300", "3.5"},
+		{"4", "250", "2.5"},
+	}
+	for i, u := range updates {
+		if err := Update(name, start.Add(time.Duration(i+1)*10*time.Second), []string{"gauge", "derive", "dderive"}, u); err != nil {
+			test.Fatalf("Can't update test file: %v", err)
+		}
+	}
+
+	errors := []struct {
+		t      int64
+		names  []string
+		values []string
+	}{
+		{1000000050, []string{"derive"}, []string{"1.5"}},
+		{1000000050, []string{"gauge"}, []string{"1e"}},
+		{1000000050, []string{"missing"}, []string{"1"}},
+		{1000000040, []string{"gauge"}, []string{"1"}},
+	}
+	for _, c := range errors {
+		if err := Update(name, time.Unix(c.t, 0), c.names, c.values); err == nil {
+			test.Errorf("Error expected for %v %v=%v", c.t, c.names, c.values)
+		}
+	}
+
+	f, err := Open(name)
+	if err != nil {
+		test.Fatalf("Can't open test file: %v", err)
+	}
+	if f.Version != 4 || f.LastUpdate.Unix() != 1000000040 || f.DS[1].LastDS != "250" {
+		test.Errorf("Incorrect header %+v", f)
+	}
+
+	cases := []struct {
+		cf   string
+		step time.Duration
+		want [][]float64
+	}{
+		// The DERIVE rate is unknown for the first value and below the minimum
+		// for the last one.
+		{"AVERAGE", 10 * time.Second, [][]float64{{1, nan, nan}, {2, 10, 0.1}, {3, 20, 0.2}, {4, nan, -0.1}}},
+		{"MAX", 20 * time.Second, [][]float64{{2, 10, 0.1}, {4, 20, 0.2}}},
+	}
+
+	for _, c := range cases {
+		res, err := f.Fetch(c.cf, start, time.Unix(1000000039, 0), c.step)
+		if err != nil {
+			test.Errorf("Fetch %v: %v", c.cf, err)
+			continue
+		}
+
+		got := [][]float64{}
+		for r := 0; r < res.RowCnt; r++ {
+			got = append(got, []float64{res.ValueAt(0, r), res.ValueAt(1, r), res.ValueAt(2, r)})
+		}
+
+		if res.Step != c.step || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			test.Errorf("Fetch %v:\nResult: %v %v\nWant:   %v %v\n", c.cf, res.Step, got, c.step, c.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package scrape
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"github.com/rrdserver/rrdserver/writer"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Type   string
+	Value  float64
+}
+
+// ParseTextFormat parses the Prometheus text exposition format. The type of
+// every sample is taken from the "# TYPE" line of its family, samples without
+// a family type are "untyped".
+func ParseTextFormat(r io.Reader) ([]Sample, error) {
+	types := make(map[string]string)
+	res := []Sample{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			items := strings.Fields(line)
+			if len(items) >= 4 && items[1] == "TYPE" {
+				types[items[2]] = items[3]
+			}
+			continue
+		}
+
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		s.Type = sampleType(s.Name, types)
+		res = append(res, s)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func sampleType(name string, types map[string]string) string {
+	if t, ok := types[name]; ok {
+		return t
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if t, ok := types[strings.TrimSuffix(name, suffix)]; ok && strings.HasSuffix(name, suffix) {
+			// Buckets, sums and counts of histograms and summaries are counters.
+			if t == "histogram" || t == "summary" {
+				return "counter"
+			}
+			return t
+		}
+	}
+
+	return "untyped"
+}
+
+func parseSample(line string) (Sample, error) {
+	res := Sample{Labels: make(map[string]string)}
+
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return Sample{}, fmt.Errorf("Incorrect sample '%v'", line)
+	}
+	res.Name = line[:i]
+	rest := line[i:]
+
+	if rest[0] == '{' {
+		end, err := parseLabels(rest, res.Labels)
+		if err != nil {
+			return Sample{}, fmt.Errorf("Incorrect labels in the sample '%v': %v", line, err)
+		}
+		rest = rest[end:]
+	}
+
+	items := strings.Fields(rest)
+	if len(items) < 1 || len(items) > 2 {
+		return Sample{}, fmt.Errorf("Incorrect sample '%v'", line)
+	}
+
+	v, err := parseValue(items[0])
+	if err != nil {
+		return Sample{}, fmt.Errorf("Incorrect value in the sample '%v'", line)
+	}
+	res.Value = v
+
+	return res, nil
+}
+
+func parseValue(s string) (float64, error) {
+	switch s {
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseLabels reads {name="value",...} and returns the position after '}'.
+func parseLabels(s string, labels map[string]string) (int, error) {
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+
+		if i >= len(s) {
+			return 0, fmt.Errorf("unexpected end of labels")
+		}
+
+		if s[i] == '}' {
+			return i + 1, nil
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 {
+			return 0, fmt.Errorf("missing '='")
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+
+		if i >= len(s) || s[i] != '"' {
+			return 0, fmt.Errorf("label value of '%v' isn't quoted", name)
+		}
+		i++
+
+		value := []byte{}
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value = append(value, '\n')
+				default:
+					value = append(value, s[i])
+				}
+				continue
+			}
+			value = append(value, s[i])
+		}
+
+		if i >= len(s) {
+			return 0, fmt.Errorf("unterminated label value of '%v'", name)
+		}
+		i++
+
+		labels[name] = string(value)
+	}
+}
+
+type Job struct {
+	Name        string
+	Targets     []string
+	Interval    time.Duration
+	Allow       []string
+	CounterType string
+}
+
+// Allowed checks the metric name against the job allowlist of shell patterns,
+// an empty list allows everything.
+func (job Job) Allowed(name string) bool {
+	if len(job.Allow) == 0 {
+		return true
+	}
+
+	for _, p := range job.Allow {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type Scraper struct {
+	Prefix string
+	Jobs   []Job
+	Writer writer.Sink
+	Client *http.Client
+}
+
+func NewScraper(w writer.Sink) *Scraper {
+	return &Scraper{
+		Prefix: "prometheus",
+		Writer: w,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *Scraper) Start() {
+	for _, job := range s.Jobs {
+		go s.run(job)
+	}
+}
+
+func (s *Scraper) run(job Job) {
+	log.Info("Scrape job '%v': %d targets every %v", job.Name, len(job.Targets), job.Interval)
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for t := range ticker.C {
+		for _, target := range job.Targets {
+			if err := s.Scrape(job, target, t); err != nil {
+				log.Warning("Can't scrape '%v' for job '%v': %v", target, job.Name, err)
+			}
+		}
+	}
+}
+
+func (s *Scraper) Scrape(job Job, target string, t time.Time) error {
+	resp, err := s.Client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %v", resp.Status)
+	}
+
+	samples, err := ParseTextFormat(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	instance := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		instance = u.Host
+	}
+
+	for _, sample := range samples {
+		if !job.Allowed(sample.Name) {
+			continue
+		}
+
+		metric := s.Metric(job, instance, sample)
+		ds := writer.DataSource{
+			Name:  "value",
+			Type:  DSType(sample.Type, job.CounterType),
+			Value: sample.Value,
+		}
+
+		if err := s.Writer.Write(metric, t, []writer.DataSource{ds}); err != nil {
+			log.Warning("Can't write scraped metric '%v': %v", metric, err)
+		}
+	}
+
+	return nil
+}
+
+// Metric maps a sample to <prefix>/<job>/<instance>/<name>[-<key>_<value>]
+// where the labels are sorted by the name, like the InfluxDB tags of /write.
+func (s *Scraper) Metric(job Job, instance string, sample Sample) string {
+	names := []string{}
+	for k := range sample.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	res := sample.Name
+	for _, k := range names {
+		res += "-" + strings.Replace(k+"_"+sample.Labels[k], "/", "_", -1)
+	}
+
+	res = job.Name + "/" + strings.Replace(instance, "/", "_", -1) + "/" + res
+	if s.Prefix != "" {
+		res = s.Prefix + "/" + res
+	}
+	return res
+}
+
+// DSType returns the DS type of the sample, the counters are floats, so
+// they are DDERIVE by default.
+func DSType(sampleType, counterType string) string {
+	if sampleType != "counter" {
+		return "GAUGE"
+	}
+
+	if counterType == "" {
+		return "DDERIVE"
+	}
+	return strings.ToUpper(counterType)
+}
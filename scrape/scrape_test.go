@@ -0,0 +1,142 @@
+package scrape
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/writer"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exposition = `
+# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE temperature gauge
+temperature{path="/dev/sda",escaped="a\"b\\c\nd"} -12.5
+
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+
+# TYPE request_duration histogram
+request_duration_bucket{le="+Inf"} 144320
+request_duration_count 144320
+
+up 1
+missing NaN
+`
+
+func TestParseTextFormat(test *testing.T) {
+	want := []Sample{
+		{"http_requests_total", map[string]string{"method": "post", "code": "200"}, "counter", 1027},
+		{"http_requests_total", map[string]string{"method": "post", "code": "400"}, "counter", 3},
+		{"temperature", map[string]string{"path": "/dev/sda", "escaped": "a\"b\\c\nd"}, "gauge", -12.5},
+		{"rpc_duration_seconds", map[string]string{"quantile": "0.5"}, "summary", 4773},
+		{"rpc_duration_seconds_sum", map[string]string{}, "counter", 1.7560473e+07},
+		{"rpc_duration_seconds_count", map[string]string{}, "counter", 2693},
+		{"request_duration_bucket", map[string]string{"le": "+Inf"}, "counter", 144320},
+		{"request_duration_count", map[string]string{}, "counter", 144320},
+		{"up", map[string]string{}, "untyped", 1},
+	}
+
+	res, err := ParseTextFormat(strings.NewReader(exposition))
+	if err != nil {
+		test.Fatalf("Error parse: %v", err)
+	}
+
+	if len(res) != len(want)+1 || !math.IsNaN(res[len(res)-1].Value) {
+		test.Fatalf("Result: %+v\nWant:   %+v\n", res, want)
+	}
+
+	if !reflect.DeepEqual(res[:len(want)], want) {
+		test.Errorf("Result: %+v\nWant:   %+v\n", res[:len(want)], want)
+	}
+
+	for _, s := range []string{`metric{a="1" 1`, `metric{a=1} 1`, `metric abc`, `{a="1"} 1`} {
+		if _, err := ParseTextFormat(strings.NewReader(s)); err == nil {
+			test.Errorf("Sample: %s\nError expected\n", s)
+		}
+	}
+}
+
+type testSink map[string]writer.DataSource
+
+func (s testSink) Write(metric string, t time.Time, values []writer.DataSource) error {
+	for _, v := range values {
+		s[metric+":"+v.Name] = v
+	}
+	return nil
+}
+
+func TestScrape(test *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, exposition)
+	}))
+	defer exporter.Close()
+
+	sink := testSink{}
+	scraper := NewScraper(sink)
+
+	job := Job{
+		Name:    "node",
+		Targets: []string{exporter.URL},
+		Allow:   []string{"http_*", "temperature"},
+	}
+
+	if err := scraper.Scrape(job, exporter.URL, time.Now()); err != nil {
+		test.Fatalf("Scrape error: %v", err)
+	}
+
+	instance := strings.Replace(strings.TrimPrefix(exporter.URL, "http://"), "/", "_", -1)
+	prefix := "prometheus/node/" + instance + "/"
+
+	want := testSink{
+		prefix + "http_requests_total-code_200-method_post:value":     {Name: "value", Type: "DDERIVE", Value: 1027},
+		prefix + "http_requests_total-code_400-method_post:value":     {Name: "value", Type: "DDERIVE", Value: 3},
+		prefix + "temperature-escaped_a\"b\\c\nd-path__dev_sda:value": {Name: "value", Type: "GAUGE", Value: -12.5},
+	}
+
+	if !reflect.DeepEqual(sink, want) {
+		test.Errorf("Result: %+v\nWant:   %+v\n", sink, want)
+	}
+
+	failed := httptest.NewServer(http.NotFoundHandler())
+	defer failed.Close()
+
+	if err := scraper.Scrape(job, failed.URL, time.Now()); err == nil {
+		test.Errorf("Error expected for the failed target")
+	}
+}
+
+func TestMetric(test *testing.T) {
+	scraper := NewScraper(testSink{})
+	job := Job{Name: "node"}
+
+	samples := []Sample{
+		{Name: "requests", Labels: map[string]string{"method": "GET"}},
+		{Name: "requests", Labels: map[string]string{"path": "GET"}},
+		{Name: "requests", Labels: map[string]string{"a": "1", "b": "2"}},
+		{Name: "requests", Labels: map[string]string{"a": "2", "b": "1"}},
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		m := scraper.Metric(job, "host:9100", s)
+		if seen[m] {
+			test.Errorf("Labels %v have the same metric %v", s.Labels, m)
+		}
+		seen[m] = true
+	}
+
+	if m := scraper.Metric(job, "host:9100", samples[0]); m != "prometheus/node/host:9100/requests-method_GET" {
+		test.Errorf("Incorrect metric %v", m)
+	}
+}
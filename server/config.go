@@ -4,20 +4,159 @@ import (
 	"code.google.com/p/gcfg"
 	"flag"
 	"fmt"
+	"github.com/rrdserver/rrdserver/auth"
+	"github.com/rrdserver/rrdserver/cluster"
 	"github.com/rrdserver/rrdserver/log"
+	"github.com/rrdserver/rrdserver/writer"
+	"sort"
 	"strings"
 )
 
+// MetricsConfig is the data directory, the unnamed [metrics] section keeps
+// the metrics as is, the metrics of [metrics "name"] are available as name/<metric>.
+// Write marks the single rrd section the written metrics go to.
+type MetricsConfig struct {
+	DataDir   string
+	Backend   string
+	Write     bool
+	Step      uint
+	Heartbeat uint
+	RRA       []string
+}
+
+// UpstreamConfig is the rrdserver API of the other instance, its metrics are
+// available as name/<metric>. Timeout is in seconds.
+type UpstreamConfig struct {
+	URL      string
+	Timeout  int
+	User     string
+	Password string
+}
+
 type Config struct {
+	// Server.User and Password is the single user with the plain text
+	// password, UsersFile is the htpasswd file with the bcrypt or argon2id
+	// hashes of the rest of them. TokensFile keeps the API tokens managed
+	// by the Admin users, by default it's User. CertFile and KeyFile enable
+	// HTTPS, the client certificates of ClientCAFile authenticate the users
+	// by their CN.
 	Server struct {
-		Port     int
-		Bind     string
+		Port         int
+		Bind         string
+		User         string
+		Password     string
+		UsersFile    string
+		TokensFile   string
+		Admin        []string
+		CertFile     string
+		KeyFile      string
+		ClientCAFile string
+	}
+
+	// JWT validates the OIDC bearer tokens by the JWKS file or URL, the
+	// UserClaim and GroupsClaim map them to the users and groups of the ACL.
+	JWT struct {
+		JWKS        string
+		Issuer      string
+		Audience    []string
+		UserClaim   string
+		GroupsClaim string
+	}
+
+	// CORS allows the browsers of the origins (the exact values or the
+	// patterns) to use the API, no origins disable it. MaxAge is in seconds.
+	CORS struct {
+		Origin      []string
+		Method      []string
+		Header      []string
+		MaxAge      int
+		Credentials bool
+	}
+
+	// Limits is the token bucket of every user (the remote IP without the
+	// authentication): Rate requests per second with the Burst, zero Rate
+	// disables it. MaxQueries limits the concurrent queries of all clients,
+	// the query waits for the free slot up to QueueTimeout seconds.
+	// QueryTimeout (in seconds) and MaxPoints abort the long queries.
+	// IPRate and IPBurst limit every remote IP before the authentication, so
+	// the failed logins are limited too, zero IPRate disables it. The cluster
+	// nodes aren't limited.
+	Limits struct {
+		Rate         float64
+		Burst        int
+		IPRate       float64
+		IPBurst      int
+		MaxQueries   int
+		QueueTimeout int
+		QueryTimeout int
+		MaxPoints    int
+	}
+
+	// Log is the level (debug, info, warn or error) and the output (stderr,
+	// syslog with the Facility or File) of the messages, Format is text or
+	// json.
+	Log struct {
+		Level    string
+		Output   string
+		File     string
+		Facility string
+		Format   string
+	}
+
+	// AccessLog is the file of the access log records, Format is clf
+	// (the default) or json. SIGHUP reopens the file.
+	AccessLog struct {
+		File   string
+		Format string
+	}
+
+	Metrics map[string]*MetricsConfig
+
+	// Group is the list of the users of the group, the ACL rules allow the
+	// users and the groups to access the metrics matching the Allow globs.
+	Group map[string]*struct {
+		User []string
+	}
+
+	ACL map[string]*struct {
+		User  []string
+		Group []string
+		Allow []string
+	}
+
+	Upstream map[string]*UpstreamConfig
+
+	// Index keeps the metric names in memory, Rescan is in seconds.
+	Index struct {
+		Enabled bool
+		Rescan  int
+	}
+
+	// Cluster shards the written metrics section between the nodes,
+	// every node is "<name> <url>". User and Password is the node
+	// credential of the requests between the nodes, it's required with the
+	// authentication.
+	Cluster struct {
+		Self     string
+		Node     []string
+		Replicas int
+		Timeout  int
 		User     string
 		Password string
 	}
 
-	Metrics struct {
-		DataDir string
+	Statsd struct {
+		Listen        string
+		FlushInterval int
+		Percentile    []float64
+		Prefix        string
+	}
+
+	Scrape map[string]*struct {
+		Target      []string
+		Interval    int
+		Allow       []string
+		CounterType string
 	}
 }
 
@@ -35,6 +174,8 @@ func NewConfig() Config {
 	flag.Parse()
 
 	var cfg Config
+	cfg.Statsd.FlushInterval = 10
+	cfg.Statsd.Prefix = "statsd"
 
 	if err := gcfg.ReadFileInto(&cfg, configFile); err != nil {
 		fmt.Printf("Can't read config: %v\n", err)
@@ -49,18 +190,335 @@ func NewConfig() Config {
 		cfg.Server.Bind = argBind
 	}
 
-	if cfg.Metrics.DataDir == "" {
+	if len(cfg.Metrics) == 0 {
 		fmt.Printf("Config error. DataDir isn't set.\n")
 		log.Fatal("Config error. DataDir isn't set.")
 	}
 
-	if !strings.HasSuffix(cfg.Metrics.DataDir, "/") {
-		cfg.Metrics.DataDir += "/"
+	for name, m := range cfg.Metrics {
+		if strings.Contains(name, "/") {
+			fmt.Printf("Config error. Incorrect metrics name '%v'.\n", name)
+			log.Fatal("Config error. Incorrect metrics name '%v'.", name)
+		}
+
+		if m.DataDir == "" {
+			fmt.Printf("Config error. DataDir isn't set for metrics '%v'.\n", name)
+			log.Fatal("Config error. DataDir isn't set for metrics '%v'.", name)
+		}
+
+		if !strings.HasSuffix(m.DataDir, "/") {
+			m.DataDir += "/"
+		}
+
+		switch strings.ToLower(m.Backend) {
+		case "", "rrd", "whisper", "munin":
+		default:
+			fmt.Printf("Config error. Incorrect backend '%v' for metrics '%v'.\n", m.Backend, name)
+			log.Fatal("Config error. Incorrect backend '%v' for metrics '%v'.", m.Backend, name)
+		}
+	}
+
+	writes := []string{}
+	for name, m := range cfg.Metrics {
+		if !m.Write {
+			continue
+		}
+		writes = append(writes, name)
+
+		switch strings.ToLower(m.Backend) {
+		case "", "rrd":
+		default:
+			fmt.Printf("Config error. Metrics '%v' with backend '%v' can't be written.\n", name, m.Backend)
+			log.Fatal("Config error. Metrics '%v' with backend '%v' can't be written.", name, m.Backend)
+		}
+	}
+
+	if len(writes) > 1 {
+		sort.Strings(writes)
+		fmt.Printf("Config error. Only one metrics section can be written, got %v.\n", writes)
+		log.Fatal("Config error. Only one metrics section can be written, got %v.", writes)
+	}
+
+	if len(writes) == 0 && (cfg.Statsd.Listen != "" || len(cfg.Scrape) > 0 || len(cfg.Cluster.Node) > 0) {
+		fmt.Printf("Config error. StatsD, scrape and cluster need the metrics section with write = true.\n")
+		log.Fatal("Config error. StatsD, scrape and cluster need the metrics section with write = true.")
+	}
+
+	for name, up := range cfg.Upstream {
+		if name == "" || strings.Contains(name, "/") {
+			fmt.Printf("Config error. Incorrect upstream name '%v'.\n", name)
+			log.Fatal("Config error. Incorrect upstream name '%v'.", name)
+		}
+
+		if _, ok := cfg.Metrics[name]; ok {
+			fmt.Printf("Config error. Upstream '%v' has the same name as metrics.\n", name)
+			log.Fatal("Config error. Upstream '%v' has the same name as metrics.", name)
+		}
+
+		if up.URL == "" {
+			fmt.Printf("Config error. URL isn't set for upstream '%v'.\n", name)
+			log.Fatal("Config error. URL isn't set for upstream '%v'.", name)
+		}
+
+		if up.Timeout <= 0 {
+			up.Timeout = 10
+		}
+	}
+
+	if len(cfg.Cluster.Node) > 0 {
+		if _, err := cfg.ClusterNodes(); err != nil {
+			fmt.Printf("Config error. %v.\n", err)
+			log.Fatal("Config error. %v.", err)
+		}
+
+		if cfg.Cluster.Self == "" {
+			fmt.Printf("Config error. Cluster self node isn't set.\n")
+			log.Fatal("Config error. Cluster self node isn't set.")
+		}
+
+		if cfg.AuthEnabled() && (cfg.Cluster.User == "" || cfg.Cluster.Password == "") {
+			fmt.Printf("Config error. Cluster user and password should be set with the authentication.\n")
+			log.Fatal("Config error. Cluster user and password should be set with the authentication.")
+		}
+
+		if cfg.Cluster.Replicas <= 0 {
+			cfg.Cluster.Replicas = 128
+		}
+
+		if cfg.Cluster.Timeout <= 0 {
+			cfg.Cluster.Timeout = 10
+		}
+	}
+
+	if (cfg.Server.CertFile == "") != (cfg.Server.KeyFile == "") {
+		fmt.Printf("Config error. Both certfile and keyfile should be set.\n")
+		log.Fatal("Config error. Both certfile and keyfile should be set.")
+	}
+
+	if cfg.Server.ClientCAFile != "" && cfg.Server.CertFile == "" {
+		fmt.Printf("Config error. The client certificates need certfile and keyfile.\n")
+		log.Fatal("Config error. The client certificates need certfile and keyfile.")
+	}
+
+	if cfg.Server.TokensFile != "" && !cfg.AuthEnabled() {
+		fmt.Printf("Config error. The tokens need the users, set usersfile or user and password.\n")
+		log.Fatal("Config error. The tokens need the users, set usersfile or user and password.")
+	}
+
+	for name, acl := range cfg.ACL {
+		if !cfg.AuthEnabled() {
+			fmt.Printf("Config error. The ACL need the users, set usersfile or user and password.\n")
+			log.Fatal("Config error. The ACL need the users, set usersfile or user and password.")
+		}
+
+		if len(acl.Allow) == 0 || len(acl.User)+len(acl.Group) == 0 {
+			fmt.Printf("Config error. ACL '%v' should have allow and user or group.\n", name)
+			log.Fatal("Config error. ACL '%v' should have allow and user or group.", name)
+		}
+
+		// The groups of JWT aren't known in advance.
+		for _, g := range acl.Group {
+			if _, ok := cfg.Group[g]; !ok && cfg.JWT.JWKS == "" {
+				fmt.Printf("Config error. Unknown group '%v' in ACL '%v'.\n", g, name)
+				log.Fatal("Config error. Unknown group '%v' in ACL '%v'.", g, name)
+			}
+		}
+	}
+
+	if cfg.JWT.UserClaim == "" {
+		cfg.JWT.UserClaim = "sub"
+	}
+
+	if cfg.JWT.GroupsClaim == "" {
+		cfg.JWT.GroupsClaim = "groups"
+	}
+
+	if len(cfg.Server.Admin) == 0 && cfg.Server.User != "" {
+		cfg.Server.Admin = []string{cfg.Server.User}
+	}
+
+	if cfg.Limits.Rate < 0 || cfg.Limits.Burst < 0 || cfg.Limits.IPRate < 0 || cfg.Limits.IPBurst < 0 ||
+		cfg.Limits.MaxQueries < 0 || cfg.Limits.QueueTimeout < 0 || cfg.Limits.QueryTimeout < 0 || cfg.Limits.MaxPoints < 0 {
+		fmt.Printf("Config error. Limits can't be negative.\n")
+		log.Fatal("Config error. Limits can't be negative.")
+	}
+
+	if cfg.Limits.Burst == 0 {
+		cfg.Limits.Burst = int(2*cfg.Limits.Rate) + 1
+	}
+
+	if cfg.Limits.IPBurst == 0 && cfg.Limits.IPRate > 0 {
+		cfg.Limits.IPBurst = int(2*cfg.Limits.IPRate) + 1
+	}
+
+	if _, err := log.ParseLevel(cfg.Log.Level); err != nil {
+		fmt.Printf("Config error. %v.\n", err)
+		log.Fatal("Config error. %v.", err)
+	}
+
+	if _, err := log.ParseFacility(cfg.Log.Facility); err != nil {
+		fmt.Printf("Config error. %v.\n", err)
+		log.Fatal("Config error. %v.", err)
+	}
+
+	switch strings.ToLower(cfg.Log.Output) {
+	case "", "stderr", "syslog":
+	case "file":
+		if cfg.Log.File == "" {
+			fmt.Printf("Config error. Log file isn't set.\n")
+			log.Fatal("Config error. Log file isn't set.")
+		}
+	default:
+		fmt.Printf("Config error. Incorrect log output '%v'.\n", cfg.Log.Output)
+		log.Fatal("Config error. Incorrect log output '%v'.", cfg.Log.Output)
+	}
+
+	switch strings.ToLower(cfg.Log.Format) {
+	case "", "text", "json":
+	default:
+		fmt.Printf("Config error. Incorrect log format '%v'.\n", cfg.Log.Format)
+		log.Fatal("Config error. Incorrect log format '%v'.", cfg.Log.Format)
+	}
+
+	switch strings.ToLower(cfg.AccessLog.Format) {
+	case "", "clf", "json":
+	default:
+		fmt.Printf("Config error. Incorrect access log format '%v'.\n", cfg.AccessLog.Format)
+		log.Fatal("Config error. Incorrect access log format '%v'.", cfg.AccessLog.Format)
+	}
+
+	if cfg.Index.Rescan <= 0 {
+		cfg.Index.Rescan = 600
+	}
+
+	if cfg.Statsd.FlushInterval <= 0 {
+		fmt.Printf("Config error. Statsd FlushInterval should be positive.\n")
+		log.Fatal("Config error. Statsd FlushInterval should be positive.")
+	}
+
+	if len(cfg.Statsd.Percentile) == 0 {
+		cfg.Statsd.Percentile = []float64{90}
+	}
+
+	for name, job := range cfg.Scrape {
+		if job.Interval <= 0 {
+			job.Interval = 15
+		}
+
+		switch strings.ToUpper(job.CounterType) {
+		case "", "COUNTER", "DERIVE", "DCOUNTER", "DDERIVE":
+		default:
+			fmt.Printf("Config error. Incorrect countertype '%v' for scrape job '%v'.\n", job.CounterType, name)
+			log.Fatal("Config error. Incorrect countertype '%v' for scrape job '%v'.", job.CounterType, name)
+		}
 	}
 
 	return cfg
 }
 
+// LogOptions returns the setup of the log package.
+func (cfg Config) LogOptions() log.Options {
+	level, _ := log.ParseLevel(cfg.Log.Level)
+	return log.Options{
+		Level:    level,
+		Output:   strings.ToLower(cfg.Log.Output),
+		File:     cfg.Log.File,
+		Facility: cfg.Log.Facility,
+		JSON:     strings.ToLower(cfg.Log.Format) == "json",
+	}
+}
+
+// WriteMetrics returns the name of the metrics section with write = true,
+// ok is false if the writes are disabled.
+func (cfg Config) WriteMetrics() (name string, ok bool) {
+	for name, m := range cfg.Metrics {
+		if m.Write {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (cfg Config) WriterTemplate() writer.Template {
+	res := writer.DefaultTemplate()
+	name, ok := cfg.WriteMetrics()
+	if !ok {
+		return res
+	}
+	m := cfg.Metrics[name]
+
+	if m.Step > 0 {
+		res.Step = m.Step
+		res.Heartbeat = m.Step * 2
+	}
+
+	if m.Heartbeat > 0 {
+		res.Heartbeat = m.Heartbeat
+	}
+
+	if len(m.RRA) > 0 {
+		res.RRA = m.RRA
+	}
+
+	return res
+}
+
+// AuthEnabled returns true if the requests should be authenticated.
+func (cfg Config) AuthEnabled() bool {
+	return cfg.Server.UsersFile != "" || (cfg.Server.User != "" && cfg.Server.Password != "") ||
+		cfg.JWT.JWKS != "" || cfg.Server.ClientCAFile != ""
+}
+
+// UserGroups returns the groups of every user.
+func (cfg Config) UserGroups() map[string][]string {
+	res := make(map[string][]string)
+	for name, g := range cfg.Group {
+		for _, u := range g.User {
+			res[u] = append(res[u], name)
+		}
+	}
+	return res
+}
+
+// AccessControl returns the ACL of the config, nil if there are no rules.
+// The admins and the cluster user authenticated by the password aren't limited.
+func (cfg Config) AccessControl() *auth.ACL {
+	if len(cfg.ACL) == 0 {
+		return nil
+	}
+
+	res := &auth.ACL{Admins: make(map[string]bool)}
+	for _, name := range append(cfg.Server.Admin, cfg.Server.User, cfg.Cluster.User) {
+		if name != "" {
+			res.Admins[name] = true
+		}
+	}
+
+	names := []string{}
+	for name := range cfg.ACL {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		acl := cfg.ACL[name]
+		res.Rules = append(res.Rules, auth.Rule{Users: acl.User, Groups: acl.Group, Allow: acl.Allow})
+	}
+	return res
+}
+
+func (cfg Config) ClusterNodes() ([]cluster.Node, error) {
+	res := []cluster.Node{}
+	for _, n := range cfg.Cluster.Node {
+		items := strings.Fields(n)
+		if len(items) != 2 {
+			return nil, fmt.Errorf("Incorrect cluster node '%v', should be '<name> <url>'", n)
+		}
+		res = append(res, cluster.Node{Name: items[0], URL: items[1]})
+	}
+	return res, nil
+}
+
 func flagIsSet(name string) bool {
 	res := false
 	flag.Visit(func(f *flag.Flag) {
@@ -1,55 +1,327 @@
 package rrdserver
 
 import (
-	"encoding/base64"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rrdserver/rrdserver/api"
+	"github.com/rrdserver/rrdserver/auth"
+	"github.com/rrdserver/rrdserver/cluster"
 	"github.com/rrdserver/rrdserver/log"
+	"github.com/rrdserver/rrdserver/scrape"
+	"github.com/rrdserver/rrdserver/statsd"
+	"github.com/rrdserver/rrdserver/writer"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func Serve() {
 	config := NewConfig()
+	if err := log.Setup(config.LogOptions()); err != nil {
+		log.Warning("%v, logging to stderr", err)
+	}
 
 	router := mux.NewRouter()
 	router.Methods("OPTIONS").HandlerFunc(optionsHandler)
 	router.Path("/").HandlerFunc(indexHandler)
 	router.Path("/index.html").HandlerFunc(indexHandler)
 
+	// Writer .........................
+	var rrdWriter *writer.Writer
+	var sink writer.Sink
+	writeName, writeEnabled := config.WriteMetrics()
+	writeMetrics := config.Metrics[writeName]
+	if writeEnabled {
+		rrdWriter = writer.NewWriter(writeMetrics.DataDir, config.WriterTemplate())
+		sink = rrdWriter
+	}
+
 	// API ............................
-	api := api.NewAPI(config.Metrics.DataDir)
-	api.Serve(router)
-	api.Serve(router.PathPrefix("/api/v1/").Subrouter())
-	api.Serve(router.PathPrefix("/api/").Subrouter())
+	storage := api.NewMultiStorage()
+	for name, m := range config.Metrics {
+		storage.Add(name, newStorage(m.Backend, m.DataDir))
+	}
+
+	// Cluster ........................
+	var isNode func(r *http.Request) bool
+	if len(config.Cluster.Node) > 0 {
+		nodes, _ := config.ClusterNodes()
+		c, err := cluster.New(config.Cluster.Self, writeMetrics.DataDir, nodes,
+			config.Cluster.Replicas, time.Duration(config.Cluster.Timeout)*time.Second)
+		if err != nil {
+			log.Fatal("Can't create cluster: %v", err)
+		}
+		c.User = config.Cluster.User
+		c.Password = config.Cluster.Password
+
+		local := newStorage(writeMetrics.Backend, writeMetrics.DataDir)
+		c.Serve(router, local, rrdWriter)
+		isNode = c.IsNode
+
+		storage.Add(writeName, cluster.NewStorage(c, local))
+		sink = cluster.NewWriter(c, rrdWriter)
+		log.Info("Cluster node '%v' of %v nodes", c.Self, len(nodes))
+	}
+
+	for name, up := range config.Upstream {
+		remote := api.NewRemoteStorage(name, up.URL, time.Duration(up.Timeout)*time.Second)
+		remote.User = up.User
+		remote.Password = up.Password
+		storage.Add(name, remote)
+	}
+
+	// Index ..........................
+	var apiStorage api.Storage = storage
+	if config.Index.Enabled {
+		dirs := []string{}
+		for _, m := range config.Metrics {
+			dirs = append(dirs, m.DataDir)
+		}
+
+		index := api.NewIndex(storage, time.Duration(config.Index.Rescan)*time.Second, dirs...)
+		index.Start()
+		router.Methods("GET").Path("/index/status").HandlerFunc(index.StatusHandler)
+		apiStorage = index
+	}
+
+	restAPI := api.NewAPI("")
+	restAPI.Storage = apiStorage
+	restAPI.Writer = sink
+	if acl := config.AccessControl(); acl != nil {
+		restAPI.Allow = func(r *http.Request) func(string) bool {
+			user, _ := auth.FromRequest(r)
+			return acl.Allow(user)
+		}
+	}
+	if config.Limits.MaxQueries > 0 {
+		restAPI.Xports = api.NewSemaphore(config.Limits.MaxQueries, time.Duration(config.Limits.QueueTimeout)*time.Second)
+	}
+	restAPI.QueryTimeout = time.Duration(config.Limits.QueryTimeout) * time.Second
+	restAPI.MaxPoints = config.Limits.MaxPoints
+	restAPI.Serve(router)
+	restAPI.Serve(router.PathPrefix("/api/v1/").Subrouter())
+	restAPI.Serve(router.PathPrefix("/api/").Subrouter())
+
+	// StatsD .........................
+	if config.Statsd.Listen != "" {
+		s := statsd.NewServer(config.Statsd.Listen, sink)
+		s.FlushInterval = time.Duration(config.Statsd.FlushInterval) * time.Second
+		s.Percentiles = config.Statsd.Percentile
+		s.Prefix = config.Statsd.Prefix
+
+		go func() {
+			log.Info("StatsD listen: %v", config.Statsd.Listen)
+			if err := s.ListenAndServe(); err != nil {
+				log.Fatal("Can't start StatsD listener: %v", err)
+			}
+		}()
+	}
+
+	// Prometheus scrape ..............
+	if len(config.Scrape) > 0 {
+		scraper := scrape.NewScraper(sink)
+		for name, job := range config.Scrape {
+			scraper.Jobs = append(scraper.Jobs, scrape.Job{
+				Name:        name,
+				Targets:     job.Target,
+				Interval:    time.Duration(job.Interval) * time.Second,
+				Allow:       job.Allow,
+				CounterType: job.CounterType,
+			})
+		}
+		scraper.Start()
+	}
+
+	// Rate limit of the users ........
+	// The cluster nodes aren't limited by it and by the IP rate limit.
+	var handler http.Handler = router
+	if config.Limits.Rate > 0 {
+		limit := api.NewRateLimitHandler(api.NewRateLimiter(config.Limits.Rate, config.Limits.Burst), handler)
+		limit.Key = func(r *http.Request) string {
+			if user, ok := auth.FromRequest(r); ok {
+				return user.Name
+			}
+			return api.RemoteIP(r)
+		}
+		limit.Skip = isNode
+		handler = limit
+	}
+
+	// Access log gets the user of the authenticated requests.
+	if config.AccessLog.File != "" {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, ok := auth.FromRequest(r); ok {
+				api.SetAccessUser(r, user.Name)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 
 	// Auth ...........................
-	var handler http.Handler
-	if config.Server.User != "" && config.Server.Password != "" {
-		var users = make(map[string]string)
-		users[config.Server.User] = config.Server.Password
-		handler = NewAuthHandler(users, handler)
-	} else {
-		handler = router
+	if config.AuthEnabled() {
+		users := auth.NewUsers(config.Server.UsersFile)
+		if err := users.Load(); err != nil {
+			log.Fatal("Can't load users: %v", err)
+		}
+		if config.Server.User != "" && config.Server.Password != "" {
+			users.AddStatic(config.Server.User, config.Server.Password)
+		}
+		if len(config.Cluster.Node) > 0 {
+			users.AddStatic(config.Cluster.User, config.Cluster.Password)
+		}
+
+		a := auth.NewHandler(users, handler)
+		a.WriteRequest = isWriteRequest
+		a.Groups = config.UserGroups()
+		a.ClientCerts = config.Server.ClientCAFile != ""
+
+		if config.JWT.JWKS != "" {
+			keys := auth.NewJWKS(config.JWT.JWKS)
+			if err := keys.Load(); err != nil {
+				log.Warning("Can't load JWKS: %v", err)
+			}
+
+			a.JWT = auth.NewJWTValidator(keys)
+			a.JWT.Issuer = config.JWT.Issuer
+			a.JWT.Audience = config.JWT.Audience
+			a.JWT.UserClaim = config.JWT.UserClaim
+			a.JWT.GroupsClaim = config.JWT.GroupsClaim
+		}
+
+		if config.Server.TokensFile != "" {
+			tokens, err := auth.LoadTokens(config.Server.TokensFile)
+			if err != nil {
+				log.Fatal("Can't load tokens: %v", err)
+			}
+			for _, name := range config.Server.Admin {
+				tokens.Admins[name] = true
+			}
+			tokens.Serve(router)
+			a.Tokens = tokens
+		}
+		handler = a
+	}
+
+	// Rate limit of the remote IPs goes before the authentication, so the
+	// failed logins can't make the password checks without the limit.
+	if config.Limits.IPRate > 0 {
+		limit := api.NewRateLimitHandler(api.NewRateLimiter(config.Limits.IPRate, config.Limits.IPBurst), handler)
+		limit.Skip = isNode
+		handler = limit
+	}
+
+	// CORS ...........................
+	if len(config.CORS.Origin) > 0 {
+		cors := api.DefaultCORS()
+		cors.Origins = config.CORS.Origin
+		cors.Credentials = config.CORS.Credentials
+		if len(config.CORS.Method) > 0 {
+			cors.Methods = config.CORS.Method
+		}
+		if len(config.CORS.Header) > 0 {
+			cors.Headers = config.CORS.Header
+		}
+		if config.CORS.MaxAge > 0 {
+			cors.MaxAge = config.CORS.MaxAge
+		}
+		handler = api.NewCORSHandler(cors, handler)
+	}
+
+	// Access log .....................
+	var accessLog *log.File
+	if config.AccessLog.File != "" {
+		var err error
+		if accessLog, err = log.OpenFile(config.AccessLog.File); err != nil {
+			log.Fatal("Can't open access log: %v", err)
+		}
+
+		access := api.NewAccessLogHandler(accessLog, handler)
+		access.JSON = strings.ToLower(config.AccessLog.Format) == "json"
+		handler = access
 	}
 
 	log.Info("Starting RRD server")
 	log.Info("Listen: %v:%v", config.Server.Bind, config.Server.Port)
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", config.Server.Bind, config.Server.Port), handler)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Server.Bind, config.Server.Port),
+		Handler: handler,
+	}
+
+	var certs *auth.CertStore
+	if config.Server.CertFile != "" {
+		var err error
+		certs, err = auth.NewCertStore(config.Server.CertFile, config.Server.KeyFile, config.Server.ClientCAFile)
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+		server.TLSConfig = certs.TLSConfig()
+	}
+
+	// SIGHUP reloads the renewed certificates and reopens the rotated
+	// logs.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := log.Reopen(); err != nil {
+				log.Warning("Can't reopen log file: %v", err)
+			}
+
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					log.Warning("Can't reopen access log: %v", err)
+				}
+			}
+
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Warning("%v", err)
+					continue
+				}
+				log.Info("Certificates are reloaded")
+			}
+		}
+	}()
+
+	var err error
+	if certs != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatal("Can't start server: %v", err)
 	}
 }
 
-func optionsHandler(w http.ResponseWriter, r *http.Request) {
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
+func newStorage(backend, dataDir string) api.Storage {
+	switch strings.ToLower(backend) {
+	case "whisper":
+		return api.NewWhisperStorage(dataDir)
+	case "munin":
+		return api.NewMuninStorage(dataDir)
+	default:
+		return api.NewFileStorage(dataDir)
 	}
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+// isWriteRequest returns true for the write API of all prefixes and the
+// cluster writes.
+func isWriteRequest(r *http.Request) bool {
+	return r.Method == "POST" &&
+		(strings.HasSuffix(r.URL.Path, "/write") || strings.HasSuffix(r.URL.Path, "/v1/metrics"))
+}
+
+// optionsHandler answers the OPTIONS requests which aren't the CORS
+// preflight ones.
+func optionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, POST, DELETE, OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -72,46 +344,3 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
             </html>`
 	w.Write([]byte(html))
 }
-
-type AuthHandler struct {
-	users   map[string]string
-	handler http.Handler
-}
-
-func NewAuthHandler(users map[string]string, handler http.Handler) *AuthHandler {
-	return &AuthHandler{users: users, handler: handler}
-}
-
-func (a *AuthHandler) checkAuth(w http.ResponseWriter, r *http.Request) bool {
-	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
-	if len(s) != 2 {
-		log.Warning("Incorrect authorization header: '%v'", r.Header.Get("Authorization"))
-		return false
-	}
-
-	b, err := base64.StdEncoding.DecodeString(s[1])
-	if err != nil {
-		log.Warning("Incorrect authorization header: '%v'", r.Header.Get("Authorization"))
-		return false
-	}
-
-	pair := strings.SplitN(string(b), ":", 2)
-	if len(pair) != 2 {
-		log.Warning("Incorrect authorization header: '%v'", r.Header.Get("Authorization"))
-		return false
-	}
-
-	pass, ok := a.users[pair[0]]
-	return ok && pass == pair[1]
-}
-
-func (a *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "OPTIONS" || a.checkAuth(w, r) {
-		a.handler.ServeHTTP(w, r)
-		return
-	}
-
-	w.Header().Set("WWW-Authenticate", `Basic realm="RRD server"`)
-	w.WriteHeader(401)
-	w.Write([]byte("401 Unauthorized\n"))
-}
@@ -0,0 +1,315 @@
+package statsd
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"github.com/rrdserver/rrdserver/writer"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Metric struct {
+	Name       string
+	Type       string
+	Value      float64
+	Delta      bool
+	SampleRate float64
+	Set        string
+}
+
+// ParseLine parses one statsd line: <name>:<value>|<type>[|@<rate>]
+func ParseLine(line string) (Metric, error) {
+	line = strings.TrimSpace(line)
+
+	items := strings.SplitN(line, ":", 2)
+	if len(items) < 2 || items[0] == "" {
+		return Metric{}, fmt.Errorf("Incorrect statsd line '%v'", line)
+	}
+
+	res := Metric{Name: items[0], SampleRate: 1}
+
+	fields := strings.Split(items[1], "|")
+	if len(fields) < 2 {
+		return Metric{}, fmt.Errorf("Incorrect statsd line '%v'", line)
+	}
+
+	res.Type = fields[1]
+	switch res.Type {
+	case "c", "g", "ms", "h", "s":
+	default:
+		return Metric{}, fmt.Errorf("Incorrect metric type '%v' in the statsd line '%v'", res.Type, line)
+	}
+
+	if res.Type == "h" {
+		res.Type = "ms"
+	}
+
+	if len(fields) > 2 {
+		if !strings.HasPrefix(fields[2], "@") {
+			return Metric{}, fmt.Errorf("Incorrect sample rate in the statsd line '%v'", line)
+		}
+
+		rate, err := strconv.ParseFloat(fields[2][1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return Metric{}, fmt.Errorf("Incorrect sample rate in the statsd line '%v'", line)
+		}
+		res.SampleRate = rate
+	}
+
+	if res.Type == "s" {
+		res.Set = fields[0]
+		return res, nil
+	}
+
+	if res.Type == "g" && (strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-")) {
+		res.Delta = true
+	}
+
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return Metric{}, fmt.Errorf("Incorrect value in the statsd line '%v'", line)
+	}
+	res.Value = v
+
+	return res, nil
+}
+
+type Aggregate struct {
+	Metric string
+	Values []writer.DataSource
+}
+
+type Server struct {
+	Addr          string
+	FlushInterval time.Duration
+	Percentiles   []float64
+	Prefix        string
+	Writer        writer.Sink
+
+	mutex    sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string][]float64
+	sets     map[string]map[string]bool
+}
+
+func NewServer(addr string, w writer.Sink) *Server {
+	return &Server{
+		Addr:          addr,
+		FlushInterval: 10 * time.Second,
+		Percentiles:   []float64{90},
+		Prefix:        "statsd",
+		Writer:        w,
+		counters:      make(map[string]float64),
+		gauges:        make(map[string]float64),
+		timers:        make(map[string][]float64),
+		sets:          make(map[string]map[string]bool),
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go s.flushLoop()
+
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		s.Process(string(buf[:n]))
+	}
+}
+
+// Process handles a packet which can contain several newline separated lines.
+func (s *Server) Process(packet string) {
+	for _, line := range strings.Split(packet, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		m, err := ParseLine(line)
+		if err != nil {
+			log.Warning("%v", err)
+			continue
+		}
+		s.Add(m)
+	}
+}
+
+func (s *Server) Add(m Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch m.Type {
+	case "c":
+		s.counters[m.Name] += m.Value / m.SampleRate
+
+	case "g":
+		if m.Delta {
+			s.gauges[m.Name] += m.Value
+		} else {
+			s.gauges[m.Name] = m.Value
+		}
+
+	case "ms":
+		s.timers[m.Name] = append(s.timers[m.Name], m.Value)
+		s.counters[timerCountKey(m.Name)] += 1 / m.SampleRate
+
+	case "s":
+		if _, ok := s.sets[m.Name]; !ok {
+			s.sets[m.Name] = make(map[string]bool)
+		}
+		s.sets[m.Name][m.Set] = true
+	}
+}
+
+// Timer sample counts share the counters map, the key can't collide with
+// a real metric name because statsd names never contain '|'.
+func timerCountKey(name string) string {
+	return "|" + name
+}
+
+func (s *Server) flushLoop() {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	for t := range ticker.C {
+		for _, a := range s.Flush() {
+			if err := s.Writer.Write(a.Metric, t, a.Values); err != nil {
+				log.Warning("Can't write statsd metric '%v': %v", a.Metric, err)
+			}
+		}
+	}
+}
+
+// Flush returns aggregates collected since the previous flush and resets
+// counters, timers and sets. Gauges keep their last value.
+func (s *Server) Flush() []Aggregate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	interval := s.FlushInterval.Seconds()
+	res := []Aggregate{}
+
+	for name, v := range s.counters {
+		if strings.HasPrefix(name, "|") {
+			continue
+		}
+
+		res = append(res, Aggregate{
+			Metric: s.path("counters", name),
+			Values: []writer.DataSource{
+				{Name: "count", Type: "GAUGE", Value: v},
+				{Name: "rate", Type: "GAUGE", Value: v / interval},
+			},
+		})
+	}
+
+	for name, v := range s.gauges {
+		res = append(res, Aggregate{
+			Metric: s.path("gauges", name),
+			Values: []writer.DataSource{{Name: "value", Type: "GAUGE", Value: v}},
+		})
+	}
+
+	for name, values := range s.timers {
+		res = append(res, Aggregate{
+			Metric: s.path("timers", name),
+			Values: timerValues(values, s.counters[timerCountKey(name)], interval, s.Percentiles),
+		})
+	}
+
+	for name, v := range s.sets {
+		res = append(res, Aggregate{
+			Metric: s.path("sets", name),
+			Values: []writer.DataSource{{Name: "count", Type: "GAUGE", Value: float64(len(v))}},
+		})
+	}
+
+	s.counters = make(map[string]float64)
+	s.timers = make(map[string][]float64)
+	s.sets = make(map[string]map[string]bool)
+
+	sort.Sort(byMetric(res))
+	return res
+}
+
+type byMetric []Aggregate
+
+func (a byMetric) Len() int           { return len(a) }
+func (a byMetric) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMetric) Less(i, j int) bool { return a[i].Metric < a[j].Metric }
+
+func (s *Server) path(kind, name string) string {
+	res := kind + "/" + strings.Replace(name, ".", "/", -1)
+	if s.Prefix != "" {
+		res = s.Prefix + "/" + res
+	}
+	return res
+}
+
+func timerValues(values []float64, count, interval float64, percentiles []float64) []writer.DataSource {
+	sort.Float64s(values)
+
+	n := len(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	sqDiff := 0.0
+	for _, v := range values {
+		sqDiff += (v - mean) * (v - mean)
+	}
+
+	median := values[n/2]
+	if n%2 == 0 {
+		median = (values[n/2-1] + values[n/2]) / 2
+	}
+
+	res := []writer.DataSource{
+		{Name: "count", Type: "GAUGE", Value: count},
+		{Name: "rate", Type: "GAUGE", Value: count / interval},
+		{Name: "lower", Type: "GAUGE", Value: values[0]},
+		{Name: "upper", Type: "GAUGE", Value: values[n-1]},
+		{Name: "mean", Type: "GAUGE", Value: mean},
+		{Name: "median", Type: "GAUGE", Value: median},
+		{Name: "sum", Type: "GAUGE", Value: sum},
+		{Name: "stddev", Type: "GAUGE", Value: math.Sqrt(sqDiff / float64(n))},
+	}
+
+	for _, p := range percentiles {
+		k := int(math.Floor(p/100*float64(n) + 0.5))
+		if k < 1 {
+			k = 1
+		}
+		if k > n {
+			k = n
+		}
+
+		pSum := 0.0
+		for _, v := range values[:k] {
+			pSum += v
+		}
+
+		suffix := strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+		res = append(res,
+			writer.DataSource{Name: "upper_" + suffix, Type: "GAUGE", Value: values[k-1]},
+			writer.DataSource{Name: "mean_" + suffix, Type: "GAUGE", Value: pSum / float64(k)})
+	}
+
+	return res
+}
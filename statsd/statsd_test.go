@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(test *testing.T) {
+	cases := []struct {
+		line string
+		want Metric
+		err  bool
+	}{
+		{"app.requests:1|c", Metric{Name: "app.requests", Type: "c", Value: 1, SampleRate: 1}, false},
+		{"app.requests:10|c|@0.1", Metric{Name: "app.requests", Type: "c", Value: 10, SampleRate: 0.1}, false},
+		{"app.load:0.5|g", Metric{Name: "app.load", Type: "g", Value: 0.5, SampleRate: 1}, false},
+		{"app.load:+3|g", Metric{Name: "app.load", Type: "g", Value: 3, Delta: true, SampleRate: 1}, false},
+		{"app.load:-3|g", Metric{Name: "app.load", Type: "g", Value: -3, Delta: true, SampleRate: 1}, false},
+		{"app.time:320|ms", Metric{Name: "app.time", Type: "ms", Value: 320, SampleRate: 1}, false},
+		{"app.time:320|h", Metric{Name: "app.time", Type: "ms", Value: 320, SampleRate: 1}, false},
+		{"app.users:bob|s", Metric{Name: "app.users", Type: "s", Set: "bob", SampleRate: 1}, false},
+
+		{"app.requests", Metric{}, true},
+		{"app.requests:1", Metric{}, true},
+		{":1|c", Metric{}, true},
+		{"app.requests:1|x", Metric{}, true},
+		{"app.requests:abc|c", Metric{}, true},
+		{"app.requests:1|c|0.1", Metric{}, true},
+		{"app.requests:1|c|@2", Metric{}, true},
+	}
+
+	for _, c := range cases {
+		res, err := ParseLine(c.line)
+		if c.err {
+			if err == nil {
+				test.Errorf("Line: %s\nError expected, got %+v\n", c.line, res)
+			}
+			continue
+		}
+
+		if err != nil {
+			test.Errorf("Line: %s\nError parse: %v\n", c.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(res, c.want) {
+			test.Errorf("Line: %s\nResult: %+v\nWant:   %+v\n", c.line, res, c.want)
+		}
+	}
+}
+
+func TestFlush(test *testing.T) {
+	s := NewServer("", nil)
+	s.FlushInterval = 10 * time.Second
+
+	s.Process("app.requests:1|c\napp.requests:4|c|@0.5\n")
+	s.Process("app.load:5|g\napp.load:+2|g")
+	s.Process("app.users:bob|s\napp.users:alice|s\napp.users:bob|s")
+	for _, v := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		s.Process("app.time:" + v + "|ms")
+	}
+
+	want := map[string]map[string]float64{
+		"statsd/counters/app/requests": {"count": 9, "rate": 0.9},
+		"statsd/gauges/app/load":       {"value": 7},
+		"statsd/sets/app/users":        {"count": 2},
+		"statsd/timers/app/time": {
+			"count":    10,
+			"rate":     1,
+			"lower":    1,
+			"upper":    10,
+			"mean":     5.5,
+			"median":   5.5,
+			"sum":      55,
+			"stddev":   2.8722813232690143,
+			"upper_90": 9,
+			"mean_90":  5,
+		},
+	}
+
+	check := func(res []Aggregate, want map[string]map[string]float64) {
+		got := make(map[string]map[string]float64)
+		for _, a := range res {
+			got[a.Metric] = make(map[string]float64)
+			for _, v := range a.Values {
+				got[a.Metric][v.Name] = v.Value
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			test.Errorf("Result: %+v\nWant:   %+v\n", got, want)
+		}
+	}
+
+	check(s.Flush(), want)
+
+	// Only gauges survive a flush.
+	check(s.Flush(), map[string]map[string]float64{
+		"statsd/gauges/app/load": {"value": 7},
+	})
+}
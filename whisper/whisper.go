@@ -0,0 +1,216 @@
+// Package whisper reads the Graphite Whisper (.wsp) files.
+package whisper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	metadataSize    = 16
+	archiveInfoSize = 12
+	pointSize       = 12
+)
+
+var aggregationMethods = map[uint32]string{
+	1: "average",
+	2: "sum",
+	3: "last",
+	4: "max",
+	5: "min",
+	6: "avg_zero",
+	7: "absmax",
+	8: "absmin",
+}
+
+type Archive struct {
+	Step   uint32
+	Points uint32
+
+	offset uint32
+}
+
+func (a Archive) Retention() uint32 {
+	return a.Step * a.Points
+}
+
+type File struct {
+	Name              string
+	AggregationMethod string
+	MaxRetention      uint32
+	XFilesFactor      float32
+	Archives          []Archive
+}
+
+func readAt(f *os.File, offset int64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("unexpected end of file")
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Open reads the header of the Whisper file, the data is read by Fetch.
+func Open(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res, err := readHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s file: %v", name, err)
+	}
+	res.Name = name
+	return res, nil
+}
+
+func readHeader(f *os.File) (*File, error) {
+	buf, err := readAt(f, 0, metadataSize)
+	if err != nil {
+		return nil, err
+	}
+
+	be := binary.BigEndian
+	res := &File{
+		AggregationMethod: aggregationMethods[be.Uint32(buf[0:])],
+		MaxRetention:      be.Uint32(buf[4:]),
+		XFilesFactor:      math.Float32frombits(be.Uint32(buf[8:])),
+	}
+	archiveCnt := be.Uint32(buf[12:])
+
+	if res.AggregationMethod == "" || archiveCnt == 0 || archiveCnt > 1024 {
+		return nil, errors.New("not a Whisper file")
+	}
+
+	if buf, err = readAt(f, metadataSize, int(archiveCnt)*archiveInfoSize); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(archiveCnt); i++ {
+		o := i * archiveInfoSize
+		a := Archive{
+			offset: be.Uint32(buf[o:]),
+			Step:   be.Uint32(buf[o+4:]),
+			Points: be.Uint32(buf[o+8:]),
+		}
+		if a.Step == 0 || a.Points == 0 {
+			return nil, errors.New("corrupted archive info")
+		}
+		res.Archives = append(res.Archives, a)
+	}
+
+	return res, nil
+}
+
+func (f *File) readArchive(a Archive) ([]byte, error) {
+	file, err := os.Open(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := readAt(file, int64(a.offset), int(a.Points)*pointSize)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s file: %v", f.Name, err)
+	}
+	return data, nil
+}
+
+// LastUpdate returns the timestamp of the latest point of the most precise archive.
+func (f *File) LastUpdate() (time.Time, error) {
+	data, err := f.readArchive(f.Archives[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	last := uint32(0)
+	for i := 0; i < len(data); i += pointSize {
+		if t := binary.BigEndian.Uint32(data[i:]); t > last {
+			last = t
+		}
+	}
+	return time.Unix(int64(last), 0), nil
+}
+
+type FetchResult struct {
+	Start  time.Time
+	End    time.Time
+	Step   time.Duration
+	Values []float64
+}
+
+// chooseArchive returns the most precise archive which still keeps the
+// start time, the same way as whisper.fetch does.
+func (f *File) chooseArchive(start, now int64) Archive {
+	for _, a := range f.Archives {
+		if now-start <= int64(a.Retention()) {
+			return a
+		}
+	}
+	return f.Archives[len(f.Archives)-1]
+}
+
+// Fetch reads the points for (start, end] in the same layout as rrd_fetch
+// returns the rows: the value with index n is the point with the timestamp
+// Start + (n+1)*Step. The point timestamp is used as the end of its interval.
+func (f *File) Fetch(start, end time.Time) (*FetchResult, error) {
+	return f.fetch(start.Unix(), end.Unix(), time.Now().Unix())
+}
+
+func (f *File) fetch(start, end, now int64) (*FetchResult, error) {
+	if end < start {
+		return nil, fmt.Errorf("Start (%v) should be less than end (%v)", start, end)
+	}
+
+	a := f.chooseArchive(start, now)
+	step := int64(a.Step)
+
+	start -= start % step
+	if end%step != 0 {
+		end += step - end%step
+	}
+
+	res := &FetchResult{
+		Start:  time.Unix(start, 0),
+		End:    time.Unix(end, 0),
+		Step:   time.Duration(step) * time.Second,
+		Values: make([]float64, (end-start)/step),
+	}
+	for i := range res.Values {
+		res.Values[i] = math.NaN()
+	}
+
+	data, err := f.readArchive(a)
+	if err != nil {
+		return nil, err
+	}
+
+	be := binary.BigEndian
+	base := int64(be.Uint32(data))
+	if base == 0 {
+		// The archive is empty.
+		return res, nil
+	}
+
+	for n := range res.Values {
+		t := start + int64(n+1)*step
+		i := ((t-base)/step%int64(a.Points) + int64(a.Points)) % int64(a.Points)
+		p := data[i*pointSize:]
+
+		if int64(be.Uint32(p)) == t {
+			res.Values[n] = math.Float64frombits(be.Uint64(p[4:]))
+		}
+	}
+
+	return res, nil
+}
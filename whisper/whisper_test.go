@@ -0,0 +1,130 @@
+package whisper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+type testPoint struct {
+	time  uint32
+	value float64
+}
+
+type testArchive struct {
+	step   uint32
+	points []testPoint
+}
+
+// writeTestFile writes the Whisper file, points of every archive are given
+// in the on-disk order.
+func writeTestFile(name string, aggregation uint32, archives []testArchive) error {
+	be := binary.BigEndian
+	buf := []byte{}
+
+	u32 := func(v uint32) {
+		b := make([]byte, 4)
+		be.PutUint32(b, v)
+		buf = append(buf, b...)
+	}
+
+	last := archives[len(archives)-1]
+	u32(aggregation)
+	u32(last.step * uint32(len(last.points)))
+	u32(math.Float32bits(0.5))
+	u32(uint32(len(archives)))
+
+	offset := uint32(metadataSize + len(archives)*archiveInfoSize)
+	for _, a := range archives {
+		u32(offset)
+		u32(a.step)
+		u32(uint32(len(a.points)))
+		offset += uint32(len(a.points) * pointSize)
+	}
+
+	for _, a := range archives {
+		for _, p := range a.points {
+			u32(p.time)
+			b := make([]byte, 8)
+			be.PutUint64(b, math.Float64bits(p.value))
+			buf = append(buf, b...)
+		}
+	}
+
+	return ioutil.WriteFile(name, buf, 0600)
+}
+
+func TestFetch(test *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The ring buffer of the first archive starts from 1000000080, the
+	// point 999999960 is outdated and should be ignored.
+	archives := []testArchive{
+		{60, []testPoint{{1000000080, 3}, {1000000140, 4}, {999999960, 9}, {1000000020, 2}}},
+		{300, []testPoint{{999999900, 10}, {1000000200, 20}}},
+	}
+
+	name := dir + "/test.wsp"
+	if err := writeTestFile(name, 1, archives); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+
+	f, err := Open(name)
+	if err != nil {
+		test.Fatalf("Can't open test file: %v", err)
+	}
+
+	if f.AggregationMethod != "average" || len(f.Archives) != 2 || f.Archives[1].Step != 300 || f.MaxRetention != 600 {
+		test.Errorf("Incorrect header %+v", f)
+	}
+
+	if last, err := f.LastUpdate(); err != nil || last.Unix() != 1000000140 {
+		test.Errorf("Incorrect last update %v %v", last, err)
+	}
+
+	nan := math.NaN()
+	cases := []struct {
+		start, end int64
+		now        int64
+		wantStart  int64
+		want       []float64
+	}{
+		// The aligned end is the last point.
+		{999999960, 1000000140, 1000000200, 999999960, []float64{2, 3, 4}},
+		{1000000020, 1000000080, 1000000200, 1000000020, []float64{3}},
+
+		// The end is rounded up to the next point.
+		{999999990, 1000000110, 1000000200, 999999960, []float64{2, 3, 4}},
+		{999999960, 1000000141, 1000000200, 999999960, []float64{2, 3, 4, nan}},
+
+		// Out of the first archive retention.
+		{999999600, 1000000200, 1000000200, 999999600, []float64{10, 20}},
+	}
+
+	for _, c := range cases {
+		res, err := f.fetch(c.start, c.end, c.now)
+		if err != nil {
+			test.Errorf("Fetch %v-%v: %v", c.start, c.end, err)
+			continue
+		}
+
+		if res.Start.Unix() != c.wantStart || fmt.Sprint(res.Values) != fmt.Sprint(c.want) {
+			test.Errorf("Fetch %v-%v:\nResult: %v %v\nWant:   %v %v\n", c.start, c.end,
+				res.Start.Unix(), res.Values, c.wantStart, c.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(dir+"/bad.wsp", []byte("not a whisper file"), 0600); err != nil {
+		test.Fatalf("Can't write test file: %v", err)
+	}
+	if _, err := Open(dir + "/bad.wsp"); err == nil {
+		test.Errorf("Error expected for the incorrect file")
+	}
+}
@@ -0,0 +1,296 @@
+package writer
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/log"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DataSource struct {
+	Name  string
+	Type  string
+	Value float64
+}
+
+// Sink accepts values of the metric data sources, Writer is the RRD backed one.
+type Sink interface {
+	Write(metric string, t time.Time, values []DataSource) error
+}
+
+type Template struct {
+	Step      uint
+	Heartbeat uint
+	RRA       []string
+}
+
+func DefaultTemplate() Template {
+	return Template{
+		Step:      10,
+		Heartbeat: 20,
+		RRA: []string{
+			"AVERAGE:0.5:1:8640",
+			"AVERAGE:0.5:30:2016",
+			"AVERAGE:0.5:360:2976",
+			"AVERAGE:0.5:8640:1825",
+			"MIN:0.5:30:2016",
+			"MIN:0.5:360:2976",
+			"MIN:0.5:8640:1825",
+			"MAX:0.5:30:2016",
+			"MAX:0.5:360:2976",
+			"MAX:0.5:8640:1825",
+		},
+	}
+}
+
+type Writer struct {
+	DataDir  string
+	Template Template
+
+	mutex sync.Mutex
+	known map[string]map[string]bool
+}
+
+func NewWriter(dataDir string, template Template) *Writer {
+	return &Writer{
+		DataDir:  dataDir,
+		Template: template,
+		known:    make(map[string]map[string]bool),
+	}
+}
+
+var unsafeSegmentChars = regexp.MustCompile(`[^A-Za-z0-9._\-]`)
+var unsafeDSChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// SafeMetric turns an arbitrary incoming name into a relative path which
+// can be used both as a file name and inside a DEF query.
+func SafeMetric(metric string) string {
+	res := []string{}
+	for _, s := range strings.Split(metric, "/") {
+		s = unsafeSegmentChars.ReplaceAllString(s, "_")
+		if s == "" || s == "." || s == ".." {
+			continue
+		}
+		res = append(res, s)
+	}
+	return strings.Join(res, "/")
+}
+
+// DSName returns a valid RRD data source name, rrdtool allows at most
+// 19 characters from [a-zA-Z0-9_]. The longer names are cut and end with the
+// hash of the whole name, so they don't collide.
+func DSName(name string) string {
+	res := unsafeDSChars.ReplaceAllString(name, "_")
+	if len(res) > 19 {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		res = fmt.Sprintf("%s_%06x", res[:12], h.Sum32()&0xffffff)
+	}
+	if res == "" {
+		res = "value"
+	}
+	return res
+}
+
+func (w *Writer) FileForMetric(metric string) string {
+	return w.DataDir + SafeMetric(metric) + ".rrd"
+}
+
+func (w *Writer) Write(metric string, t time.Time, values []DataSource) error {
+	if SafeMetric(metric) == "" {
+		return fmt.Errorf("Incorrect metric name '%v'", metric)
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	if err := checkNames(values); err != nil {
+		return fmt.Errorf("Can't write '%v': %v", metric, err)
+	}
+
+	file := w.FileForMetric(metric)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	known, err := w.dataSources(file, t, values)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	args := []string{}
+	index := make(map[string]int)
+	for _, v := range values {
+		name := DSName(v.Name)
+		if !known[name] {
+			log.Warning("Data source '%v' isn't defined in %s file, value is skipped", name, file)
+			continue
+		}
+
+		// The later value of the same data source wins.
+		if i, ok := index[name]; ok {
+			args[i] = formatValue(v)
+			continue
+		}
+
+		index[name] = len(names)
+		names = append(names, name)
+		args = append(args, formatValue(v))
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	if err := updateFile(file, t, names, args); err != nil {
+		return fmt.Errorf("Can't update %s file: %v", file, err)
+	}
+
+	return nil
+}
+
+// checkNames rejects the different names which are the same data source,
+// e.g. "rx.bytes" and "rx-bytes".
+func checkNames(values []DataSource) error {
+	names := make(map[string]string)
+	for _, v := range values {
+		name := DSName(v.Name)
+		if prev, ok := names[name]; ok && prev != v.Name {
+			return fmt.Errorf("Data sources '%v' and '%v' have the same name '%v'", prev, v.Name, name)
+		}
+		names[name] = v.Name
+	}
+	return nil
+}
+
+// formatValue returns the value for the update, the floats are written as
+// they are: COUNTER and DERIVE data sources accept only the integer values,
+// DCOUNTER and DDERIVE should be used for the float ones.
+func formatValue(v DataSource) string {
+	if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+		return "U"
+	}
+	return strconv.FormatFloat(v.Value, 'f', -1, 64)
+}
+
+func (w *Writer) dataSources(file string, t time.Time, values []DataSource) (map[string]bool, error) {
+	if res, ok := w.known[file]; ok {
+		return res, nil
+	}
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err := w.create(file, t, values); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := fileDataSources(file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get info for %s file: %v", file, err)
+	}
+
+	res := make(map[string]bool)
+	for _, name := range names {
+		res[name] = true
+	}
+
+	w.known[file] = res
+	return res, nil
+}
+
+// dsDef and rraDef are the definitions of the created file, the files are
+// written by the pure Go rrdfile package or, with the librrd tag, by librrd.
+type dsDef struct {
+	Name      string
+	Type      string
+	Heartbeat uint
+	Min       float64
+}
+
+type rraDef struct {
+	CF    string
+	XFF   float64
+	Steps uint
+	Rows  uint
+}
+
+// parseRRA parses the template archive "CF:xff:steps:rows".
+func parseRRA(s string) (rraDef, error) {
+	items := strings.Split(s, ":")
+	if len(items) != 4 {
+		return rraDef{}, fmt.Errorf("Incorrect RRA definition '%v'", s)
+	}
+
+	xff, err := strconv.ParseFloat(items[1], 64)
+	if err != nil {
+		return rraDef{}, fmt.Errorf("Incorrect RRA definition '%v'", s)
+	}
+	steps, err := strconv.ParseUint(items[2], 10, 32)
+	if err != nil {
+		return rraDef{}, fmt.Errorf("Incorrect RRA definition '%v'", s)
+	}
+	rows, err := strconv.ParseUint(items[3], 10, 32)
+	if err != nil {
+		return rraDef{}, fmt.Errorf("Incorrect RRA definition '%v'", s)
+	}
+
+	return rraDef{CF: strings.ToUpper(items[0]), XFF: xff, Steps: uint(steps), Rows: uint(rows)}, nil
+}
+
+func (w *Writer) create(file string, t time.Time, values []DataSource) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("Can't create directory '%v' for RRD file: %v", filepath.Dir(file), err)
+	}
+
+	step := w.Template.Step
+	heartbeat := w.Template.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = step * 2
+	}
+
+	ds := []dsDef{}
+	created := make(map[string]bool)
+	for _, v := range values {
+		name := DSName(v.Name)
+		if created[name] {
+			continue
+		}
+		created[name] = true
+
+		dsType := strings.ToUpper(v.Type)
+		if dsType == "" {
+			dsType = "GAUGE"
+		}
+
+		min := math.NaN()
+		if dsType != "GAUGE" {
+			min = 0
+		}
+		ds = append(ds, dsDef{Name: name, Type: dsType, Heartbeat: heartbeat, Min: min})
+	}
+
+	rra := []rraDef{}
+	for _, r := range w.Template.RRA {
+		def, err := parseRRA(r)
+		if err != nil {
+			return err
+		}
+		rra = append(rra, def)
+	}
+
+	if err := createFile(file, t.Add(-time.Duration(step)*time.Second), step, ds, rra); err != nil {
+		return fmt.Errorf("Can't create %s file: %v", file, err)
+	}
+
+	log.Info("Created RRD file %s", file)
+	return nil
+}
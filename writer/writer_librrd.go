@@ -0,0 +1,55 @@
+//go:build librrd
+// +build librrd
+
+package writer
+
+import (
+	"fmt"
+	"github.com/ziutek/rrd"
+	"math"
+	"time"
+)
+
+func createFile(file string, start time.Time, step uint, ds []dsDef, rra []rraDef) error {
+	c := rrd.NewCreator(file, start, step)
+	for _, d := range ds {
+		min := "U"
+		if !math.IsNaN(d.Min) {
+			min = fmt.Sprint(d.Min)
+		}
+		c.DS(d.Name, d.Type, d.Heartbeat, min, "U")
+	}
+	for _, r := range rra {
+		c.RRA(r.CF, r.XFF, r.Steps, r.Rows)
+	}
+	return c.Create(false)
+}
+
+func updateFile(file string, t time.Time, names, values []string) error {
+	args := []interface{}{t}
+	for _, v := range values {
+		args = append(args, v)
+	}
+
+	u := rrd.NewUpdater(file)
+	u.SetTemplate(names...)
+	return u.Update(args...)
+}
+
+func fileDataSources(file string) ([]string, error) {
+	inf, err := rrd.Info(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := inf["ds.type"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Can't get ds.type from info")
+	}
+
+	res := []string{}
+	for ds := range v {
+		res = append(res, ds)
+	}
+	return res, nil
+}
@@ -0,0 +1,36 @@
+//go:build !librrd
+// +build !librrd
+
+package writer
+
+import (
+	"github.com/rrdserver/rrdserver/rrdfile"
+	"math"
+	"time"
+)
+
+func createFile(file string, start time.Time, step uint, ds []dsDef, rra []rraDef) error {
+	fds := []rrdfile.DS{}
+	for _, d := range ds {
+		fds = append(fds, rrdfile.DS{Name: d.Name, Type: d.Type, Heartbeat: uint64(d.Heartbeat), Min: d.Min, Max: math.NaN()})
+	}
+
+	frra := []rrdfile.RRA{}
+	for _, r := range rra {
+		frra = append(frra, rrdfile.RRA{CF: r.CF, XFF: r.XFF, PDPPerRow: uint64(r.Steps), Rows: uint64(r.Rows)})
+	}
+
+	return rrdfile.Create(file, start, uint64(step), fds, frra)
+}
+
+func updateFile(file string, t time.Time, names, values []string) error {
+	return rrdfile.Update(file, t, names, values)
+}
+
+func fileDataSources(file string) ([]string, error) {
+	f, err := rrdfile.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return f.DSNames(), nil
+}
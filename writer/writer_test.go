@@ -0,0 +1,111 @@
+package writer
+
+import (
+	"fmt"
+	"github.com/rrdserver/rrdserver/rrdfile"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFormatValue(test *testing.T) {
+	cases := []struct {
+		v    DataSource
+		want string
+	}{
+		{DataSource{Type: "GAUGE", Value: 1.5}, "1.5"},
+		{DataSource{Type: "COUNTER", Value: 100}, "100"},
+		{DataSource{Type: "DERIVE", Value: 1.5}, "1.5"},
+		{DataSource{Type: "DERIVE", Value: 1e21}, "1000000000000000000000"},
+		{DataSource{Type: "ABSOLUTE", Value: 0.25}, "0.25"},
+		{DataSource{Type: "DDERIVE", Value: -0.5}, "-0.5"},
+		{DataSource{Type: "GAUGE", Value: math.NaN()}, "U"},
+		{DataSource{Type: "COUNTER", Value: math.Inf(1)}, "U"},
+	}
+
+	for _, c := range cases {
+		if res := formatValue(c.v); res != c.want {
+			test.Errorf("%v %v\nResult: %v\nWant:   %v\n", c.v.Type, c.v.Value, res, c.want)
+		}
+	}
+}
+
+func TestDSName(test *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"value", "value"},
+		{"rx.bytes", "rx_bytes"},
+		{"", "value"},
+		{"exactly_19_chars_ab", "exactly_19_chars_ab"},
+	}
+
+	for _, c := range cases {
+		if res := DSName(c.name); res != c.want {
+			test.Errorf("%v\nResult: %v\nWant:   %v\n", c.name, res, c.want)
+		}
+	}
+
+	// The long names don't collide after cutting.
+	a, b := DSName("interface_errors_received"), DSName("interface_errors_sent")
+	if len(a) != 19 || len(b) != 19 || a == b || a[:13] != "interface_er_" {
+		test.Errorf("Incorrect long names %v %v", a, b)
+	}
+}
+
+func TestWrite(test *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		test.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewWriter(dir+"/", Template{Step: 10, RRA: []string{"AVERAGE:0.5:1:10"}})
+	start := time.Unix(1000000010, 0)
+
+	writes := [][]DataSource{
+		{{Name: "value", Type: "GAUGE", Value: 1}, {Name: "bytes", Type: "DDERIVE", Value: 0.5}},
+		{{Name: "value", Type: "GAUGE", Value: 2}, {Name: "bytes", Type: "DDERIVE", Value: 1.5}},
+		{{Name: "value", Type: "GAUGE", Value: math.NaN()}, {Name: "bytes", Type: "DDERIVE", Value: 2.5}, {Name: "extra", Value: 1}},
+	}
+	for i, values := range writes {
+		if err := w.Write("host/cpu", start.Add(time.Duration(i)*10*time.Second), values); err != nil {
+			test.Fatalf("Can't write %v: %v", values, err)
+		}
+	}
+
+	f, err := rrdfile.Open(dir + "/host/cpu.rrd")
+	if err != nil {
+		test.Fatalf("The file isn't created: %v", err)
+	}
+	if !reflect.DeepEqual(f.DSNames(), []string{"value", "bytes"}) || f.Step != 10 || f.DS[1].Type != "DDERIVE" {
+		test.Errorf("Incorrect file %+v", f)
+	}
+
+	res, err := f.Fetch("AVERAGE", start.Add(-10*time.Second), start.Add(19*time.Second), 10*time.Second)
+	if err != nil {
+		test.Fatalf("Can't fetch: %v", err)
+	}
+	got := [][]float64{}
+	for r := 0; r < res.RowCnt; r++ {
+		got = append(got, []float64{res.ValueAt(0, r), res.ValueAt(1, r)})
+	}
+	want := [][]float64{{1, math.NaN()}, {2, 0.1}, {math.NaN(), 0.1}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		test.Errorf("Incorrect values\nResult: %v\nWant:   %v\n", got, want)
+	}
+
+	values := []DataSource{{Name: "rx.bytes", Value: 1}, {Name: "rx-bytes", Value: 2}}
+	if err := w.Write("host/net", start, values); err == nil {
+		test.Errorf("Error expected for the same DS names")
+	}
+
+	// The float value of DERIVE isn't truncated, it's rejected.
+	if err := w.Write("host/derive", start, []DataSource{{Name: "value", Type: "DERIVE", Value: 1.5}}); err == nil {
+		test.Errorf("Error expected for the float DERIVE value")
+	}
+}